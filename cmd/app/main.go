@@ -1,7 +1,13 @@
 package main
 
-import "vpn-wg/internal/app"
+import (
+	"os"
+	"vpn-wg/internal/app"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(app.Import(os.Args[2:]))
+	}
 	app.Run()
 }
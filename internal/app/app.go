@@ -10,10 +10,19 @@ import (
 	"syscall"
 	"time"
 	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/firewall"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/metrics"
+	"vpn-wg/internal/netsetup"
+	"vpn-wg/internal/publicip"
 	"vpn-wg/internal/router"
 	"vpn-wg/internal/server"
 	"vpn-wg/internal/service"
 	"vpn-wg/internal/store/jsondb"
+	"vpn-wg/internal/store/traced"
+	"vpn-wg/internal/tracing"
+	"vpn-wg/internal/wgdevice"
 )
 
 func Run() {
@@ -22,24 +31,78 @@ func Run() {
 		panic(err)
 	}
 
-	db, err := jsondb.New("./db", cfg.Server, cfg.Global)
+	if err := logger.Init(cfg.Log); err != nil {
+		panic(err)
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+
+	detector, err := publicip.New(cfg.Endpoint)
 	if err != nil {
 		panic(err)
 	}
 
-	if err := db.Init(); err != nil {
+	db, err := jsondb.New("./db", cfg.Server, cfg.Global, cfg.DNS, detector)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := db.Lock(); err != nil {
+		panic(err)
+	}
+
+	if err := db.Init(context.Background()); err != nil {
 		panic(err)
 	}
 
-	services := service.NewServices(db)
+	device := wgdevice.New(cfg.Server.Interface)
+
+	if cfg.Metrics.Enabled {
+		metrics.Registry.MustRegister(metrics.NewPeerCollector(db, device, cfg.Metrics))
+		if cfg.Metrics.PerPeer {
+			metrics.Registry.MustRegister(metrics.NewPeerInfoCollector(db, cfg.Metrics))
+		}
+	}
 
-	newRouter := router.NewRouter(services)
+	services := service.NewServices(service.Deps{
+		Store:       traced.New(db),
+		Bus:         event.NewBus(),
+		Device:      device,
+		Webhook:     cfg.Webhook,
+		Stream:      cfg.Stream,
+		Idempotency: cfg.Idempotency,
+		Trash:       cfg.Trash,
+		Firewall:    cfg.Firewall,
+		Executor:    firewall.NewNftExecutor(cfg.Firewall.NftPath),
+		Network:     cfg.Network,
+		NetSetup:    netsetup.New(cfg.Network, netsetup.ExecRunner{}),
+		DNS:         cfg.DNS,
+	})
+
+	workers, stopWorkers := context.WithCancel(context.Background())
+	go services.WebhookService.Run(workers)
+	go services.StreamService.Run(workers)
+	go services.IdempotencyService.Run(workers)
+	go services.WireguardService.Run(workers)
+	go services.DNSService.Run(workers)
+
+	// a partial setup is kept and reported in the server status
+	_ = services.NetworkService.Setup(context.Background())
+
+	if err := services.WireguardService.ApplyFirewall(context.Background()); err != nil {
+		logrus.WithError(err).Error("failed to apply firewall ruleset")
+	}
+
+	newRouter := router.NewRouter(services, cfg)
 
 	srv := server.NewServer(cfg.HTTP, newRouter.Init())
 
 	go func() {
 		if err := srv.Run(); !errors.Is(err, http.ErrServerClosed) {
-			logrus.Errorf("error occurred while running http server: %s\n", err.Error())
+			logrus.WithError(err).Error("error occurred while running http server")
 		}
 	}()
 
@@ -50,13 +113,21 @@ func Run() {
 
 	<-quit
 
+	stopWorkers()
+
 	const timeout = 5 * time.Second
 
 	ctx, shutdown := context.WithTimeout(context.Background(), timeout)
 	defer shutdown()
 
 	if err := srv.Stop(ctx); err != nil {
-		logrus.Errorf("failed to stop server: %v", err)
+		logrus.WithError(err).Error("failed to stop server")
+	}
+
+	_ = services.NetworkService.Teardown(ctx)
+
+	if err := shutdownTracing(ctx); err != nil {
+		logrus.WithError(err).Error("failed to flush traces")
 	}
 
 }
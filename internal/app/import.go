@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/firewall"
+	"vpn-wg/internal/importer"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/netsetup"
+	"vpn-wg/internal/publicip"
+	"vpn-wg/internal/service"
+	"vpn-wg/internal/store/jsondb"
+	"vpn-wg/internal/wgdevice"
+)
+
+// Import runs the import command: it creates peers from a CSV or YAML file,
+// prints a line by line report and returns the process exit code
+func Import(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "input format, csv or yaml (default: from the file extension)")
+	dryRun := flags.Bool("dry-run", false, "validate the rows without creating peers")
+	archive := flags.String("zip", "", "write the client configs of the created peers to this ZIP file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: app import [-dry-run] [-format csv|yaml] [-zip configs.zip] <file>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if *format == "yml" {
+			*format = importer.FormatYAML
+		}
+	}
+
+	cfg, err := config.Init()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := logger.Init(cfg.Log); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	rows, err := importer.Parse(*format, file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	detector, err := publicip.New(cfg.Endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	db, err := jsondb.New("./db", cfg.Server, cfg.Global, cfg.DNS, detector)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// the running server would not see the new peers in its zone, stream and
+	// webhooks, and could allocate the same addresses
+	if err := db.Lock(); err != nil {
+		if errors.Is(err, jsondb.ErrLocked) {
+			fmt.Fprintln(os.Stderr, "the server is running, import through POST /api/v1/peers:import instead")
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	if err := db.Init(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	services := service.NewServices(service.Deps{
+		Store:       db,
+		Bus:         event.NewBus(),
+		Device:      wgdevice.New(cfg.Server.Interface),
+		Webhook:     cfg.Webhook,
+		Stream:      cfg.Stream,
+		Idempotency: cfg.Idempotency,
+		Trash:       cfg.Trash,
+		Firewall:    cfg.Firewall,
+		Executor:    firewall.NewNftExecutor(cfg.Firewall.NftPath),
+		Network:     cfg.Network,
+		NetSetup:    netsetup.New(cfg.Network, netsetup.ExecRunner{}),
+		DNS:         cfg.DNS,
+	})
+
+	report, err := services.ImportService.ImportPeers(ctx, rows, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := report.WriteText(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *archive != "" && !*dryRun {
+		out, err := os.Create(*archive)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := report.WriteArchive(out); err != nil {
+			out.Close()
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := out.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
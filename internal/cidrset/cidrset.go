@@ -0,0 +1,217 @@
+package cidrset
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Set is a set of IPv4 and IPv6 addresses. It is kept as sorted ranges
+// that neither overlap nor touch, so every set has one representation and
+// Prefixes returns the shortest CIDR list for it.
+type Set struct {
+	ranges []addrRange
+}
+
+type addrRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+// Parse reads a list of CIDRs. Host bits are ignored and IPv4-mapped IPv6
+// prefixes count as IPv4.
+func Parse(cidrs []string) (Set, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return Set{}, fmt.Errorf("%q is not a CIDR", cidr)
+		}
+		if prefix.Addr().Is4In6() {
+			bits := prefix.Bits() - 96
+			if bits < 0 {
+				return Set{}, fmt.Errorf("%q is not a CIDR", cidr)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return FromPrefixes(prefixes...), nil
+}
+
+// MustParse is Parse for lists known to be valid
+func MustParse(cidrs ...string) Set {
+	set, err := Parse(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// FromPrefixes returns the set of addresses in the prefixes
+func FromPrefixes(prefixes ...netip.Prefix) Set {
+	ranges := make([]addrRange, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		ranges = append(ranges, addrRange{from: prefix.Addr(), to: lastAddr(prefix)})
+	}
+	return Set{ranges: normalize(ranges)}
+}
+
+// Empty reports whether the set holds no address
+func (s Set) Empty() bool {
+	return len(s.ranges) == 0
+}
+
+// Contains reports whether every address of o is in s
+func (s Set) Contains(o Set) bool {
+	return o.Subtract(s).Empty()
+}
+
+// Overlaps reports whether s and o share an address
+func (s Set) Overlaps(o Set) bool {
+	for _, r := range s.ranges {
+		for _, x := range o.ranges {
+			if r.overlaps(x) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Union returns the addresses in s or o
+func (s Set) Union(o Set) Set {
+	ranges := make([]addrRange, 0, len(s.ranges)+len(o.ranges))
+	ranges = append(ranges, s.ranges...)
+	ranges = append(ranges, o.ranges...)
+	return Set{ranges: normalize(ranges)}
+}
+
+// Subtract returns the addresses in s that are not in o
+func (s Set) Subtract(o Set) Set {
+	ranges := make([]addrRange, 0, len(s.ranges))
+	for _, r := range s.ranges {
+		pieces := []addrRange{r}
+		for _, x := range o.ranges {
+			next := make([]addrRange, 0, len(pieces)+1)
+			for _, p := range pieces {
+				if !p.overlaps(x) {
+					next = append(next, p)
+					continue
+				}
+				if p.from.Less(x.from) {
+					next = append(next, addrRange{from: p.from, to: x.from.Prev()})
+				}
+				if x.to.Less(p.to) {
+					next = append(next, addrRange{from: x.to.Next(), to: p.to})
+				}
+			}
+			pieces = next
+		}
+		ranges = append(ranges, pieces...)
+	}
+	return Set{ranges: normalize(ranges)}
+}
+
+// Prefixes returns the shortest list of prefixes covering exactly the set,
+// IPv4 before IPv6
+func (s Set) Prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(s.ranges))
+	for _, r := range s.ranges {
+		prefixes = append(prefixes, r.prefixes()...)
+	}
+	return prefixes
+}
+
+// Strings returns Prefixes in CIDR notation
+func (s Set) Strings() []string {
+	prefixes := s.Prefixes()
+	cidrs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		cidrs = append(cidrs, prefix.String())
+	}
+	return cidrs
+}
+
+// Minimize returns the shortest CIDR list covering the same addresses
+func Minimize(cidrs []string) ([]string, error) {
+	set, err := Parse(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return set.Strings(), nil
+}
+
+func (r addrRange) overlaps(o addrRange) bool {
+	return r.from.BitLen() == o.from.BitLen() && !r.to.Less(o.from) && !o.to.Less(r.from)
+}
+
+// prefixes splits the range into the largest aligned blocks
+func (r addrRange) prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, 1)
+	from := r.from
+	for {
+		var prefix netip.Prefix
+		for bits := 0; bits <= from.BitLen(); bits++ {
+			candidate := netip.PrefixFrom(from, bits)
+			if candidate.Masked().Addr() == from && !r.to.Less(lastAddr(candidate)) {
+				prefix = candidate
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == r.to {
+			return prefixes
+		}
+		from = last.Next()
+	}
+}
+
+// normalize sorts the ranges and merges the ones that overlap or touch
+func normalize(ranges []addrRange) []addrRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].from.Less(ranges[j].from)
+	})
+	merged := []addrRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		current := &merged[len(merged)-1]
+		next := current.to.Next()
+		if r.from.BitLen() == current.from.BitLen() && (!current.to.Less(r.from) || r.from == next) {
+			if current.to.Less(r.to) {
+				current.to = r.to
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// lastAddr returns the highest address of the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		setHostBits(b[:], prefix.Bits())
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	setHostBits(b[:], prefix.Bits())
+	return netip.AddrFrom16(b)
+}
+
+func setHostBits(b []byte, bits int) {
+	for i := range b {
+		for j := 0; j < 8; j++ {
+			if i*8+j >= bits {
+				b[i] |= 0x80 >> j
+			}
+		}
+	}
+}
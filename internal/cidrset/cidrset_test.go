@@ -0,0 +1,224 @@
+package cidrset
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnion(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want []string
+	}{
+		{
+			name: "disjoint",
+			a:    []string{"10.0.0.0/24"},
+			b:    []string{"10.0.2.0/24"},
+			want: []string{"10.0.0.0/24", "10.0.2.0/24"},
+		},
+		{
+			name: "adjacent halves merge",
+			a:    []string{"10.0.0.0/25"},
+			b:    []string{"10.0.0.128/25"},
+			want: []string{"10.0.0.0/24"},
+		},
+		{
+			name: "adjacent but not aligned",
+			a:    []string{"10.0.1.0/24"},
+			b:    []string{"10.0.2.0/24"},
+			want: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			name: "contained",
+			a:    []string{"10.0.0.0/8"},
+			b:    []string{"10.1.2.0/24"},
+			want: []string{"10.0.0.0/8"},
+		},
+		{
+			name: "top of the address space",
+			a:    []string{"255.255.255.255/32"},
+			b:    []string{"255.255.255.254/32"},
+			want: []string{"255.255.255.254/31"},
+		},
+		{
+			name: "bottom and top of the address space",
+			a:    []string{"0.0.0.0/1"},
+			b:    []string{"128.0.0.0/1"},
+			want: []string{"0.0.0.0/0"},
+		},
+		{
+			name: "families stay apart",
+			a:    []string{"fd00::/8", "255.255.255.255/32"},
+			b:    []string{"0.0.0.0/32", "::/128"},
+			want: []string{"0.0.0.0/32", "255.255.255.255/32", "::/128", "fd00::/8"},
+		},
+		{
+			name: "last ipv4 and first ipv6 do not touch",
+			a:    []string{"255.255.255.255/32"},
+			b:    []string{"::/128"},
+			want: []string{"255.255.255.255/32", "::/128"},
+		},
+		{
+			name: "empty",
+			want: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MustParse(test.a...).Union(MustParse(test.b...)).Strings()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Union() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want []string
+	}{
+		{
+			name: "hole in the middle",
+			a:    []string{"10.0.0.0/24"},
+			b:    []string{"10.0.0.128/32"},
+			want: []string{"10.0.0.0/25", "10.0.0.129/32", "10.0.0.130/31", "10.0.0.132/30", "10.0.0.136/29", "10.0.0.144/28", "10.0.0.160/27", "10.0.0.192/26"},
+		},
+		{
+			name: "first address of the space",
+			a:    []string{"0.0.0.0/30"},
+			b:    []string{"0.0.0.0/32"},
+			want: []string{"0.0.0.1/32", "0.0.0.2/31"},
+		},
+		{
+			name: "last address of the space",
+			a:    []string{"255.255.255.252/30"},
+			b:    []string{"255.255.255.255/32"},
+			want: []string{"255.255.255.252/31", "255.255.255.254/32"},
+		},
+		{
+			name: "last ipv6 address",
+			a:    []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe/127"},
+			b:    []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/128"},
+			want: []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe/128"},
+		},
+		{
+			name: "everything",
+			a:    []string{"10.0.0.0/8"},
+			b:    []string{"0.0.0.0/0"},
+			want: []string{},
+		},
+		{
+			name: "other family is untouched",
+			a:    []string{"0.0.0.0/0", "fd00::/8"},
+			b:    []string{"::/0"},
+			want: []string{"0.0.0.0/0"},
+		},
+		{
+			name: "several holes",
+			a:    []string{"10.0.0.0/29"},
+			b:    []string{"10.0.0.1/32", "10.0.0.6/32"},
+			want: []string{"10.0.0.0/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.7/32"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MustParse(test.a...).Subtract(MustParse(test.b...)).Strings()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Subtract() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "host bits are ignored",
+			cidrs: []string{"10.0.0.77/24"},
+			want:  []string{"10.0.0.0/24"},
+		},
+		{
+			name:  "duplicates and overlaps",
+			cidrs: []string{"10.0.0.0/24", "10.0.0.0/24", "10.0.0.64/26"},
+			want:  []string{"10.0.0.0/24"},
+		},
+		{
+			name:  "ipv4 before ipv6",
+			cidrs: []string{"fd42::/64", "10.252.1.0/24"},
+			want:  []string{"10.252.1.0/24", "fd42::/64"},
+		},
+		{
+			name:  "ipv4-mapped ipv6 counts as ipv4",
+			cidrs: []string{"::ffff:10.0.0.0/104", "10.0.0.0/8"},
+			want:  []string{"10.0.0.0/8"},
+		},
+		{
+			name:  "ipv4-mapped host",
+			cidrs: []string{"::ffff:192.168.1.1/128"},
+			want:  []string{"192.168.1.1/32"},
+		},
+		{
+			name:  "surrounding spaces",
+			cidrs: []string{" 10.0.0.0/8 "},
+			want:  []string{"10.0.0.0/8"},
+		},
+		{
+			name:    "not a cidr",
+			cidrs:   []string{"10.0.0.0"},
+			wantErr: true,
+		},
+		{
+			name:    "ipv4-mapped prefix shorter than the mapping",
+			cidrs:   []string{"::ffff:0.0.0.0/95"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Minimize(test.cidrs)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Minimize() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Minimize() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContainsOverlaps(t *testing.T) {
+	tests := []struct {
+		name         string
+		a            []string
+		b            []string
+		wantContains bool
+		wantOverlaps bool
+	}{
+		{name: "inside", a: []string{"10.0.0.0/8"}, b: []string{"10.1.0.0/16"}, wantContains: true, wantOverlaps: true},
+		{name: "partly", a: []string{"10.0.0.0/24"}, b: []string{"10.0.0.128/24", "10.0.1.0/24"}, wantOverlaps: true},
+		{name: "apart", a: []string{"10.0.0.0/24"}, b: []string{"10.0.1.0/24"}},
+		{name: "other family", a: []string{"0.0.0.0/0"}, b: []string{"::/0"}},
+		{name: "empty", a: []string{"10.0.0.0/24"}, wantContains: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := MustParse(test.a...), MustParse(test.b...)
+			if got := a.Contains(b); got != test.wantContains {
+				t.Errorf("Contains() = %v, want %v", got, test.wantContains)
+			}
+			if got := a.Overlaps(b); got != test.wantOverlaps {
+				t.Errorf("Overlaps() = %v, want %v", got, test.wantOverlaps)
+			}
+		})
+	}
+}
@@ -1,7 +1,8 @@
 package config
 
 import (
-	"fmt"
+	"encoding/base64"
+	"errors"
 	"github.com/ilyakaznacheev/cleanenv"
 	"log"
 	"time"
@@ -25,9 +26,20 @@ const (
 
 type (
 	Config struct {
-		HTTP   HTTPConfig
-		Server ServerConfig
-		Global GlobalConfig
+		HTTP        HTTPConfig
+		Server      ServerConfig
+		Global      GlobalConfig
+		Webhook     WebhookConfig
+		Stream      StreamConfig
+		Idempotency IdempotencyConfig
+		Trash       TrashConfig
+		Firewall    FirewallConfig
+		Network     NetworkConfig
+		DNS         DNSConfig
+		Endpoint    EndpointConfig
+		Metrics     MetricsConfig
+		Tracing     TracingConfig
+		Log         LogConfig
 	}
 
 	HTTPConfig struct {
@@ -43,6 +55,7 @@ type (
 		Port      int    `env:"WG_SERVER_LISTEN_PORT"`
 		PostUp    string `env:"WG_SERVER_POST_UP_SCRIPT"`
 		PostDown  string `env:"WG_SERVER_POST_DOWN_SCRIPT"`
+		Interface string `env:"WG_SERVER_INTERFACE_NAME" env-default:"wg0"`
 	}
 
 	GlobalConfig struct {
@@ -53,12 +66,112 @@ type (
 		ForwardMark         string `env:"WG_FORWARD_MARK"`
 		ConfigFilePath      string `env:"WG_CONFIG_FILE_PATH"`
 	}
+
+	WebhookConfig struct {
+		MaxAttempts    int           `env:"WEBHOOK_MAX_ATTEMPTS" env-default:"8"`
+		RetryBaseDelay time.Duration `env:"WEBHOOK_RETRY_BASE_DELAY" env-default:"10s"`
+		RetryMaxDelay  time.Duration `env:"WEBHOOK_RETRY_MAX_DELAY" env-default:"1h"`
+		Timeout        time.Duration `env:"WEBHOOK_TIMEOUT" env-default:"10s"`
+		PollInterval   time.Duration `env:"WEBHOOK_POLL_INTERVAL" env-default:"5s"`
+		Concurrency    int           `env:"WEBHOOK_CONCURRENCY" env-default:"4"` // parallel deliveries per webhook
+		Retention      time.Duration `env:"WEBHOOK_DELIVERY_RETENTION" env-default:"168h"`
+		PurgeInterval  time.Duration `env:"WEBHOOK_PURGE_INTERVAL" env-default:"1h"`
+	}
+
+	IdempotencyConfig struct {
+		Retention     time.Duration `env:"IDEMPOTENCY_KEY_RETENTION" env-default:"24h"`
+		PurgeInterval time.Duration `env:"IDEMPOTENCY_PURGE_INTERVAL" env-default:"10m"`
+		// EncryptionKey seals the stored responses, 32 bytes in base64. A
+		// random key is used when empty, responses stored before a restart
+		// then cannot be replayed.
+		EncryptionKey string `env:"IDEMPOTENCY_ENCRYPTION_KEY"`
+	}
+
+	// TrashConfig controls how long deleted peers are kept and how long
+	// their addresses stay reserved
+	TrashConfig struct {
+		Retention     time.Duration `env:"PEER_TRASH_RETENTION" env-default:"720h"`
+		IPQuarantine  time.Duration `env:"PEER_IP_QUARANTINE" env-default:"24h"`
+		PurgeInterval time.Duration `env:"PEER_TRASH_PURGE_INTERVAL" env-default:"1h"`
+	}
+
+	// FirewallConfig controls the nftables table the ACL rules are rendered
+	// to. Interface is taken from the server config.
+	FirewallConfig struct {
+		Enabled       bool   `env:"FIREWALL_ENABLED" env-default:"false"`
+		Table         string `env:"FIREWALL_TABLE" env-default:"vpn_wg"`
+		DefaultPolicy string `env:"FIREWALL_DEFAULT_POLICY" env-default:"accept"` // accept or drop
+		NftPath       string `env:"FIREWALL_NFT_PATH" env-default:"nft"`
+		Interface     string
+	}
+
+	// NetworkConfig enables the managed NAT and forwarding setup that takes
+	// the place of hand-written PostUp and PostDown scripts. Interface is
+	// taken from the server config.
+	NetworkConfig struct {
+		Managed         bool   `env:"NETWORK_MANAGED" env-default:"false"`
+		Backend         string `env:"NETWORK_BACKEND" env-default:"nftables"` // nftables or iptables
+		EgressInterface string `env:"NETWORK_EGRESS_INTERFACE"`               // detected from the default route when empty
+		Table           string `env:"NETWORK_NFT_TABLE" env-default:"vpn_wg_nat"`
+		Interface       string
+	}
+
+	// DNSConfig enables the embedded resolver for peer names. It listens on
+	// the server's tunnel addresses unless ListenAddresses is set, and
+	// forwards other names to Upstreams or to the DNS servers of the global
+	// settings when Upstreams is empty.
+	DNSConfig struct {
+		Enabled         bool          `env:"DNS_ENABLED" env-default:"false"`
+		Domain          string        `env:"DNS_DOMAIN" env-default:"vpn"`
+		Port            int           `env:"DNS_PORT" env-default:"53"`
+		ListenAddresses []string      `env:"DNS_LISTEN_ADDRESSES"`
+		Upstreams       []string      `env:"DNS_UPSTREAMS"`
+		TTL             time.Duration `env:"DNS_TTL" env-default:"60s"`
+		ForwardTimeout  time.Duration `env:"DNS_FORWARD_TIMEOUT" env-default:"2s"`
+	}
+
+	// EndpointConfig controls how the endpoint address is found on first
+	// boot. The detectors in Detect are tried in order, each for at most
+	// Timeout: static takes WG_ENDPOINT_ADDRESS, http asks HTTPURLs, txt
+	// looks up the TXT record TXTName and interface takes the address of
+	// the default route interface.
+	EndpointConfig struct {
+		Detect    []string      `env:"ENDPOINT_DETECT" env-default:"static,http,interface"`
+		Timeout   time.Duration `env:"ENDPOINT_DETECT_TIMEOUT" env-default:"5s"`
+		HTTPURLs  []string      `env:"ENDPOINT_DETECT_HTTP_URLS" env-default:"http://checkip.amazonaws.com/,http://whatismyip.akamai.com,http://ifconfig.top"`
+		TXTName   string        `env:"ENDPOINT_DETECT_TXT_NAME"`
+		TXTServer string        `env:"ENDPOINT_DETECT_TXT_SERVER"` // the system resolver when empty
+		Interface string        `env:"ENDPOINT_DETECT_INTERFACE"`  // the default route interface when empty
+		Static    string
+	}
+
+	StreamConfig struct {
+		BufferSize        int           `env:"STREAM_BUFFER_SIZE" env-default:"1024"`
+		HeartbeatInterval time.Duration `env:"STREAM_HEARTBEAT_INTERVAL" env-default:"15s"`
+		StatusInterval    time.Duration `env:"STREAM_STATUS_INTERVAL" env-default:"10s"`
+	}
+
+	MetricsConfig struct {
+		Enabled       bool `env:"METRICS_ENABLED" env-default:"true"`
+		PerPeer       bool `env:"METRICS_PER_PEER" env-default:"true"`
+		PeerNameLabel bool `env:"METRICS_PEER_NAME_LABEL" env-default:"true"`
+	}
+
+	TracingConfig struct {
+		Exporter    string  `env:"TRACING_EXPORTER" env-default:"none"` // none, otlp or memory
+		ServiceName string  `env:"OTEL_SERVICE_NAME" env-default:"vpn-wg"`
+		SampleRatio float64 `env:"TRACING_SAMPLE_RATIO" env-default:"1"`
+	}
+
+	LogConfig struct {
+		Level  string `env:"LOG_LEVEL" env-default:"info"`
+		Format string `env:"LOG_FORMAT" env-default:"json"` // json or text
+	}
 )
 
 func Init() (*Config, error) {
 	cfg := Config{}
 	populateDefaults(cfg)
-	fmt.Println(cfg)
 	err := cleanenv.ReadEnv(&cfg.HTTP)
 	if err != nil {
 		return nil, err
@@ -74,6 +187,70 @@ func Init() (*Config, error) {
 		return nil, err
 	}
 
+	err = cleanenv.ReadEnv(&cfg.Webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Idempotency)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Idempotency.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.Idempotency.EncryptionKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("IDEMPOTENCY_ENCRYPTION_KEY must be 32 bytes in base64")
+		}
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Trash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Firewall)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Firewall.Interface = cfg.Server.Interface
+
+	err = cleanenv.ReadEnv(&cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Network.Interface = cfg.Server.Interface
+
+	err = cleanenv.ReadEnv(&cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Endpoint.Static = cfg.Global.Addresses
+
+	err = cleanenv.ReadEnv(&cfg.Metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cleanenv.ReadEnv(&cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Println("Parsed Configuration")
 	return &cfg, nil
 }
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"vpn-wg/internal/model"
+)
+
+func (h *Handler) ACLRuleList(c *gin.Context) {
+	rules, err := h.services.ACLService.GetRules(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func (h *Handler) ACLRuleGet(c *gin.Context) {
+	id := c.Params.ByName("id")
+	rule, err := h.services.ACLService.GetRuleByID(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func (h *Handler) ACLRuleCreate(c *gin.Context) {
+	ruleValue := model.ACLRule{Enabled: true}
+
+	if err := c.ShouldBindJSON(&ruleValue); err == nil {
+		rule, err := h.services.ACLService.CreateRule(c.Request.Context(), ruleValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, rule)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) ACLRuleEdit(c *gin.Context) {
+	id := c.Params.ByName("id")
+	ruleValue := model.ACLRule{}
+
+	if err := c.ShouldBindJSON(&ruleValue); err == nil {
+		rule, err := h.services.ACLService.EditRule(c.Request.Context(), id, ruleValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, rule)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) ACLRuleDelete(c *gin.Context) {
+	id := c.Params.ByName("id")
+	err := h.services.ACLService.DeleteRule(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	newResponse(c, http.StatusOK, "ACL rule removed")
+}
+
+// ACLRuleset shows the nftables script the rules compile to
+func (h *Handler) ACLRuleset(c *gin.Context) {
+	ruleset, err := h.services.ACLService.Ruleset(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.String(http.StatusOK, ruleset)
+}
+
+func (h *Handler) initACLRoutes(api *gin.RouterGroup) {
+	acl := api.Group("/acl")
+	{
+		acl.GET("/rules", h.ACLRuleList)
+		acl.POST("/rules", h.ACLRuleCreate)
+		acl.GET("/rules/:id", h.ACLRuleGet)
+		acl.PUT("/rules/:id", h.ACLRuleEdit)
+		acl.DELETE("/rules/:id", h.ACLRuleDelete)
+		acl.GET("/ruleset", h.ACLRuleset)
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/util"
+)
+
+type allowedIPsResult struct {
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+func (h *Handler) AllowedIPsPresets(c *gin.Context) {
+	c.JSON(http.StatusOK, util.AllowedIPsPresets)
+}
+
+// AllowedIPsCalculate returns the AllowedIPs a spec expands to without
+// saving anything
+func (h *Handler) AllowedIPsCalculate(c *gin.Context) {
+	spec := model.AllowedIPsSpec{}
+
+	if err := c.ShouldBindJSON(&spec); err == nil {
+		cidrs, err := h.services.WireguardService.CalculateAllowedIPs(c.Request.Context(), spec)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, allowedIPsResult{AllowedIPs: cidrs})
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) initAllowedIPsRoutes(api *gin.RouterGroup) {
+	allowedIPs := api.Group("/allowed-ips")
+	{
+		allowedIPs.GET("/presets", h.AllowedIPsPresets)
+		allowedIPs.POST("/calculate", h.AllowedIPsCalculate)
+	}
+}
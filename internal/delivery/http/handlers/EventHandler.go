@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"vpn-wg/internal/service"
+)
+
+func (h *Handler) EventStream(c *gin.Context) {
+	filter := service.StreamFilter{
+		Types:   splitQuery(c.Query("types")),
+		PeerIDs: splitQuery(c.Query("peer_id")),
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	var resumeFrom uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			newErrorResponse(c, service.FieldInvalid("Last-Event-ID", "must be a number"))
+			return
+		}
+		resumeFrom = id
+	}
+
+	stream := h.services.StreamService
+	sub := stream.Subscribe(filter, resumeFrom)
+	defer stream.Unsubscribe(sub)
+
+	heartbeat := time.NewTicker(stream.HeartbeatInterval())
+	defer heartbeat.Stop()
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		case e, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			err := sse.Encode(w, sse.Event{
+				Id:    e.StringID(),
+				Event: e.Type,
+				Data:  e.Data,
+			})
+			return err == nil
+		}
+	})
+}
+
+func splitQuery(value string) []string {
+	if value == "" {
+		return nil
+	}
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (h *Handler) initEventRoutes(api *gin.RouterGroup) {
+	api.GET("/events", h.EventStream)
+}
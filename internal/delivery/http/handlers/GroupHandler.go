@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"vpn-wg/internal/model"
+)
+
+func (h *Handler) GroupList(c *gin.Context) {
+	groups, err := h.services.GroupService.GetGroups(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+func (h *Handler) GroupGet(c *gin.Context) {
+	id := c.Params.ByName("id")
+	group, err := h.services.GroupService.GetGroupByID(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+func (h *Handler) GroupCreate(c *gin.Context) {
+	groupValue := model.Group{}
+
+	if err := c.ShouldBindJSON(&groupValue); err == nil {
+		group, err := h.services.GroupService.CreateGroup(c.Request.Context(), groupValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, group)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) GroupEdit(c *gin.Context) {
+	id := c.Params.ByName("id")
+	groupValue := model.Group{}
+
+	if err := c.ShouldBindJSON(&groupValue); err == nil {
+		group, err := h.services.GroupService.EditGroup(c.Request.Context(), id, groupValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, group)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) GroupDelete(c *gin.Context) {
+	id := c.Params.ByName("id")
+	err := h.services.GroupService.DeleteGroup(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	newResponse(c, http.StatusOK, "Group removed")
+}
+
+func (h *Handler) initGroupRoutes(api *gin.RouterGroup) {
+	groups := api.Group("/groups")
+	{
+		groups.GET("", h.GroupList)
+		groups.POST("", h.GroupCreate)
+		groups.GET("/:id", h.GroupGet)
+		groups.PUT("/:id", h.GroupEdit)
+		groups.DELETE("/:id", h.GroupDelete)
+	}
+}
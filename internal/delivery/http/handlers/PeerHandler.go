@@ -1,9 +1,16 @@
 package handlers
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
+	"vpn-wg/internal/importer"
+	"vpn-wg/internal/logger"
 	"vpn-wg/internal/model"
+	"vpn-wg/internal/selector"
+	"vpn-wg/internal/service"
+	"vpn-wg/internal/util"
 )
 
 func (h *Handler) PeerCreate(c *gin.Context) {
@@ -11,50 +18,321 @@ func (h *Handler) PeerCreate(c *gin.Context) {
 	peerData := model.PeerData{}
 
 	if err := c.ShouldBindJSON(&peerValue); err == nil {
-		peer, peerConfig, err := h.services.WireguardService.CreateNew(peerValue)
+		peer, peerConfig, err := h.services.WireguardService.CreateNew(c.Request.Context(), peerValue)
 		if err != nil {
-			newResponse(c, http.StatusInternalServerError, err.Error())
+			newErrorResponse(c, err)
 			return
 		}
 		peerData.Peer = &peer
 		peerData.PeerConfig = peerConfig
+		setETag(c, peer.Revision)
 		c.JSON(http.StatusOK, peerData)
 	} else {
-		newResponse(c, http.StatusUnprocessableEntity, err.Error())
+		newErrorResponse(c, bindingError(err))
 	}
 }
 
+// PeerList lists the peers, optionally narrowed by a label selector such as
+// team=backend,device!=phone. deleted=true lists the trash instead.
+func (h *Handler) PeerList(c *gin.Context) {
+	filter := service.PeerFilter{}
+	sel, err := selector.Parse(c.Query("selector"))
+	if err != nil {
+		newErrorResponse(c, service.FieldInvalid("selector", err.Error()))
+		return
+	}
+	filter.Selector = sel
+	if value := c.Query("deleted"); value != "" {
+		if filter.Deleted, err = strconv.ParseBool(value); err != nil {
+			newErrorResponse(c, service.FieldInvalid("deleted", "must be a boolean"))
+			return
+		}
+	}
+
+	peers, err := h.services.WireguardService.GetPeers(c.Request.Context(), filter)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, peers)
+}
+
+// PeerGet returns a peer. ?qrcode=true adds the QR code of its client
+// config, the qrcode_dns, qrcode_mtu and qrcode_fwmark flags can leave
+// those settings out of it.
+func (h *Handler) PeerGet(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	qrCode := model.QRCodeSettings{}
+	for _, flag := range []struct {
+		name         string
+		defaultValue string
+		value        *bool
+	}{
+		{"qrcode", "false", &qrCode.Enabled},
+		{"qrcode_dns", "true", &qrCode.IncludeDNS},
+		{"qrcode_mtu", "true", &qrCode.IncludeMTU},
+		{"qrcode_fwmark", "true", &qrCode.IncludeFwMark},
+	} {
+		value, err := strconv.ParseBool(c.DefaultQuery(flag.name, flag.defaultValue))
+		if err != nil {
+			newErrorResponse(c, service.FieldInvalid(flag.name, "must be a boolean"))
+			return
+		}
+		*flag.value = value
+	}
+	peerData, err := h.services.WireguardService.GetPeer(c.Request.Context(), id, qrCode)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	setETag(c, peerData.Peer.Revision)
+	c.JSON(http.StatusOK, peerData)
+}
+
+// PeerConfig downloads the client config of a peer, ?format= picks
+// wg-quick, networkmanager or systemd-resolved
+func (h *Handler) PeerConfig(c *gin.Context) {
+	id := c.Params.ByName("id")
+	format := c.DefaultQuery("format", util.ConfigFormatWgQuick)
+
+	config, err := h.services.WireguardService.GetPeerConfig(c.Request.Context(), id, format)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	extension := map[string]string{
+		util.ConfigFormatWgQuick:        "conf",
+		util.ConfigFormatNetworkManager: "nmconnection",
+		util.ConfigFormatResolved:       "sh",
+	}[format]
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, id, extension))
+	c.String(http.StatusOK, config)
+}
+
 func (h *Handler) PeerEdit(c *gin.Context) {
 	id := c.Params.ByName("id")
 	peer := model.Peer{}
 
+	revision, ok := ifMatch(c)
+	if !ok {
+		return
+	}
 	if err := c.ShouldBindJSON(&peer); err == nil {
-		peerData, err := h.services.WireguardService.EditPeer(id, peer)
+		peerData, err := h.services.WireguardService.EditPeer(c.Request.Context(), id, revision, peer)
 		if err != nil {
-			newResponse(c, http.StatusInternalServerError, err.Error())
+			newErrorResponse(c, err)
 			return
 		}
+		setETag(c, peerData.Peer.Revision)
 		c.JSON(http.StatusOK, peerData)
 	} else {
-		newResponse(c, http.StatusUnprocessableEntity, err.Error())
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) PeerPatch(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	contentType := c.ContentType()
+	if contentType != "application/merge-patch+json" && contentType != "application/json" {
+		newErrorResponse(c, service.UnsupportedMediaType("Content-Type must be application/merge-patch+json"))
+		return
+	}
+	revision, ok := ifMatch(c)
+	if !ok {
+		return
+	}
+	patch, err := c.GetRawData()
+	if err != nil {
+		newErrorResponse(c, bindingError(err))
+		return
+	}
+
+	peerData, err := h.services.WireguardService.PatchPeer(c.Request.Context(), id, revision, patch)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
 	}
+	setETag(c, peerData.Peer.Revision)
+	c.JSON(http.StatusOK, peerData)
 }
 
 func (h *Handler) PeerDelete(c *gin.Context) {
 	id := c.Params.ByName("id")
-	err := h.services.WireguardService.DeletePeer(id)
+
+	revision, ok := ifMatch(c)
+	if !ok {
+		return
+	}
+	err := h.services.WireguardService.DeletePeer(c.Request.Context(), id, revision)
 	if err != nil {
-		newResponse(c, http.StatusUnprocessableEntity, err.Error())
+		newErrorResponse(c, err)
 		return
 	}
 	newResponse(c, http.StatusOK, "Peer removed")
 }
 
+func (h *Handler) PeerRestore(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	// restoring cannot lose an edit, so If-Match is checked but not required
+	revision := service.AnyRevision
+	if c.GetHeader("If-Match") != "" {
+		var ok bool
+		if revision, ok = ifMatch(c); !ok {
+			return
+		}
+	}
+	peerData, err := h.services.WireguardService.RestorePeer(c.Request.Context(), id, revision)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	setETag(c, peerData.Peer.Revision)
+	c.JSON(http.StatusOK, peerData)
+}
+
+func (h *Handler) PeerRevisions(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	revisions, err := h.services.WireguardService.GetPeerRevisions(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+func (h *Handler) PeerRevisionDiff(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	from, err := strconv.ParseInt(c.Params.ByName("rev"), 10, 64)
+	if err != nil {
+		newErrorResponse(c, service.FieldInvalid("rev", "must be a number"))
+		return
+	}
+	to, err := strconv.ParseInt(c.DefaultQuery("to", "0"), 10, 64)
+	if err != nil {
+		newErrorResponse(c, service.FieldInvalid("to", "must be a number"))
+		return
+	}
+	diff, err := h.services.WireguardService.DiffPeerRevisions(c.Request.Context(), id, from, to)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+func (h *Handler) PeerRevisionRestore(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	restore, err := strconv.ParseInt(c.Params.ByName("rev"), 10, 64)
+	if err != nil {
+		newErrorResponse(c, service.FieldInvalid("rev", "must be a number"))
+		return
+	}
+	revision, ok := ifMatch(c)
+	if !ok {
+		return
+	}
+	peerData, err := h.services.WireguardService.RestorePeerRevision(c.Request.Context(), id, restore, revision)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	setETag(c, peerData.Peer.Revision)
+	c.JSON(http.StatusOK, peerData)
+}
+
+// PeerAction serves the custom methods on the peer collection, such as /peers:batch
+func (h *Handler) PeerAction(c *gin.Context) {
+	switch c.Params.ByName("action") {
+	case ":batch":
+		h.PeerBatch(c)
+	case ":import":
+		h.PeerImport(c)
+	default:
+		newErrorResponse(c, service.NotFound("unknown peer collection method %s", c.Params.ByName("action")))
+	}
+}
+
+func (h *Handler) PeerBatch(c *gin.Context) {
+	request := service.BatchRequest{}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		newErrorResponse(c, bindingError(err))
+		return
+	}
+	result, err := h.services.WireguardService.Batch(c.Request.Context(), request)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	status := http.StatusOK
+	if failed := result.Failed(); failed != nil && result.Mode == service.BatchAtomic {
+		status = errorStatus[failed.Error.Code]
+	}
+	c.JSON(status, result)
+}
+
+// PeerImport creates peers from a CSV or YAML upload. The report comes back
+// as JSON, or as a ZIP of client configs when the client accepts application/zip.
+func (h *Handler) PeerImport(c *gin.Context) {
+	format := c.Query("format")
+	if format == "" {
+		var ok bool
+		if format, ok = importer.FormatFromContentType(c.ContentType()); !ok {
+			newErrorResponse(c, service.UnsupportedMediaType("Content-Type must be text/csv or application/yaml"))
+			return
+		}
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		newErrorResponse(c, service.FieldInvalid("dry_run", "must be a boolean"))
+		return
+	}
+
+	rows, err := importer.Parse(format, c.Request.Body)
+	if err != nil {
+		newErrorResponse(c, service.FieldInvalid("body", err.Error()))
+		return
+	}
+	report, err := h.services.ImportService.ImportPeers(c.Request.Context(), rows, dryRun)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+
+	if c.NegotiateFormat(gin.MIMEJSON, "application/zip") == "application/zip" {
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", `attachment; filename="peers.zip"`)
+		c.Status(http.StatusOK)
+		if err := report.WriteArchive(c.Writer); err != nil {
+			logger.FromContext(c.Request.Context()).WithError(err).Error("Cannot write import archive")
+		}
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
 func (h *Handler) initPeerRoutes(api *gin.RouterGroup) {
+	// gin has no escaping for ':' so the method name arrives as a parameter
+	api.POST("/peers:action", h.idempotent(), h.PeerAction)
+
 	peers := api.Group("/peers")
 	{
-		peers.POST("", h.PeerCreate)
+		peers.GET("", h.PeerList)
+		peers.POST("", h.idempotent(), h.PeerCreate)
+		peers.GET("/:id", h.PeerGet)
+		peers.GET("/:id/config", h.PeerConfig)
 		peers.PUT("/:id", h.PeerEdit)
+		peers.PATCH("/:id", h.PeerPatch)
 		peers.DELETE("/:id", h.PeerDelete)
+		peers.POST("/:id/restore", h.PeerRestore)
+		peers.GET("/:id/revisions", h.PeerRevisions)
+		peers.GET("/:id/revisions/:rev/diff", h.PeerRevisionDiff)
+		peers.POST("/:id/revisions/:rev/restore", h.PeerRevisionRestore)
 	}
 }
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"vpn-wg/internal/model"
+)
+
+func (h *Handler) PortForwardList(c *gin.Context) {
+	forwards, err := h.services.PortForwardService.GetForwards(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, forwards)
+}
+
+func (h *Handler) PortForwardGet(c *gin.Context) {
+	id := c.Params.ByName("id")
+	forward, err := h.services.PortForwardService.GetForwardByID(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, forward)
+}
+
+func (h *Handler) PortForwardCreate(c *gin.Context) {
+	forwardValue := model.PortForward{Enabled: true}
+
+	if err := c.ShouldBindJSON(&forwardValue); err == nil {
+		forward, err := h.services.PortForwardService.CreateForward(c.Request.Context(), forwardValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, forward)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) PortForwardEdit(c *gin.Context) {
+	id := c.Params.ByName("id")
+	forwardValue := model.PortForward{}
+
+	if err := c.ShouldBindJSON(&forwardValue); err == nil {
+		forward, err := h.services.PortForwardService.EditForward(c.Request.Context(), id, forwardValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, forward)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) PortForwardDelete(c *gin.Context) {
+	id := c.Params.ByName("id")
+	err := h.services.PortForwardService.DeleteForward(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	newResponse(c, http.StatusOK, "Port forward removed")
+}
+
+func (h *Handler) initPortForwardRoutes(api *gin.RouterGroup) {
+	forwards := api.Group("/port-forwards")
+	{
+		forwards.GET("", h.PortForwardList)
+		forwards.POST("", h.PortForwardCreate)
+		forwards.GET("/:id", h.PortForwardGet)
+		forwards.PUT("/:id", h.PortForwardEdit)
+		forwards.DELETE("/:id", h.PortForwardDelete)
+	}
+}
@@ -9,9 +9,19 @@ func (h *Handler) ServerInfo(c *gin.Context) {
 	c.String(http.StatusOK, "pong")
 }
 
+func (h *Handler) ServerStatus(c *gin.Context) {
+	status, err := h.services.NetworkService.Status(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
 func (h *Handler) initServerRoutes(api *gin.RouterGroup) {
 	users := api.Group("/server")
 	{
 		users.GET("", h.ServerInfo)
+		users.GET("/status", h.ServerStatus)
 	}
 }
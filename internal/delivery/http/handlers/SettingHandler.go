@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"vpn-wg/internal/model"
+)
+
+func (h *Handler) SettingsGet(c *gin.Context) {
+	settings, err := h.services.WireguardService.GetSettings(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	setETag(c, settings.Revision)
+	c.JSON(http.StatusOK, settings)
+}
+
+func (h *Handler) SettingsUpdate(c *gin.Context) {
+	settingsValue := model.GlobalSetting{}
+
+	revision, ok := ifMatch(c)
+	if !ok {
+		return
+	}
+	if err := c.ShouldBindJSON(&settingsValue); err != nil {
+		newErrorResponse(c, bindingError(err))
+		return
+	}
+	settings, err := h.services.WireguardService.UpdateSettings(c.Request.Context(), revision, settingsValue)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	setETag(c, settings.Revision)
+	c.JSON(http.StatusOK, settings)
+}
+
+func (h *Handler) initSettingRoutes(api *gin.RouterGroup) {
+	settings := api.Group("/settings")
+	{
+		settings.GET("", h.SettingsGet)
+		settings.PUT("", h.SettingsUpdate)
+	}
+}
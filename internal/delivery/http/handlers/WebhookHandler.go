@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"vpn-wg/internal/model"
+)
+
+func (h *Handler) WebhookList(c *gin.Context) {
+	webhooks, err := h.services.WebhookService.GetWebhooks(c.Request.Context())
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func (h *Handler) WebhookGet(c *gin.Context) {
+	id := c.Params.ByName("id")
+	webhook, err := h.services.WebhookService.GetWebhookByID(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+func (h *Handler) WebhookCreate(c *gin.Context) {
+	webhookValue := model.Webhook{Enabled: true}
+
+	if err := c.ShouldBindJSON(&webhookValue); err == nil {
+		webhook, err := h.services.WebhookService.CreateWebhook(c.Request.Context(), webhookValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, webhook)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) WebhookEdit(c *gin.Context) {
+	id := c.Params.ByName("id")
+	webhookValue := model.Webhook{}
+
+	if err := c.ShouldBindJSON(&webhookValue); err == nil {
+		webhook, err := h.services.WebhookService.EditWebhook(c.Request.Context(), id, webhookValue)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, webhook)
+	} else {
+		newErrorResponse(c, bindingError(err))
+	}
+}
+
+func (h *Handler) WebhookDelete(c *gin.Context) {
+	id := c.Params.ByName("id")
+	err := h.services.WebhookService.DeleteWebhook(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	newResponse(c, http.StatusOK, "Webhook removed")
+}
+
+func (h *Handler) WebhookDeliveries(c *gin.Context) {
+	id := c.Params.ByName("id")
+	deliveries, err := h.services.WebhookService.GetDeliveries(c.Request.Context(), id)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func (h *Handler) WebhookRedeliver(c *gin.Context) {
+	id := c.Params.ByName("id")
+	deliveryID := c.Params.ByName("delivery_id")
+	delivery, err := h.services.WebhookService.Redeliver(c.Request.Context(), id, deliveryID)
+	if err != nil {
+		newErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+func (h *Handler) initWebhookRoutes(api *gin.RouterGroup) {
+	webhooks := api.Group("/webhooks")
+	{
+		webhooks.GET("", h.WebhookList)
+		webhooks.POST("", h.WebhookCreate)
+		webhooks.GET("/:id", h.WebhookGet)
+		webhooks.PUT("/:id", h.WebhookEdit)
+		webhooks.DELETE("/:id", h.WebhookDelete)
+		webhooks.GET("/:id/deliveries", h.WebhookDeliveries)
+		webhooks.POST("/:id/deliveries/:delivery_id/redeliver", h.WebhookRedeliver)
+	}
+}
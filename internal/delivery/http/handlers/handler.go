@@ -1,11 +1,32 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"vpn-wg/internal/logger"
 	"vpn-wg/internal/service"
 )
 
+func init() {
+	// report json field names in validation errors instead of Go field names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" || name == "" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
 type Handler struct {
 	services *service.Services
 }
@@ -18,9 +39,17 @@ func NewHandler(services *service.Services) *Handler {
 
 func (h *Handler) Init(api *gin.RouterGroup) {
 	v1 := api.Group("/v1")
+	v1.Use(errorMiddleware())
 	{
 		h.initServerRoutes(v1)
 		h.initPeerRoutes(v1)
+		h.initGroupRoutes(v1)
+		h.initAllowedIPsRoutes(v1)
+		h.initACLRoutes(v1)
+		h.initPortForwardRoutes(v1)
+		h.initSettingRoutes(v1)
+		h.initWebhookRoutes(v1)
+		h.initEventRoutes(v1)
 	}
 }
 
@@ -29,6 +58,101 @@ type response struct {
 }
 
 func newResponse(c *gin.Context, statusCode int, message string) {
-	logrus.Error(message)
 	c.AbortWithStatusJSON(statusCode, response{message})
 }
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    service.ErrorCode    `json:"code"`
+	Message string               `json:"message"`
+	Details []service.FieldError `json:"details,omitempty"`
+}
+
+var errorStatus = map[service.ErrorCode]int{
+	service.CodeNotFound:   http.StatusNotFound,
+	service.CodeConflict:   http.StatusConflict,
+	service.CodeValidation: http.StatusUnprocessableEntity,
+	service.CodeInternal:   http.StatusInternalServerError,
+
+	service.CodePreconditionFailed:   http.StatusPreconditionFailed,
+	service.CodePreconditionRequired: http.StatusPreconditionRequired,
+	service.CodeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+}
+
+// newErrorResponse records err on the context and stops the chain;
+// errorMiddleware renders it once the handler returns
+func newErrorResponse(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// errorMiddleware renders the last error a handler recorded as a JSON error envelope
+func errorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		domainErr := service.AsError(c.Errors.Last().Err)
+		status := errorStatus[domainErr.Code]
+
+		entry := logger.FromContext(c.Request.Context()).WithField("status", status)
+		if domainErr.Code == service.CodeInternal {
+			entry.WithError(domainErr.Err).Error(domainErr.Message)
+		} else {
+			entry.Info(domainErr.Message)
+		}
+
+		c.JSON(status, errorResponse{errorBody{
+			Code:    domainErr.Code,
+			Message: domainErr.Message,
+			Details: domainErr.Fields,
+		}})
+	}
+}
+
+func setETag(c *gin.Context, revision int64) {
+	c.Header("ETag", strconv.Quote(strconv.FormatInt(revision, 10)))
+}
+
+// ifMatch reads the revision a write was based on from the If-Match header.
+// It records an error and returns false when the header is missing or is
+// not an ETag this API hands out.
+func ifMatch(c *gin.Context) (int64, bool) {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "" {
+		newErrorResponse(c, service.PreconditionRequired("If-Match header is required"))
+		return 0, false
+	}
+	if value == "*" {
+		return service.AnyRevision, true
+	}
+	unquoted, err := strconv.Unquote(strings.TrimPrefix(value, "W/"))
+	if err == nil {
+		if revision, err := strconv.ParseInt(unquoted, 10, 64); err == nil && revision >= 0 {
+			return revision, true
+		}
+	}
+	newErrorResponse(c, service.PreconditionFailed("If-Match %s does not match the current revision", value))
+	return 0, false
+}
+
+// bindingError turns a request decoding failure into a validation error
+func bindingError(err error) error {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		fields := make([]service.FieldError, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			fields = append(fields, service.FieldError{
+				Field:   fieldErr.Field(),
+				Message: fmt.Sprintf("failed on the '%s' rule", fieldErr.Tag()),
+			})
+		}
+		return service.Validation(fields...)
+	}
+	return service.FieldInvalid("body", err.Error())
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"io"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/service"
+)
+
+// replayedHeaders are stored with an idempotent response and sent again on replay
+var replayedHeaders = []string{"Content-Type", "ETag"}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent replays the stored response when a request is retried with the
+// same Idempotency-Key. Only successful responses are stored, so a request
+// that failed can be retried with its original key.
+func (h *Handler) idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(service.IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		body, err := c.GetRawData()
+		if err != nil {
+			newErrorResponse(c, bindingError(err))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := service.Fingerprint(c.Request.Method, c.Request.URL.Path, body)
+
+		idempotency := h.services.IdempotencyService
+		record, err := idempotency.Begin(c.Request.Context(), key, fingerprint)
+		if err != nil {
+			newErrorResponse(c, err)
+			return
+		}
+		if record != nil {
+			for name, value := range record.Header {
+				c.Header(name, value)
+			}
+			c.Header(service.IdempotentReplayedHeader, "true")
+			c.Status(record.StatusCode)
+			_, _ = c.Writer.Write(record.Body)
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		if len(c.Errors) > 0 || c.Writer.Status() >= 300 {
+			idempotency.Release(key)
+			return
+		}
+		header := make(map[string]string)
+		for _, name := range replayedHeaders {
+			if value := c.Writer.Header().Get(name); value != "" {
+				header[name] = value
+			}
+		}
+		err = idempotency.Complete(c.Request.Context(), key, fingerprint, c.Writer.Status(), header, writer.body.Bytes())
+		if err != nil {
+			logger.FromContext(c.Request.Context()).WithError(err).Error("Cannot store idempotent response")
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package event
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	PeerCreated   Type = "peer.created"
+	PeerUpdated   Type = "peer.updated"
+	PeerEnabled   Type = "peer.enabled"
+	PeerDisabled  Type = "peer.disabled"
+	PeerDeleted   Type = "peer.deleted"
+	PeerRestored  Type = "peer.restored"
+	PeerPurged    Type = "peer.purged"
+	PeerStatus    Type = "peer.status"
+	GroupCreated  Type = "group.created"
+	GroupUpdated  Type = "group.updated"
+	GroupDeleted  Type = "group.deleted"
+	ConfigApplied Type = "config.applied"
+)
+
+// Event is a notification about a change that already happened
+type Event struct {
+	ID        string      `json:"id"`
+	Type      Type        `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type Handler func(ctx context.Context, e Event)
+
+// Bus fans out published events to every subscribed handler.
+// Handlers are called synchronously in the order they subscribed.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+func (b *Bus) Subscribe(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *Bus) Publish(ctx context.Context, eventType Type, data interface{}) Event {
+	e := Event{
+		ID:        uuid.NewV4().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(ctx, e)
+	}
+	return e
+}
@@ -0,0 +1,36 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+type Executor interface {
+	// Apply loads a rendered ruleset into the kernel
+	Apply(ctx context.Context, ruleset string) error
+}
+
+// NftExecutor pipes the ruleset into nft -f, which applies the whole script
+// as one transaction
+type NftExecutor struct {
+	path string
+}
+
+func NewNftExecutor(path string) *NftExecutor {
+	return &NftExecutor{path: path}
+}
+
+func (e *NftExecutor) Apply(ctx context.Context, ruleset string) error {
+	cmd := exec.CommandContext(ctx, e.path, "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
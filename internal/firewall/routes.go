@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"vpn-wg/internal/cidrset"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/selector"
+)
+
+// Routes returns the LAN subnets of the other enabled router peers that
+// peer may reach, so they can be added to its client AllowedIPs. The first
+// rule from the peer towards a subnet decides: an allow rule makes it
+// reachable even when it is limited to some protocols, a deny rule only
+// when it covers the whole subnet for every protocol. Without a matching
+// rule the default policy decides.
+func (r Ruleset) Routes(peer model.Peer) []string {
+	rules := r.enabledRules()
+	routes := make([]string, 0)
+	for _, router := range r.Peers {
+		if router.ID == peer.ID || !router.Router() || !router.Enabled || router.Deleted() {
+			continue
+		}
+		for _, subnet := range router.LANSubnets {
+			if r.reaches(rules, peer, router, subnet) {
+				routes = append(routes, subnet)
+			}
+		}
+	}
+	return routes
+}
+
+func (r Ruleset) reaches(rules []model.ACLRule, peer model.Peer, router model.Peer, subnet string) bool {
+	target, err := cidrset.Parse([]string{subnet})
+	if err != nil {
+		return false
+	}
+	for _, rule := range rules {
+		if !sourceMatches(rule.Source, peer) {
+			continue
+		}
+		overlaps, covers := r.destinationMatches(rule.Destination, router, target)
+		if !overlaps {
+			continue
+		}
+		if rule.Action == model.ACLAllow {
+			return true
+		}
+		if covers && rule.Destination.Protocol == "" {
+			return false
+		}
+	}
+	return r.DefaultPolicy != PolicyDrop
+}
+
+func sourceMatches(source model.ACLSource, peer model.Peer) bool {
+	switch {
+	case source.PeerID != "":
+		return source.PeerID == peer.ID
+	case source.GroupID != "":
+		return source.GroupID == peer.GroupID
+	case source.Selector != "":
+		sel, err := selector.Parse(source.Selector)
+		return err == nil && sel.Matches(peer.Labels)
+	}
+	return false
+}
+
+// destinationMatches reports whether the destination shares addresses with
+// the subnet of router and whether it covers all of them
+func (r Ruleset) destinationMatches(destination model.ACLDestination, router model.Peer, subnet cidrset.Set) (bool, bool) {
+	var cidrs []string
+	switch {
+	case destination.PeerID != "":
+		return destination.PeerID == router.ID, destination.PeerID == router.ID
+	case destination.GroupID != "":
+		for _, group := range r.Groups {
+			if group.ID == destination.GroupID {
+				cidrs = group.CIDRs
+			}
+		}
+	case destination.CIDR != "":
+		cidrs = []string{destination.CIDR}
+	default:
+		return true, true
+	}
+	set, err := cidrset.Parse(cidrs)
+	if err != nil {
+		return false, false
+	}
+	return set.Overlaps(subnet), set.Contains(subnet)
+}
@@ -0,0 +1,356 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/selector"
+)
+
+const (
+	PolicyAccept = "accept"
+	PolicyDrop   = "drop"
+)
+
+// Ruleset is everything the nftables table is rendered from. Peers are the
+// live peers, deleted ones must be left out.
+type Ruleset struct {
+	Table         string
+	Interface     string
+	DefaultPolicy string
+	Rules         []model.ACLRule
+	Peers         []model.Peer
+	Groups        []model.Group
+	Forwards      []model.PortForward
+}
+
+// addresses of one rule side split by family, sorted and without duplicates
+type addresses struct {
+	v4 []string
+	v6 []string
+}
+
+// Render compiles the ruleset to an nftables script. The script recreates
+// the table in a single transaction, so nft -f applies it atomically. The
+// output only depends on the input: rules are ordered by priority and id and
+// every address set is sorted.
+func Render(ruleset Ruleset) (string, error) {
+	if ruleset.DefaultPolicy != PolicyAccept && ruleset.DefaultPolicy != PolicyDrop {
+		return "", fmt.Errorf("unknown default policy %q", ruleset.DefaultPolicy)
+	}
+	rules := ruleset.enabledRules()
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# Generated by vpn-wg, changes are overwritten on the next apply.\n")
+	// declaring the table first makes the delete succeed when it does not exist yet
+	fmt.Fprintf(b, "table inet %s\n", ruleset.Table)
+	fmt.Fprintf(b, "delete table inet %s\n", ruleset.Table)
+	fmt.Fprintf(b, "table inet %s {\n", ruleset.Table)
+	fmt.Fprintf(b, "\tchain forward {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook forward priority filter; policy accept;\n")
+	fmt.Fprintf(b, "\t\tiifname != %q accept\n", ruleset.Interface)
+	fmt.Fprintf(b, "\t\tct state established,related accept\n")
+	ruleset.renderIsolation(b)
+	for _, rule := range rules {
+		lines, err := ruleset.renderRule(rule)
+		if err != nil {
+			return "", fmt.Errorf("acl rule %s: %w", rule.ID, err)
+		}
+		fmt.Fprintf(b, "\t\t# %s priority %d %s", rule.ID, rule.Priority, rule.Action)
+		if rule.Description != "" {
+			fmt.Fprintf(b, ": %s", rule.Description)
+		}
+		fmt.Fprintf(b, "\n")
+		if len(lines) == 0 {
+			fmt.Fprintf(b, "\t\t# matches no addresses\n")
+		}
+		for _, line := range lines {
+			fmt.Fprintf(b, "\t\t%s\n", line)
+		}
+	}
+	if ruleset.DefaultPolicy == PolicyDrop {
+		fmt.Fprintf(b, "\t\tdrop\n")
+	}
+	fmt.Fprintf(b, "\t}\n")
+	ruleset.renderForwards(b)
+	fmt.Fprintf(b, "}\n")
+	return b.String(), nil
+}
+
+// enabledRules returns the enabled rules in evaluation order
+func (r Ruleset) enabledRules() []model.ACLRule {
+	rules := make([]model.ACLRule, 0, len(r.Rules))
+	for _, rule := range r.Rules {
+		if rule.Enabled {
+			rules = append(rules, rule)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// renderIsolation drops the traffic between the peers of every isolated
+// group. It comes before the ACL rules, so no rule can open it up.
+func (r Ruleset) renderIsolation(b *strings.Builder) {
+	groups := make([]model.Group, 0)
+	for _, group := range r.Groups {
+		if group.Isolated {
+			groups = append(groups, group)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+	for _, group := range groups {
+		pool := newAddresses(group.CIDRs)
+		fmt.Fprintf(b, "\t\t# isolate group %s\n", group.ID)
+		for _, family := range []struct {
+			name   string
+			values []string
+		}{{"ip", pool.v4}, {"ip6", pool.v6}} {
+			if len(family.values) == 0 {
+				continue
+			}
+			fmt.Fprintf(b, "\t\toifname %q %s saddr %s %s daddr %s drop\n", r.Interface, family.name, set(family.values), family.name, set(family.values))
+		}
+	}
+}
+
+func (r Ruleset) renderRule(rule model.ACLRule) ([]string, error) {
+	source, err := r.sourceAddresses(rule.Source)
+	if err != nil {
+		return nil, err
+	}
+	destination, anyDestination, err := r.destinationAddresses(rule.Destination)
+	if err != nil {
+		return nil, err
+	}
+	verdict := "accept"
+	if rule.Action == model.ACLDeny {
+		verdict = "drop"
+	}
+
+	lines := make([]string, 0, 2)
+	families := []struct {
+		name        string
+		icmp        string
+		source      []string
+		destination []string
+	}{
+		{"ip", "icmp", source.v4, destination.v4},
+		{"ip6", "ipv6-icmp", source.v6, destination.v6},
+	}
+	for _, family := range families {
+		if len(family.source) == 0 || (!anyDestination && len(family.destination) == 0) {
+			continue
+		}
+		parts := []string{fmt.Sprintf("%s saddr %s", family.name, set(family.source))}
+		if !anyDestination {
+			parts = append(parts, fmt.Sprintf("%s daddr %s", family.name, set(family.destination)))
+		}
+		switch protocol := rule.Destination.Protocol; {
+		case protocol == "icmp":
+			parts = append(parts, "meta l4proto "+family.icmp)
+		case protocol != "" && len(rule.Destination.Ports) > 0:
+			parts = append(parts, fmt.Sprintf("%s dport %s", protocol, set(rule.Destination.Ports)))
+		case protocol != "":
+			parts = append(parts, "meta l4proto "+protocol)
+		}
+		parts = append(parts, verdict)
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	return lines, nil
+}
+
+// renderForwards adds the nat chains for the port forwards of enabled peers.
+// Forwarded connections are masqueraded towards the peer so the replies go
+// back through the server whatever the peer's default route is.
+func (r Ruleset) renderForwards(b *strings.Builder) {
+	forwards := make([]model.PortForward, 0, len(r.Forwards))
+	for _, forward := range r.Forwards {
+		if forward.Enabled {
+			forwards = append(forwards, forward)
+		}
+	}
+	sort.SliceStable(forwards, func(i, j int) bool {
+		if forwards[i].Protocol != forwards[j].Protocol {
+			return forwards[i].Protocol < forwards[j].Protocol
+		}
+		if forwards[i].PublicPort != forwards[j].PublicPort {
+			return forwards[i].PublicPort < forwards[j].PublicPort
+		}
+		return forwards[i].ID < forwards[j].ID
+	})
+
+	prerouting := make([]string, 0)
+	postrouting := make([]string, 0)
+	for _, forward := range forwards {
+		peer, ok := r.enabledPeer(forward.PeerID)
+		if !ok {
+			continue
+		}
+		peerPort := forward.PeerPort
+		if peerPort == 0 {
+			peerPort = forward.PublicPort
+		}
+		hosts := newAddresses(peer.AllocatedIPs)
+		families := []struct {
+			name    string
+			nfproto string
+			address string
+			target  string
+		}{
+			{"ip", "ipv4", firstHost(hosts.v4), "%s:%d"},
+			{"ip6", "ipv6", firstHost(hosts.v6), "[%s]:%d"},
+		}
+		comment := fmt.Sprintf("# %s %s %d to peer %s", forward.ID, forward.Protocol, forward.PublicPort, forward.PeerID)
+		prerouting = append(prerouting, comment)
+		postrouting = append(postrouting, comment)
+		for _, family := range families {
+			if family.address == "" {
+				continue
+			}
+			target := fmt.Sprintf(family.target, family.address, peerPort)
+			prerouting = append(prerouting, fmt.Sprintf("meta nfproto %s fib daddr type local iifname != %q %s dport %d dnat %s to %s",
+				family.nfproto, r.Interface, forward.Protocol, forward.PublicPort, family.name, target))
+			postrouting = append(postrouting, fmt.Sprintf("oifname %q %s daddr %s %s dport %d ct status dnat masquerade",
+				r.Interface, family.name, family.address, forward.Protocol, peerPort))
+		}
+	}
+	if len(prerouting) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\tchain prerouting {\n")
+	fmt.Fprintf(b, "\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	for _, line := range prerouting {
+		fmt.Fprintf(b, "\t\t%s\n", line)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "\tchain postrouting {\n")
+	fmt.Fprintf(b, "\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, line := range postrouting {
+		fmt.Fprintf(b, "\t\t%s\n", line)
+	}
+	fmt.Fprintf(b, "\t}\n")
+}
+
+func (r Ruleset) enabledPeer(id string) (model.Peer, bool) {
+	for _, peer := range r.Peers {
+		if peer.ID == id {
+			return peer, peer.Enabled
+		}
+	}
+	return model.Peer{}, false
+}
+
+func (r Ruleset) sourceAddresses(source model.ACLSource) (addresses, error) {
+	switch {
+	case source.PeerID != "":
+		return r.peerAddresses(source.PeerID), nil
+	case source.GroupID != "":
+		return r.groupAddresses(source.GroupID), nil
+	case source.Selector != "":
+		sel, err := selector.Parse(source.Selector)
+		if err != nil {
+			return addresses{}, err
+		}
+		cidrs := make([]string, 0)
+		for _, peer := range r.Peers {
+			if sel.Matches(peer.Labels) {
+				cidrs = append(cidrs, peer.AllocatedIPs...)
+			}
+		}
+		return newAddresses(cidrs), nil
+	}
+	return addresses{}, fmt.Errorf("source names no peers")
+}
+
+// destinationAddresses returns the addresses of the destination, the bool
+// is true when the rule matches any destination address
+func (r Ruleset) destinationAddresses(destination model.ACLDestination) (addresses, bool, error) {
+	switch {
+	case destination.PeerID != "":
+		return r.peerAddresses(destination.PeerID), false, nil
+	case destination.GroupID != "":
+		return r.groupAddresses(destination.GroupID), false, nil
+	case destination.CIDR != "":
+		if _, _, err := net.ParseCIDR(destination.CIDR); err != nil {
+			return addresses{}, false, err
+		}
+		return newAddresses([]string{destination.CIDR}), false, nil
+	}
+	return addresses{}, true, nil
+}
+
+// peerAddresses returns the addresses of a peer, the LAN subnets of a
+// router included
+func (r Ruleset) peerAddresses(id string) addresses {
+	for _, peer := range r.Peers {
+		if peer.ID == id {
+			return newAddresses(append(append([]string{}, peer.AllocatedIPs...), peer.LANSubnets...))
+		}
+	}
+	return addresses{}
+}
+
+func (r Ruleset) groupAddresses(id string) addresses {
+	for _, group := range r.Groups {
+		if group.ID == id {
+			return newAddresses(group.CIDRs)
+		}
+	}
+	return addresses{}
+}
+
+// newAddresses canonicalizes CIDRs, single host prefixes become plain addresses
+func newAddresses(cidrs []string) addresses {
+	seen := make(map[string]bool)
+	result := addresses{}
+	for _, cidr := range cidrs {
+		ip, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		value := network.String()
+		if ones, bits := network.Mask.Size(); ones == bits {
+			value = ip.String()
+		}
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		if ip.To4() != nil {
+			result.v4 = append(result.v4, value)
+		} else {
+			result.v6 = append(result.v6, value)
+		}
+	}
+	sort.Strings(result.v4)
+	sort.Strings(result.v6)
+	return result
+}
+
+// firstHost returns the first single address, skipping networks
+func firstHost(values []string) string {
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			return value
+		}
+	}
+	return ""
+}
+
+// set renders a single value as is and several values as an anonymous set
+func set(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return "{ " + strings.Join(values, ", ") + " }"
+}
@@ -0,0 +1,182 @@
+package firewall
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"vpn-wg/internal/model"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var (
+	alice = model.Peer{ID: "alice", Enabled: true, AllocatedIPs: []string{"10.252.1.2/32", "fd42::2/128"}, Labels: map[string]string{"team": "backend"}, GroupID: "staff"}
+	bob   = model.Peer{ID: "bob", Enabled: true, AllocatedIPs: []string{"10.252.1.3/32"}, Labels: map[string]string{"team": "frontend"}}
+	carol = model.Peer{ID: "carol", Enabled: false, AllocatedIPs: []string{"10.252.1.4/32"}, Labels: map[string]string{"team": "backend"}}
+
+	staff = model.Group{ID: "staff", CIDRs: []string{"10.252.2.0/24"}}
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		ruleset Ruleset
+	}{
+		{
+			name:    "default_accept",
+			ruleset: Ruleset{DefaultPolicy: PolicyAccept},
+		},
+		{
+			name:    "default_drop",
+			ruleset: Ruleset{DefaultPolicy: PolicyDrop},
+		},
+		{
+			name: "peer_source",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyDrop,
+				Peers:         []model.Peer{alice, bob},
+				Rules: []model.ACLRule{
+					{ID: "r1", Priority: 10, Action: model.ACLAllow, Enabled: true, Description: "alice to bob",
+						Source: model.ACLSource{PeerID: "alice"}, Destination: model.ACLDestination{PeerID: "bob"}},
+					{ID: "r0", Priority: 5, Action: model.ACLDeny, Enabled: false,
+						Source: model.ACLSource{PeerID: "bob"}},
+				},
+			},
+		},
+		{
+			name: "group_source",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyAccept,
+				Peers:         []model.Peer{alice, bob},
+				Groups:        []model.Group{staff},
+				Rules: []model.ACLRule{
+					{ID: "r1", Priority: 10, Action: model.ACLDeny, Enabled: true,
+						Source: model.ACLSource{GroupID: "staff"}, Destination: model.ACLDestination{CIDR: "192.168.0.0/16"}},
+				},
+			},
+		},
+		{
+			name: "selector_source",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyDrop,
+				Peers:         []model.Peer{alice, bob, carol},
+				Rules: []model.ACLRule{
+					{ID: "r1", Priority: 10, Action: model.ACLAllow, Enabled: true,
+						Source: model.ACLSource{Selector: "team=backend"}},
+					{ID: "r2", Priority: 20, Action: model.ACLAllow, Enabled: true,
+						Source: model.ACLSource{Selector: "team=ops"}},
+				},
+			},
+		},
+		{
+			name: "port_ranges",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyDrop,
+				Peers:         []model.Peer{alice, bob},
+				Rules: []model.ACLRule{
+					{ID: "r1", Priority: 10, Action: model.ACLAllow, Enabled: true,
+						Source: model.ACLSource{PeerID: "bob"}, Destination: model.ACLDestination{PeerID: "alice", Protocol: "tcp", Ports: []string{"22", "8000-8100"}}},
+					{ID: "r2", Priority: 10, Action: model.ACLAllow, Enabled: true,
+						Source: model.ACLSource{PeerID: "bob"}, Destination: model.ACLDestination{Protocol: "udp", Ports: []string{"53"}}},
+				},
+			},
+		},
+		{
+			name: "icmp",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyDrop,
+				Peers:         []model.Peer{alice, bob},
+				Rules: []model.ACLRule{
+					{ID: "r1", Priority: 10, Action: model.ACLAllow, Enabled: true,
+						Source: model.ACLSource{PeerID: "alice"}, Destination: model.ACLDestination{Protocol: "icmp"}},
+				},
+			},
+		},
+		{
+			name: "isolation",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyAccept,
+				Peers:         []model.Peer{alice, bob},
+				Groups: []model.Group{
+					{ID: "lab", CIDRs: []string{"10.252.3.0/24", "fd42:3::/64"}, Isolated: true},
+					staff,
+					{ID: "guests", CIDRs: []string{"10.252.4.0/24"}, Isolated: true},
+				},
+				Rules: []model.ACLRule{
+					{ID: "r1", Priority: 10, Action: model.ACLAllow, Enabled: true,
+						Source: model.ACLSource{GroupID: "lab"}, Destination: model.ACLDestination{GroupID: "lab"}},
+				},
+			},
+		},
+		{
+			name: "forwards",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyAccept,
+				Peers:         []model.Peer{alice, bob, carol},
+				Forwards: []model.PortForward{
+					{ID: "f2", Protocol: "udp", PublicPort: 51000, PeerID: "bob", Enabled: true},
+					{ID: "f1", Protocol: "tcp", PublicPort: 8443, PeerID: "alice", PeerPort: 443, Enabled: true},
+					{ID: "f3", Protocol: "tcp", PublicPort: 2222, PeerID: "carol", PeerPort: 22, Enabled: true},
+					{ID: "f4", Protocol: "tcp", PublicPort: 8080, PeerID: "bob", Enabled: false},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.ruleset.Table = "vpn_wg"
+			test.ruleset.Interface = "wg0"
+			got, err := Render(test.ruleset)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			golden := filepath.Join("testdata", test.name+".nft")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("Render() mismatch with %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		ruleset Ruleset
+	}{
+		{
+			name:    "unknown policy",
+			ruleset: Ruleset{DefaultPolicy: "reject"},
+		},
+		{
+			name: "bad selector",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyAccept,
+				Rules:         []model.ACLRule{{ID: "r1", Action: model.ACLAllow, Enabled: true, Source: model.ACLSource{Selector: "team in"}}},
+			},
+		},
+		{
+			name: "source without peers",
+			ruleset: Ruleset{
+				DefaultPolicy: PolicyAccept,
+				Rules:         []model.ACLRule{{ID: "r1", Action: model.ACLAllow, Enabled: true}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Render(test.ruleset); err == nil {
+				t.Errorf("Render() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatYAML = "yaml"
+)
+
+// Row is a peer to import, as read from one CSV line or YAML list item
+type Row struct {
+	Line            int      `yaml:"-"`
+	Name            string   `yaml:"name"`
+	Email           string   `yaml:"email"`
+	PublicKey       string   `yaml:"public_key"`
+	AllowedIPs      []string `yaml:"allowed_ips"`
+	ExtraAllowedIPs []string `yaml:"extra_allowed_ips"`
+	Tags            []string `yaml:"tags"`
+	Enabled         *bool    `yaml:"enabled"`
+	Error           string   `yaml:"-"` // set when the row itself could not be read
+}
+
+// columns are the CSV header names, name is the only required one
+var columns = []string{"name", "email", "public_key", "allowed_ips", "extra_allowed_ips", "tags", "enabled"}
+
+// FormatFromContentType maps a request Content-Type to an import format
+func FormatFromContentType(contentType string) (string, bool) {
+	switch contentType {
+	case "text/csv", "application/csv":
+		return FormatCSV, true
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return FormatYAML, true
+	}
+	return "", false
+}
+
+// Parse reads rows in the given format. Problems with a single row are
+// recorded on the row, an error is only returned when the input as a whole
+// cannot be read.
+func Parse(format string, r io.Reader) ([]Row, error) {
+	var rows []Row
+	var err error
+	switch format {
+	case FormatCSV:
+		rows, err = parseCSV(r)
+	case FormatYAML:
+		rows, err = parseYAML(r)
+	default:
+		return nil, fmt.Errorf("unsupported import format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		if rows[i].Error == "" && strings.TrimSpace(rows[i].Name) == "" {
+			rows[i].Error = "name is required"
+		}
+	}
+	return rows, nil
+}
+
+func parseCSV(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("csv input is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !contains(columns, name) {
+			return nil, fmt.Errorf("unknown csv column %q", name)
+		}
+		index[name] = i
+	}
+	if _, ok := index["name"]; !ok {
+		return nil, errors.New("csv header has no name column")
+	}
+
+	rows := make([]Row, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := Row{
+			Line:            line,
+			Name:            field("name"),
+			Email:           field("email"),
+			PublicKey:       field("public_key"),
+			AllowedIPs:      splitList(field("allowed_ips")),
+			ExtraAllowedIPs: splitList(field("extra_allowed_ips")),
+			Tags:            splitList(field("tags")),
+		}
+		if value := field("enabled"); value != "" {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				row.Error = fmt.Sprintf("enabled: %q is not a boolean", value)
+			}
+			row.Enabled = &enabled
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseYAML(r io.Reader) ([]Row, error) {
+	document := yaml.Node{}
+	if err := yaml.NewDecoder(r).Decode(&document); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("yaml input is empty")
+		}
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, errors.New("yaml input is empty")
+	}
+	list := document.Content[0]
+	// accept both a bare list and a {peers: [...]} document
+	if list.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(list.Content); i += 2 {
+			if list.Content[i].Value == "peers" {
+				list = list.Content[i+1]
+				break
+			}
+		}
+	}
+	if list.Kind != yaml.SequenceNode {
+		return nil, errors.New("yaml input must be a list of peers")
+	}
+
+	rows := make([]Row, 0, len(list.Content))
+	for _, item := range list.Content {
+		row := Row{}
+		if err := item.Decode(&row); err != nil {
+			row.Error = err.Error()
+		}
+		row.Line = item.Line
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// splitList splits a CSV cell holding several values separated by
+// semicolons, commas or spaces
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
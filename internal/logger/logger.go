@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"vpn-wg/internal/config"
+)
+
+type contextKey struct{}
+
+var requestIDKey = contextKey{}
+
+// Init configures the standard logrus logger, so packages that log through
+// logrus directly get the same level, format and redaction.
+func Init(cfg config.LogConfig) error {
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	var formatter logrus.Formatter = &logrus.JSONFormatter{}
+	if cfg.Format == "text" {
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	}
+	logrus.SetFormatter(&RedactingFormatter{Next: formatter})
+	return nil
+}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// FromContext returns an entry carrying the request and trace IDs found in ctx
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if requestID := RequestID(ctx); requestID != "" {
+		entry = entry.WithField("request_id", requestID)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		entry = entry.WithField("trace_id", spanContext.TraceID().String())
+	}
+	return entry
+}
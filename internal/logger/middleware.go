@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+	"time"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// Middleware assigns every request an ID, taken from the X-Request-ID header
+// when the caller sent one, and writes a structured access log line.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.NewV4().String()
+		}
+		c.Header(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), requestID))
+
+		c.Next()
+
+		entry := FromContext(c.Request.Context()).WithFields(map[string]interface{}{
+			"method":      c.Request.Method,
+			"path":        c.Request.URL.Path,
+			"status":      c.Writer.Status(),
+			"duration_ms": time.Since(start).Milliseconds(),
+			"client_ip":   c.ClientIP(),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("errors", c.Errors.String())
+		}
+		entry.Info("request")
+	}
+}
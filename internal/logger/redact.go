@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// wireguardKey matches base64 encoded 32 byte keys: 43 significant characters
+// where the last one only carries four bits, followed by a single pad.
+var wireguardKey = regexp.MustCompile(`[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=`)
+
+// sensitiveFields are masked regardless of their value
+var sensitiveFields = []string{"private_key", "privatekey", "preshared_key", "presharedkey", "secret", "password", "token"}
+
+// RedactingFormatter masks WireGuard key material in the message and fields
+// of every entry before handing it to the wrapped formatter.
+type RedactingFormatter struct {
+	Next logrus.Formatter
+}
+
+func (f *RedactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	clean := *entry
+	clean.Message = RedactString(entry.Message)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if isSensitive(key) {
+			clean.Data[key] = redacted
+			continue
+		}
+		clean.Data[key] = Redact(value)
+	}
+	return f.Next.Format(&clean)
+}
+
+func RedactString(s string) string {
+	return wireguardKey.ReplaceAllString(s, redacted)
+}
+
+// Redact returns value with key material masked. Values that are not plain
+// scalars are rendered to text first, so keys nested in structs are caught too.
+func Redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return RedactString(v)
+	case error:
+		return RedactString(v.Error())
+	case fmt.Stringer:
+		return RedactString(v.String())
+	default:
+		return RedactString(fmt.Sprintf("%+v", v))
+	}
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range sensitiveFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"net"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/store"
+	"vpn-wg/internal/wgdevice"
+)
+
+// PeerCollector reads peers from the store and the device on every scrape
+type PeerCollector struct {
+	store  store.IStore
+	device wgdevice.Reader
+	cfg    config.MetricsConfig
+
+	receiveBytes  *prometheus.Desc
+	transmitBytes *prometheus.Desc
+	lastHandshake *prometheus.Desc
+	enabled       *prometheus.Desc
+	online        *prometheus.Desc
+
+	allocationUsed        *prometheus.Desc
+	allocationCapacity    *prometheus.Desc
+	allocationUtilization *prometheus.Desc
+}
+
+func NewPeerCollector(store store.IStore, device wgdevice.Reader, cfg config.MetricsConfig) *PeerCollector {
+	peerLabels := []string{"peer_id"}
+	if cfg.PeerNameLabel {
+		peerLabels = append(peerLabels, "name")
+	}
+	peerDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "peer", name), help, peerLabels, nil)
+	}
+	allocationDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "allocation", name), help, []string{"cidr"}, nil)
+	}
+
+	return &PeerCollector{
+		store:  store,
+		device: device,
+		cfg:    cfg,
+
+		receiveBytes:  peerDesc("receive_bytes_total", "Bytes received from the peer."),
+		transmitBytes: peerDesc("transmit_bytes_total", "Bytes sent to the peer."),
+		lastHandshake: peerDesc("last_handshake_seconds", "Seconds since the last handshake with the peer."),
+		enabled:       peerDesc("enabled", "Whether the peer is enabled in the server config."),
+		online:        peerDesc("online", "Whether the peer completed a handshake recently."),
+
+		allocationUsed:        allocationDesc("used", "Addresses allocated in the server CIDR, including the server itself."),
+		allocationCapacity:    allocationDesc("capacity", "Usable host addresses in the server CIDR."),
+		allocationUtilization: allocationDesc("utilization_ratio", "Share of usable addresses in the server CIDR that are allocated."),
+	}
+}
+
+func (p *PeerCollector) Describe(ch chan<- *prometheus.Desc) {
+	if p.cfg.PerPeer {
+		ch <- p.receiveBytes
+		ch <- p.transmitBytes
+		ch <- p.lastHandshake
+		ch <- p.enabled
+		ch <- p.online
+	}
+	ch <- p.allocationUsed
+	ch <- p.allocationCapacity
+	ch <- p.allocationUtilization
+}
+
+func (p *PeerCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	server, err := p.store.GetServer(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Metrics] Cannot get server")
+		return
+	}
+	peers, err := p.store.GetPeers(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Metrics] Cannot get peers")
+		return
+	}
+
+	allocated := make([]net.IP, 0)
+	for _, cidr := range server.Interface.Addresses {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			allocated = append(allocated, ip)
+		}
+	}
+	for _, peerData := range peers {
+		if peerData.Peer.Deleted() {
+			continue
+		}
+		for _, cidr := range peerData.Peer.AllocatedIPs {
+			if ip, _, err := net.ParseCIDR(cidr); err == nil {
+				allocated = append(allocated, ip)
+			}
+		}
+	}
+	for _, cidr := range server.Interface.Addresses {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		used := 0
+		for _, ip := range allocated {
+			if network.Contains(ip) {
+				used++
+			}
+		}
+		capacity := usableHosts(network)
+		ch <- prometheus.MustNewConstMetric(p.allocationUsed, prometheus.GaugeValue, float64(used), cidr)
+		ch <- prometheus.MustNewConstMetric(p.allocationCapacity, prometheus.GaugeValue, capacity, cidr)
+		if capacity > 0 {
+			ch <- prometheus.MustNewConstMetric(p.allocationUtilization, prometheus.GaugeValue, float64(used)/capacity, cidr)
+		}
+	}
+
+	if !p.cfg.PerPeer {
+		return
+	}
+
+	stats, err := p.device.Peers()
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Debug("[Metrics] Cannot read wireguard device")
+		stats = map[string]wgdevice.PeerStats{}
+	}
+
+	now := time.Now()
+	for _, peerData := range peers {
+		peer := peerData.Peer
+		if peer.Deleted() {
+			continue
+		}
+		labels := []string{peer.ID}
+		if p.cfg.PeerNameLabel {
+			labels = append(labels, peer.Name)
+		}
+
+		ch <- prometheus.MustNewConstMetric(p.enabled, prometheus.GaugeValue, boolValue(peer.Enabled), labels...)
+
+		current, ok := stats[peer.PublicKey]
+		ch <- prometheus.MustNewConstMetric(p.online, prometheus.GaugeValue, boolValue(ok && current.Online(now)), labels...)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(p.receiveBytes, prometheus.CounterValue, float64(current.ReceiveBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(p.transmitBytes, prometheus.CounterValue, float64(current.TransmitBytes), labels...)
+		if !current.LastHandshakeTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(p.lastHandshake, prometheus.GaugeValue, now.Sub(current.LastHandshakeTime).Seconds(), labels...)
+		}
+	}
+}
+
+// usableHosts excludes the network and broadcast addresses
+func usableHosts(network *net.IPNet) float64 {
+	ones, bits := network.Mask.Size()
+	hosts := math.Pow(2, float64(bits-ones)) - 2
+	if hosts < 0 {
+		return 0
+	}
+	return hosts
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
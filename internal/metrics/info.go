@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"sort"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+)
+
+// PeerInfoCollector exports the owner and labels of every peer as a
+// vpn_wg_peer_info gauge that is always 1, to be joined onto the other
+// per-peer series by peer_id. Label keys are not known up front, so the
+// collector is unchecked and builds its description on every scrape.
+type PeerInfoCollector struct {
+	store store.IStore
+	cfg   config.MetricsConfig
+}
+
+func NewPeerInfoCollector(store store.IStore, cfg config.MetricsConfig) *PeerInfoCollector {
+	return &PeerInfoCollector{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+func (p *PeerInfoCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (p *PeerInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	peers, err := p.store.GetPeers(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Metrics] Cannot get peers")
+		return
+	}
+	live := make([]*model.Peer, 0, len(peers))
+	for _, peerData := range peers {
+		if !peerData.Peer.Deleted() {
+			live = append(live, peerData.Peer)
+		}
+	}
+
+	// every series carries the union of label keys, peers without a label
+	// get an empty value for it
+	keys := labelKeys(live)
+	names := []string{"peer_id", "owner"}
+	if p.cfg.PeerNameLabel {
+		names = append(names, "name")
+	}
+	for _, key := range keys {
+		names = append(names, labelName(key))
+	}
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "peer", "info"), "Owner and labels of the peer.", names, nil)
+
+	for _, peer := range live {
+		values := []string{peer.ID, peer.Owner}
+		if p.cfg.PeerNameLabel {
+			values = append(values, peer.Name)
+		}
+		for _, key := range keys {
+			values = append(values, peer.Labels[key])
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func labelName(key string) string {
+	return "label_" + invalidLabelChars.ReplaceAllString(key, "_")
+}
+
+// labelKeys returns the sorted label keys of the peers. Keys that map to
+// the same Prometheus label name are only exported once.
+func labelKeys(peers []*model.Peer) []string {
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		for key := range peer.Labels {
+			seen[key] = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]bool, len(keys))
+	unique := keys[:0]
+	for _, key := range keys {
+		if name := labelName(key); !names[name] {
+			names[name] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"time"
+)
+
+const namespace = "vpn_wg"
+
+var (
+	// Registry holds every metric exported on /metrics
+	Registry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	applyConfigTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "apply_config_total",
+		Help:      "Number of attempts to render and write the WireGuard server config by result.",
+	}, []string{"result"})
+
+	applyConfigDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "apply_config_duration_seconds",
+		Help:      "Time spent rendering and writing the WireGuard server config.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		applyConfigTotal,
+		applyConfigDuration,
+	)
+	// expose both results from the start so rate() works before the first failure
+	applyConfigTotal.WithLabelValues("success")
+	applyConfigTotal.WithLabelValues("failure")
+}
+
+func ObserveApplyConfig(duration time.Duration, err error) {
+	applyConfigDuration.Observe(duration.Seconds())
+	if err != nil {
+		applyConfigTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	applyConfigTotal.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule allows or denies traffic from a set of peers to a destination.
+// Enabled rules are evaluated by ascending priority and the first match wins.
+type ACLRule struct {
+	ID          string         `json:"id"`
+	Description string         `json:"description"`
+	Priority    int            `json:"priority"`
+	Action      string         `json:"action" binding:"required,oneof=allow deny"`
+	Source      ACLSource      `json:"source"`
+	Destination ACLDestination `json:"destination"`
+	Enabled     bool           `json:"enabled"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+// ACLSource names the peers a rule applies to. Exactly one field is set,
+// Selector is a label selector such as team=backend.
+type ACLSource struct {
+	PeerID   string `json:"peer_id,omitempty"`
+	GroupID  string `json:"group_id,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+// ACLDestination is where the traffic goes. Without a peer, group or CIDR
+// it matches every address. Ports need the tcp or udp protocol.
+type ACLDestination struct {
+	PeerID   string   `json:"peer_id,omitempty"`
+	GroupID  string   `json:"group_id,omitempty"`
+	CIDR     string   `json:"cidr,omitempty"`
+	Protocol string   `json:"protocol,omitempty"` // tcp, udp, icmp or empty for any
+	Ports    []string `json:"ports,omitempty"`    // single ports or ranges such as 8000-8100
+}
@@ -0,0 +1,16 @@
+package model
+
+const (
+	PresetFullTunnel     = "full-tunnel"     // 0.0.0.0/0 and ::/0
+	PresetVPNSubnet      = "vpn-subnet"      // the server networks
+	PresetExcludePrivate = "exclude-rfc1918" // full tunnel without the RFC 1918 networks, the server networks stay
+)
+
+// AllowedIPsSpec describes the client AllowedIPs as the preset and Include
+// networks minus the Exclude networks. The minimized result replaces the
+// AllowedIPs list whenever the spec is saved.
+type AllowedIPsSpec struct {
+	Preset  string   `json:"preset"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
@@ -0,0 +1,9 @@
+package model
+
+// DNSRoute sends the queries for names under Domain to Servers. Only
+// clients with split DNS, such as NetworkManager and systemd-resolved, can
+// use it, the wg-quick config has no way to express it.
+type DNSRoute struct {
+	Domain  string   `json:"domain"`
+	Servers []string `json:"servers"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"net"
+	"strconv"
+)
+
+const (
+	FamilyIPv4     = "ipv4"
+	FamilyIPv6     = "ipv6"
+	FamilyHostname = "hostname"
+)
+
+// Endpoint is an address peers connect to. A zero Port stands for the
+// listen port of the server. Family is derived from Host.
+type Endpoint struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Family string `json:"family"`
+}
+
+// Address returns host:port with IPv6 literals in brackets. defaultPort is
+// used when the endpoint has no port, without either only the host is
+// returned.
+func (e Endpoint) Address(defaultPort int) string {
+	port := e.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	if port == 0 {
+		if e.Family == FamilyIPv6 {
+			return "[" + e.Host + "]"
+		}
+		return e.Host
+	}
+	return net.JoinHostPort(e.Host, strconv.Itoa(port))
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// PortForward forwards a public port of the server to a port on a peer.
+// Forwards of disabled peers are not rendered, PeerPort defaults to
+// PublicPort.
+type PortForward struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Protocol    string    `json:"protocol" binding:"required,oneof=tcp udp"`
+	PublicPort  int       `json:"public_port" binding:"required,min=1,max=65535"`
+	PeerID      string    `json:"peer_id" binding:"required"`
+	PeerPort    int       `json:"peer_port" binding:"omitempty,min=1,max=65535"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import "time"
+
+// Group is a set of peers that take their addresses from a pool inside the
+// server networks and share defaults for their client configs
+type Group struct {
+	ID                  string          `json:"id"`
+	Name                string          `json:"name" binding:"required"`
+	Description         string          `json:"description"`
+	CIDRs               []string        `json:"cidrs" binding:"required,min=1"`
+	AllowedIPs          []string        `json:"allowed_ips"`
+	AllowedIPsSpec      *AllowedIPsSpec `json:"allowed_ips_spec"` // replaces AllowedIPs with its result when set
+	DNSServers          []string        `json:"dns_servers"`
+	SearchDomains       []string        `json:"search_domains"`
+	DNSRoutes           []DNSRoute      `json:"dns_routes"`
+	PersistentKeepalive int             `json:"persistent_keepalive"`
+	Isolated            bool            `json:"isolated"` // peers of the group cannot reach each other, enforced by the firewall table so it needs the firewall enabled
+	CreatedAt           time.Time       `json:"created_at"`
+	UpdatedAt           time.Time       `json:"updated_at"`
+}
+
+// ClientSettings returns the global settings with the group defaults applied
+func (g Group) ClientSettings(settings GlobalSetting) GlobalSetting {
+	if len(g.DNSServers) > 0 {
+		settings.DNSServers = g.DNSServers
+	}
+	if len(g.SearchDomains) > 0 {
+		settings.SearchDomains = g.SearchDomains
+	}
+	if len(g.DNSRoutes) > 0 {
+		settings.DNSRoutes = g.DNSRoutes
+	}
+	if g.PersistentKeepalive > 0 {
+		settings.PersistentKeepalive = g.PersistentKeepalive
+	}
+	return settings
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// IdempotencyRecord remembers the response to a request sent with an
+// Idempotency-Key so a retry can be answered without repeating the work
+type IdempotencyRecord struct {
+	ID          string            `json:"id"`
+	Key         string            `json:"key"`
+	Fingerprint string            `json:"fingerprint"`
+	StatusCode  int               `json:"status_code"`
+	Header      map[string]string `json:"header"`
+	Body        []byte            `json:"body"` // sealed with the idempotency encryption key, replays are byte for byte
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+}
@@ -0,0 +1,68 @@
+package model
+
+const (
+	SourceSettings = "settings"
+	SourceGroup    = "group"
+	SourcePeer     = "peer"
+	SourceResolver = "resolver"
+)
+
+// EffectiveValue is a client setting as it is rendered and the level it
+// was taken from
+type EffectiveValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// EffectiveSettings are the client settings of a peer after the group
+// defaults and the peer overrides are applied
+type EffectiveSettings struct {
+	DNSServers          EffectiveValue `json:"dns_servers"`
+	SearchDomains       EffectiveValue `json:"search_domains"`
+	MTU                 EffectiveValue `json:"mtu"`
+	PersistentKeepalive EffectiveValue `json:"persistent_keepalive"`
+	ForwardMark         EffectiveValue `json:"forward_mark"`
+	EndpointAddress     EffectiveValue `json:"endpoint_address"`
+}
+
+// ClientSettings returns the settings with the overrides of the peer
+// applied, group defaults must already be in settings. The endpoint the
+// peer picked replaces the default one, an endpoint address override
+// replaces both.
+func (p Peer) ClientSettings(settings GlobalSetting) GlobalSetting {
+	if endpoint, ok := p.SelectedEndpoint(settings); ok {
+		settings.EndpointAddress = endpoint.Address(0)
+	}
+	if len(p.DNSServers) > 0 {
+		settings.DNSServers = p.DNSServers
+	}
+	if len(p.SearchDomains) > 0 {
+		settings.SearchDomains = p.SearchDomains
+	}
+	if p.MTU != nil {
+		settings.MTU = *p.MTU
+	}
+	if p.PersistentKeepalive != nil {
+		settings.PersistentKeepalive = *p.PersistentKeepalive
+	}
+	if p.ForwardMark != nil {
+		settings.ForwardMark = *p.ForwardMark
+	}
+	if p.EndpointAddress != nil {
+		settings.EndpointAddress = *p.EndpointAddress
+	}
+	return settings
+}
+
+// SelectedEndpoint returns the settings endpoint the peer picked
+func (p Peer) SelectedEndpoint(settings GlobalSetting) (Endpoint, bool) {
+	if p.Endpoint == "" {
+		return Endpoint{}, false
+	}
+	for _, endpoint := range settings.Endpoints {
+		if endpoint.Name == p.Endpoint {
+			return endpoint, true
+		}
+	}
+	return Endpoint{}, false
+}
@@ -1,27 +1,80 @@
 package model
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
 
 type Peer struct {
-	ID              string    `json:"id"`
-	PrivateKey      string    `json:"private_key"`
-	PublicKey       string    `json:"public_key"`
-	PresharedKey    string    `json:"preshared_key"`
-	Name            string    `json:"name"`
-	Email           string    `json:"email"`
-	AllocatedIPs    []string  `json:"allocated_ips"`
-	AllowedIPs      []string  `json:"allowed_ips"`
-	ExtraAllowedIPs []string  `json:"extra_allowed_ips"`
-	UseServerDNS    bool      `json:"use_server_dns"`
-	Enabled         bool      `json:"enabled"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
+	ID                  string            `json:"id"`
+	PrivateKey          string            `json:"private_key"`
+	PublicKey           string            `json:"public_key"`
+	PresharedKey        string            `json:"preshared_key"`
+	Name                string            `json:"name"`
+	Email               string            `json:"email"`
+	AllocatedIPs        []string          `json:"allocated_ips"`
+	AllowedIPs          []string          `json:"allowed_ips"`
+	AllowedIPsSpec      *AllowedIPsSpec   `json:"allowed_ips_spec"` // replaces AllowedIPs with its result when set, a conflicting AllowedIPs is rejected
+	ExtraAllowedIPs     []string          `json:"extra_allowed_ips"`
+	UseServerDNS        bool              `json:"use_server_dns"`
+	DNSServers          []string          `json:"dns_servers"`    // replaces the settings and group servers
+	SearchDomains       []string          `json:"search_domains"` // replaces the settings and group domains
+	MTU                 *int              `json:"mtu"`            // overrides, nil takes the group or settings value
+	PersistentKeepalive *int              `json:"persistent_keepalive"`
+	ForwardMark         *string           `json:"forward_mark"`
+	EndpointAddress     *string           `json:"endpoint_address"`
+	Endpoint            string            `json:"endpoint"`       // name of a settings endpoint, empty for the default
+	Type                string            `json:"type"`           // client or router, empty for a client
+	LANSubnets          []string          `json:"lan_subnets"`    // networks behind a router peer
+	LANInterface        string            `json:"lan_interface"`  // LAN side interface of a router, used in its config hints
+	LANMasquerade       bool              `json:"lan_masquerade"` // the router masquerades tunnel traffic into its LAN
+	Enabled             bool              `json:"enabled"`
+	GroupID             string            `json:"group_id"`
+	Tags                []string          `json:"tags"`
+	Labels              map[string]string `json:"labels"`
+	Owner               string            `json:"owner"`
+	Notes               string            `json:"notes"`
+	Revision            int64             `json:"revision"`
+	CreatedAt           time.Time         `json:"created_at"`
+	UpdatedAt           time.Time         `json:"updated_at"`
+	DeletedAt           *time.Time        `json:"deleted_at,omitempty"`
+}
+
+// Deleted reports whether the peer is in the trash
+func (p Peer) Deleted() bool {
+	return p.DeletedAt != nil
+}
+
+// PeerRevision is a saved version of a peer. Its key material is hashed,
+// so versions can be compared without storing old secrets in clear.
+type PeerRevision struct {
+	PeerID    string    `json:"peer_id"`
+	Revision  int64     `json:"revision"`
+	Peer      Peer      `json:"peer"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HashSecrets replaces the private and preshared key with their SHA-256
+func (p Peer) HashSecrets() Peer {
+	p.PrivateKey = hashSecret(p.PrivateKey)
+	p.PresharedKey = hashSecret(p.PresharedKey)
+	return p
+}
+
+func hashSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
 }
 
 type PeerData struct {
 	Peer       *Peer
 	QRCode     string
 	PeerConfig string
+	Effective  *EffectiveSettings `json:",omitempty"`
 }
 
 type QRCodeSettings struct {
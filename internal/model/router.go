@@ -0,0 +1,11 @@
+package model
+
+const (
+	PeerTypeClient = "client"
+	PeerTypeRouter = "router"
+)
+
+// Router reports whether the peer is a gateway for the LAN subnets behind it
+func (p Peer) Router() bool {
+	return p.Type == PeerTypeRouter
+}
@@ -1,10 +1,21 @@
 package model
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
 type Server struct {
 	KeyPair   *ServerKeypair
 	Interface *ServerInterface
+	Resolver  *Resolver // nil when the embedded DNS server is disabled
+}
+
+// Resolver is the embedded DNS server, peers that use the server DNS are
+// pointed at its addresses with Domain as search domain
+type Resolver struct {
+	Addresses []string
+	Domain    string
 }
 
 // ServerInterface model
@@ -16,6 +27,17 @@ type ServerInterface struct {
 	PostDown   string    `json:"post_down"`
 }
 
+// HostAddresses returns the server's own addresses inside its networks
+func (i ServerInterface) HostAddresses() []string {
+	hosts := make([]string, 0, len(i.Addresses))
+	for _, cidr := range i.Addresses {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			hosts = append(hosts, ip.String())
+		}
+	}
+	return hosts
+}
+
 // ServerKeypair model
 type ServerKeypair struct {
 	PrivateKey string    `json:"private_key"`
@@ -2,13 +2,22 @@ package model
 
 import "time"
 
+// EndpointSourceManual marks an endpoint address set through the settings,
+// detected ones carry the name of their detector
+const EndpointSourceManual = "manual"
+
 // GlobalSetting model
 type GlobalSetting struct {
-	EndpointAddress     string    `json:"endpoint_address"`
-	DNSServers          []string  `json:"dns_servers"`
-	MTU                 int       `json:"mtu,string"`
-	PersistentKeepalive int       `json:"persistent_keepalive,string"`
-	ForwardMark         string    `json:"forward_mark"`
-	ConfigFilePath      string    `json:"config_file_path"`
-	UpdatedAt           time.Time `json:"updated_at"`
+	EndpointAddress     string     `json:"endpoint_address"`
+	EndpointSource      string     `json:"endpoint_source"`
+	Endpoints           []Endpoint `json:"endpoints"` // named alternatives peers can pick
+	DNSServers          []string   `json:"dns_servers"`
+	SearchDomains       []string   `json:"search_domains"`
+	DNSRoutes           []DNSRoute `json:"dns_routes"`
+	MTU                 int        `json:"mtu,string"`
+	PersistentKeepalive int        `json:"persistent_keepalive,string"`
+	ForwardMark         string     `json:"forward_mark"`
+	ConfigFilePath      string     `json:"config_file_path"` // read only, set from WG_CONFIG_FILE_PATH when the store is created
+	Revision            int64      `json:"revision"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 }
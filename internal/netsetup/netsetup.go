@@ -0,0 +1,231 @@
+package netsetup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"vpn-wg/internal/config"
+)
+
+const (
+	StepOK      = "ok"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+// Step is the outcome of one part of the setup or teardown
+type Step struct {
+	Name   string    `json:"name"`
+	Status string    `json:"status"`
+	Detail string    `json:"detail"`
+	At     time.Time `json:"at"`
+}
+
+type Status struct {
+	Managed         bool   `json:"managed"`
+	Backend         string `json:"backend,omitempty"`
+	EgressInterface string `json:"egress_interface,omitempty"`
+	Steps           []Step `json:"steps"`
+}
+
+type Runner interface {
+	Run(ctx context.Context, command Command) error
+}
+
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, command Command) error {
+	cmd := exec.CommandContext(ctx, command.Name, command.Args...)
+	if command.Stdin != "" {
+		cmd.Stdin = strings.NewReader(command.Stdin)
+	}
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", command.Name, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// Manager sets up NAT and forwarding for the server networks and undoes it
+// on shutdown. Every step is recorded in the status.
+type Manager struct {
+	cfg      config.NetworkConfig
+	runner   Runner
+	procRoot string
+
+	mu       sync.Mutex
+	status   Status
+	teardown []Command
+	restore  map[string]string // sysctl file to the value it had before
+}
+
+func New(cfg config.NetworkConfig, runner Runner) *Manager {
+	return &Manager{
+		cfg:      cfg,
+		runner:   runner,
+		procRoot: "/proc",
+		status:   Status{Managed: cfg.Managed, Steps: make([]Step, 0)},
+		restore:  make(map[string]string),
+	}
+}
+
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := m.status
+	status.Steps = append([]Step{}, m.status.Steps...)
+	return status
+}
+
+// Setup configures forwarding and NAT for the given server addresses. It
+// runs every step it can and returns the first failure.
+func (m *Manager) Setup(ctx context.Context, addresses []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status = Status{Managed: true, Backend: m.cfg.Backend, Steps: make([]Step, 0)}
+	var firstErr error
+	record := func(name string, err error, detail string, args ...interface{}) {
+		step := Step{Name: name, Status: StepOK, Detail: fmt.Sprintf(detail, args...), At: time.Now().UTC()}
+		if err != nil {
+			step.Status = StepFailed
+			step.Detail = err.Error()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		m.status.Steps = append(m.status.Steps, step)
+	}
+	skip := func(name string, detail string) {
+		m.status.Steps = append(m.status.Steps, Step{Name: name, Status: StepSkipped, Detail: detail, At: time.Now().UTC()})
+	}
+
+	networks := make([]*net.IPNet, 0, len(addresses))
+	hasV4, hasV6 := false, false
+	for _, cidr := range addresses {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			record("server_networks", err, "")
+			return firstErr
+		}
+		networks = append(networks, network)
+		if network.IP.To4() != nil {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+
+	egress := m.cfg.EgressInterface
+	if egress != "" {
+		record("egress_interface", nil, "%s from the configuration", egress)
+	} else {
+		var err error
+		egress, err = DefaultRouteInterface(m.procRoot, !hasV4, m.cfg.Interface)
+		record("egress_interface", err, "%s from the default route", egress)
+	}
+	m.status.EgressInterface = egress
+
+	if hasV4 {
+		detail, err := m.enableForwarding(filepath.Join(m.procRoot, "sys", "net", "ipv4", "ip_forward"))
+		record("ipv4_forwarding", err, "%s", detail)
+	} else {
+		skip("ipv4_forwarding", "no IPv4 server network")
+	}
+	if hasV6 {
+		detail, err := m.enableForwarding(filepath.Join(m.procRoot, "sys", "net", "ipv6", "conf", "all", "forwarding"))
+		record("ipv6_forwarding", err, "%s", detail)
+	} else {
+		skip("ipv6_forwarding", "no IPv6 server network")
+	}
+
+	if egress == "" {
+		skip("nat_rules", "no egress interface")
+		return firstErr
+	}
+	setup, teardown, err := Rules(m.cfg.Backend, m.cfg.Table, m.cfg.Interface, egress, networks)
+	if err != nil {
+		record("nat_rules", err, "")
+		return firstErr
+	}
+	// rules left behind by a run that did not shut down cleanly
+	m.runTeardown(ctx, teardown)
+	m.teardown = make([]Command, 0, len(teardown))
+	for i, command := range setup {
+		if err := m.runner.Run(ctx, command); err != nil {
+			record("nat_rules", err, "")
+			return firstErr
+		}
+		m.teardown = append(m.teardown, teardown[i])
+	}
+	record("nat_rules", nil, "%d networks masqueraded behind %s with %s", len(networks), egress, m.cfg.Backend)
+	return firstErr
+}
+
+// Teardown removes the rules Setup added and puts back the forwarding
+// settings it changed
+func (m *Manager) Teardown(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var firstErr error
+	if len(m.teardown) > 0 {
+		step := Step{Name: "remove_nat_rules", Status: StepOK, Detail: fmt.Sprintf("%d commands", len(m.teardown)), At: time.Now().UTC()}
+		if err := m.runTeardown(ctx, m.teardown); err != nil {
+			step.Status, step.Detail, firstErr = StepFailed, err.Error(), err
+		}
+		m.status.Steps = append(m.status.Steps, step)
+		m.teardown = nil
+	}
+	for path, value := range m.restore {
+		step := Step{Name: "restore_forwarding", Status: StepOK, Detail: fmt.Sprintf("%s set back to %s", path, value), At: time.Now().UTC()}
+		if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			step.Status, step.Detail = StepFailed, err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		m.status.Steps = append(m.status.Steps, step)
+		delete(m.restore, path)
+	}
+	return firstErr
+}
+
+// runTeardown runs every command in reverse order and returns the first failure
+func (m *Manager) runTeardown(ctx context.Context, commands []Command) error {
+	var firstErr error
+	for i := len(commands) - 1; i >= 0; i-- {
+		if err := m.runner.Run(ctx, commands[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// enableForwarding turns a forwarding sysctl on and remembers the previous
+// value so Teardown can put it back
+func (m *Manager) enableForwarding(path string) (string, error) {
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(current))
+	if value == "1" {
+		return "already enabled", nil
+	}
+	if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		return "", err
+	}
+	m.restore[path] = value
+	return "enabled, was " + value, nil
+}
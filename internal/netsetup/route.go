@@ -0,0 +1,78 @@
+package netsetup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultRouteInterface returns the interface of the default route with the
+// lowest metric, read from /proc/net/route or /proc/net/ipv6_route. Routes
+// over the interfaces in skip are ignored.
+func DefaultRouteInterface(procRoot string, ipv6 bool, skip ...string) (string, error) {
+	name := "route"
+	if ipv6 {
+		name = "ipv6_route"
+	}
+	file, err := os.Open(filepath.Join(procRoot, "net", name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	best := ""
+	bestMetric := uint64(0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		var iface, metric string
+		if ipv6 {
+			// destination, prefix length, source, source prefix length,
+			// next hop, metric, reference count, use, flags, interface
+			if len(fields) < 10 || strings.Trim(fields[0], "0") != "" || fields[1] != "00" {
+				continue
+			}
+			iface, metric = fields[9], fields[5]
+		} else {
+			// interface, destination, gateway, flags, reference count,
+			// use, metric, mask
+			if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+				continue
+			}
+			iface, metric = fields[0], fields[6]
+		}
+		if iface == "lo" || contains(skip, iface) {
+			continue
+		}
+		base := 10
+		if ipv6 {
+			base = 16
+		}
+		value, err := strconv.ParseUint(metric, base, 64)
+		if err != nil {
+			continue
+		}
+		if best == "" || value < bestMetric {
+			best, bestMetric = iface, value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if best == "" {
+		return "", fmt.Errorf("no default route in %s", file.Name())
+	}
+	return best, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
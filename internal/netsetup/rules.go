@@ -0,0 +1,110 @@
+package netsetup
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	BackendNftables = "nftables"
+	BackendIptables = "iptables"
+
+	ruleComment = "vpn-wg"
+)
+
+// Command is a single program invocation, Stdin is fed to it when set
+type Command struct {
+	Name  string
+	Args  []string
+	Stdin string
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Rules returns the commands that masquerade the server networks behind the
+// egress interface and forward traffic between it and the wireguard
+// interface, and the commands that remove them again. Each teardown command
+// undoes the setup command with the same index.
+func Rules(backend string, table string, wgInterface string, egress string, networks []*net.IPNet) ([]Command, []Command, error) {
+	switch backend {
+	case BackendNftables:
+		setup := Command{Name: "nft", Args: []string{"-f", "-"}, Stdin: nftRules(table, wgInterface, egress, networks)}
+		teardown := Command{Name: "nft", Args: []string{"delete", "table", "inet", table}}
+		return []Command{setup}, []Command{teardown}, nil
+	case BackendIptables:
+		setup, teardown := iptablesRules(wgInterface, egress, networks)
+		return setup, teardown, nil
+	}
+	return nil, nil, fmt.Errorf("unknown network backend %q", backend)
+}
+
+func nftRules(table string, wgInterface string, egress string, networks []*net.IPNet) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# Generated by vpn-wg, removed on shutdown.\n")
+	fmt.Fprintf(b, "table inet %s\n", table)
+	fmt.Fprintf(b, "delete table inet %s\n", table)
+	fmt.Fprintf(b, "table inet %s {\n", table)
+	fmt.Fprintf(b, "\tchain postrouting {\n")
+	fmt.Fprintf(b, "\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, network := range networks {
+		fmt.Fprintf(b, "\t\toifname %q %s saddr %s masquerade\n", egress, family(network), network)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "\tchain forward {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook forward priority filter; policy accept;\n")
+	fmt.Fprintf(b, "\t\tiifname %q oifname %q accept\n", wgInterface, egress)
+	fmt.Fprintf(b, "\t\tiifname %q oifname %q ct state established,related accept\n", egress, wgInterface)
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "}\n")
+	return b.String()
+}
+
+// iptablesRules inserts the rules at the top of the chains, so they win
+// over a restrictive FORWARD policy. Every rule carries a comment to tell
+// it apart from rules added by hand.
+func iptablesRules(wgInterface string, egress string, networks []*net.IPNet) ([]Command, []Command) {
+	setup := make([]Command, 0)
+	teardown := make([]Command, 0)
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		rules := make([][]string, 0)
+		for _, network := range networks {
+			if (tool == "ip6tables") != (network.IP.To4() == nil) {
+				continue
+			}
+			rules = append(rules, []string{"-t", "nat", "POSTROUTING", "-s", network.String(), "-o", egress, "-m", "comment", "--comment", ruleComment, "-j", "MASQUERADE"})
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		rules = append(rules,
+			[]string{"FORWARD", "-i", wgInterface, "-o", egress, "-m", "comment", "--comment", ruleComment, "-j", "ACCEPT"},
+			[]string{"FORWARD", "-i", egress, "-o", wgInterface, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-m", "comment", "--comment", ruleComment, "-j", "ACCEPT"},
+		)
+		for _, rule := range rules {
+			setup = append(setup, Command{Name: tool, Args: iptablesArgs("-I", rule)})
+			teardown = append(teardown, Command{Name: tool, Args: iptablesArgs("-D", rule)})
+		}
+	}
+	return setup, teardown
+}
+
+// iptablesArgs puts the action in front of the chain, after an optional -t table
+func iptablesArgs(action string, rule []string) []string {
+	args := make([]string, 0, len(rule)+1)
+	if rule[0] == "-t" {
+		args = append(args, rule[0], rule[1])
+		rule = rule[2:]
+	}
+	args = append(args, action)
+	return append(args, rule...)
+}
+
+func family(network *net.IPNet) string {
+	if network.IP.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
@@ -0,0 +1,145 @@
+package publicip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	externalip "github.com/glendc/go-external-ip"
+	"net"
+	"strings"
+	"time"
+	"vpn-wg/internal/netsetup"
+)
+
+// Static returns the configured address as is
+type Static struct {
+	Address string
+}
+
+func (s Static) Name() string { return SourceStatic }
+
+func (s Static) Detect(ctx context.Context) (string, error) {
+	if s.Address == "" {
+		return "", errors.New("no address configured")
+	}
+	return s.Address, nil
+}
+
+// HTTP asks the URLs for the address the requests come from and takes the
+// answer most of them agree on
+type HTTP struct {
+	URLs []string
+}
+
+func (h HTTP) Name() string { return SourceHTTP }
+
+func (h HTTP) Detect(ctx context.Context) (string, error) {
+	if len(h.URLs) == 0 {
+		return "", errors.New("no urls configured")
+	}
+	cfg := externalip.ConsensusConfig{Timeout: 5 * time.Second}
+	if deadline, ok := ctx.Deadline(); ok {
+		cfg.Timeout = time.Until(deadline)
+	}
+	consensus := externalip.NewConsensus(&cfg, nil)
+	for _, url := range h.URLs {
+		consensus.AddVoter(externalip.NewHTTPSource(url), 1)
+	}
+
+	// the consensus has no context, it is bounded by its own timeout
+	type answer struct {
+		ip  net.IP
+		err error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		ip, err := consensus.ExternalIP()
+		done <- answer{ip, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case a := <-done:
+		if a.err != nil {
+			return "", a.err
+		}
+		return a.ip.String(), nil
+	}
+}
+
+// TXT looks up the TXT records of Record and takes the first one holding an
+// ip address. Server is the DNS server to ask, the system resolver is used
+// when it is empty.
+type TXT struct {
+	Record string
+	Server string
+}
+
+func (t TXT) Name() string { return SourceTXT }
+
+func (t TXT) Detect(ctx context.Context) (string, error) {
+	if t.Record == "" {
+		return "", errors.New("no record name configured")
+	}
+	resolver := net.DefaultResolver
+	if t.Server != "" {
+		server := t.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	records, err := resolver.LookupTXT(ctx, t.Record)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if ip := net.ParseIP(strings.TrimSpace(record)); ip != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no TXT record of %s holds an ip address", t.Record)
+}
+
+// Interface takes the first global unicast address of Device, or of the
+// default route interface when Device is empty. It needs no network
+// access, so it works on air-gapped hosts.
+type Interface struct {
+	Device   string
+	ProcRoot string
+}
+
+func (i Interface) Name() string { return SourceInterface }
+
+func (i Interface) Detect(ctx context.Context) (string, error) {
+	name := i.Device
+	if name == "" {
+		var err error
+		name, err = netsetup.DefaultRouteInterface(i.ProcRoot, false)
+		if err != nil {
+			if name, err = netsetup.DefaultRouteInterface(i.ProcRoot, true); err != nil {
+				return "", err
+			}
+		}
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no global unicast address", name)
+}
@@ -0,0 +1,82 @@
+package publicip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"vpn-wg/internal/config"
+)
+
+const (
+	SourceStatic    = "static"
+	SourceHTTP      = "http"
+	SourceTXT       = "txt"
+	SourceInterface = "interface"
+)
+
+// Detector is one way to find the public address of the server
+type Detector interface {
+	Name() string
+	Detect(ctx context.Context) (string, error)
+}
+
+// Result is a detected address and the name of the detector that found it
+type Result struct {
+	Address string
+	Source  string
+}
+
+// Chain tries its detectors in order, each one bounded by Timeout, and
+// returns the first address found
+type Chain struct {
+	Detectors []Detector
+	Timeout   time.Duration
+}
+
+// New builds the chain named by cfg.Detect
+func New(cfg config.EndpointConfig) (*Chain, error) {
+	chain := &Chain{Timeout: cfg.Timeout}
+	for _, name := range cfg.Detect {
+		switch strings.TrimSpace(name) {
+		case SourceStatic:
+			chain.Detectors = append(chain.Detectors, Static{Address: cfg.Static})
+		case SourceHTTP:
+			chain.Detectors = append(chain.Detectors, HTTP{URLs: cfg.HTTPURLs})
+		case SourceTXT:
+			chain.Detectors = append(chain.Detectors, TXT{Record: cfg.TXTName, Server: cfg.TXTServer})
+		case SourceInterface:
+			chain.Detectors = append(chain.Detectors, Interface{Device: cfg.Interface, ProcRoot: "/proc"})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown endpoint detector %q", name)
+		}
+	}
+	return chain, nil
+}
+
+// Detect returns the first address found. The error lists why every
+// detector failed.
+func (c *Chain) Detect(ctx context.Context) (Result, error) {
+	failures := make([]string, 0, len(c.Detectors))
+	for _, detector := range c.Detectors {
+		address, err := c.detect(ctx, detector)
+		if err == nil {
+			return Result{Address: address, Source: detector.Name()}, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", detector.Name(), err))
+	}
+	if len(failures) == 0 {
+		return Result{}, fmt.Errorf("no endpoint detectors configured")
+	}
+	return Result{}, fmt.Errorf("no public address found (%s)", strings.Join(failures, "; "))
+}
+
+func (c *Chain) detect(ctx context.Context, detector Detector) (string, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	return detector.Detect(ctx)
+}
@@ -0,0 +1,278 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"time"
+	"vpn-wg/internal/logger"
+)
+
+const maxMessageSize = 65535
+
+// Server answers names in the zone and forwards every other query to the
+// upstream servers, trying them in order
+type Server struct {
+	zone      *Zone
+	upstreams func() []string
+	timeout   time.Duration
+}
+
+func NewServer(zone *Zone, upstreams func() []string, timeout time.Duration) *Server {
+	return &Server{
+		zone:      zone,
+		upstreams: upstreams,
+		timeout:   timeout,
+	}
+}
+
+// ServePacket answers queries on a UDP socket until ctx is cancelled
+func (s *Server) ServePacket(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if reply := s.handle(ctx, query, "udp"); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// ServeStream answers length prefixed queries on TCP connections until ctx
+// is cancelled
+func (s *Server) ServeStream(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(2 * s.timeout))
+		query, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		reply := s.handle(ctx, query, "tcp")
+		if reply == nil || writeMessage(conn, reply) != nil {
+			return
+		}
+	}
+}
+
+// handle returns the reply to a query, or nil when it is not worth one
+func (s *Server) handle(ctx context.Context, query []byte, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return reply(header, nil, dnsmessage.RCodeFormatError, false, nil)
+	}
+	name := strings.ToLower(question.Name.String())
+
+	if s.zone.contains(name) {
+		ips, ok := s.zone.lookup(name)
+		if !ok && name != s.zone.domain {
+			return reply(header, &question, dnsmessage.RCodeNameError, true, nil)
+		}
+		return reply(header, &question, dnsmessage.RCodeSuccess, true, s.addressResources(question, ips))
+	}
+	if question.Type == dnsmessage.TypePTR {
+		if host, ok := s.zone.lookupReverse(name); ok {
+			target, err := dnsmessage.NewName(host)
+			if err != nil {
+				return reply(header, &question, dnsmessage.RCodeServerFailure, false, nil)
+			}
+			return reply(header, &question, dnsmessage.RCodeSuccess, true, []dnsmessage.Resource{{
+				Header: s.resourceHeader(question, dnsmessage.TypePTR),
+				Body:   &dnsmessage.PTRResource{PTR: target},
+			}})
+		}
+	}
+
+	answer, err := s.forward(ctx, query, network)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).WithField("name", name).Warn("[DNS] Cannot forward query")
+		return reply(header, &question, dnsmessage.RCodeServerFailure, false, nil)
+	}
+	return answer
+}
+
+func (s *Server) addressResources(question dnsmessage.Question, ips []net.IP) []dnsmessage.Resource {
+	resources := make([]dnsmessage.Resource, 0, len(ips))
+	for _, ip := range ips {
+		switch v4 := ip.To4(); {
+		case v4 != nil && question.Type == dnsmessage.TypeA:
+			resource := &dnsmessage.AResource{}
+			copy(resource.A[:], v4)
+			resources = append(resources, dnsmessage.Resource{Header: s.resourceHeader(question, dnsmessage.TypeA), Body: resource})
+		case v4 == nil && question.Type == dnsmessage.TypeAAAA:
+			resource := &dnsmessage.AAAAResource{}
+			copy(resource.AAAA[:], ip.To16())
+			resources = append(resources, dnsmessage.Resource{Header: s.resourceHeader(question, dnsmessage.TypeAAAA), Body: resource})
+		}
+	}
+	return resources
+}
+
+func (s *Server) resourceHeader(question dnsmessage.Question, resourceType dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  resourceType,
+		Class: dnsmessage.ClassINET,
+		TTL:   s.zone.ttl,
+	}
+}
+
+// forward relays the query as is and returns the first upstream answer
+func (s *Server) forward(ctx context.Context, query []byte, network string) ([]byte, error) {
+	upstreams := s.upstreams()
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+	var lastErr error
+	for _, upstream := range upstreams {
+		answer, err := s.exchange(ctx, upstreamAddress(upstream), query, network)
+		if err == nil {
+			return answer, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *Server) exchange(ctx context.Context, address string, query []byte, network string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		if err := writeMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func reply(request dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, authoritative bool, answers []dnsmessage.Resource) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 request.ID,
+		Response:           true,
+		OpCode:             request.OpCode,
+		Authoritative:      authoritative,
+		RecursionDesired:   request.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+	if question != nil {
+		if err := builder.StartQuestions(); err != nil {
+			return nil
+		}
+		if err := builder.Question(*question); err != nil {
+			return nil
+		}
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, answer := range answers {
+		var err error
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			err = builder.AResource(answer.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = builder.AAAAResource(answer.Header, *body)
+		case *dnsmessage.PTRResource:
+			err = builder.PTRResource(answer.Header, *body)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	message, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return message
+}
+
+// upstreamAddress adds the default port to an upstream without one
+func upstreamAddress(upstream string) string {
+	if net.ParseIP(upstream) != nil {
+		return net.JoinHostPort(upstream, "53")
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return net.JoinHostPort(upstream, "53")
+	}
+	return upstream
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func writeMessage(w io.Writer, message []byte) error {
+	buf := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(buf, uint16(len(message)))
+	copy(buf[2:], message)
+	_, err := w.Write(buf)
+	return err
+}
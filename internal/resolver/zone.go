@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vpn-wg/internal/model"
+)
+
+// Zone holds the A, AAAA and PTR records of the peers under one domain.
+// Names are kept as lower case fully qualified names.
+type Zone struct {
+	domain string
+	ttl    uint32
+
+	mu      sync.RWMutex
+	hosts   map[string][]net.IP
+	reverse map[string]string
+}
+
+func NewZone(domain string, ttl time.Duration) *Zone {
+	return &Zone{
+		domain:  fqdn(domain),
+		ttl:     uint32(ttl / time.Second),
+		hosts:   make(map[string][]net.IP),
+		reverse: make(map[string]string),
+	}
+}
+
+// Domain returns the zone domain without the trailing dot
+func (z *Zone) Domain() string {
+	return strings.TrimSuffix(z.domain, ".")
+}
+
+// Update replaces the records with the given peers. Deleted and disabled
+// peers are left out. When two peers map to the same host name the one
+// created first keeps it.
+func (z *Zone) Update(peers []model.Peer) {
+	live := make([]model.Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Enabled && !peer.Deleted() {
+			live = append(live, peer)
+		}
+	}
+	sort.SliceStable(live, func(i, j int) bool {
+		if !live[i].CreatedAt.Equal(live[j].CreatedAt) {
+			return live[i].CreatedAt.Before(live[j].CreatedAt)
+		}
+		return live[i].ID < live[j].ID
+	})
+
+	hosts := make(map[string][]net.IP)
+	reverse := make(map[string]string)
+	for _, peer := range live {
+		label := HostLabel(peer.Name)
+		if label == "" {
+			continue
+		}
+		name := label + "." + z.domain
+		if _, taken := hosts[name]; taken {
+			continue
+		}
+		ips := make([]net.IP, 0, len(peer.AllocatedIPs))
+		for _, cidr := range peer.AllocatedIPs {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			ips = append(ips, ip)
+			reverse[ReverseName(ip)] = name
+		}
+		hosts[name] = ips
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.hosts = hosts
+	z.reverse = reverse
+}
+
+// Len returns the number of host names in the zone
+func (z *Zone) Len() int {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return len(z.hosts)
+}
+
+// contains reports whether name is the zone domain or below it
+func (z *Zone) contains(name string) bool {
+	return name == z.domain || strings.HasSuffix(name, "."+z.domain)
+}
+
+func (z *Zone) lookup(name string) ([]net.IP, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	ips, ok := z.hosts[name]
+	return ips, ok
+}
+
+func (z *Zone) lookupReverse(name string) (string, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	host, ok := z.reverse[name]
+	return host, ok
+}
+
+// HostLabel turns a peer name into a DNS label: lower case letters, digits
+// and dashes, at most 63 characters. It returns an empty string for names
+// without any usable character.
+func HostLabel(name string) string {
+	b := &strings.Builder{}
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	label := strings.TrimSuffix(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimSuffix(label[:63], "-")
+	}
+	return label
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of an address
+func ReverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	b := &strings.Builder{}
+	v6 := ip.To16()
+	for i := len(v6) - 1; i >= 0; i-- {
+		fmt.Fprintf(b, "%x.%x.", v6[i]&0x0f, v6[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+func fqdn(name string) string {
+	name = strings.ToLower(strings.Trim(name, "."))
+	return name + "."
+}
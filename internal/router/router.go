@@ -3,27 +3,43 @@ package router
 import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"net/http"
+	"vpn-wg/internal/config"
 	"vpn-wg/internal/delivery/http/handlers"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/metrics"
 	"vpn-wg/internal/service"
+	"vpn-wg/internal/tracing"
 )
 
 type Router struct {
 	services *service.Services
+	cfg      *config.Config
 }
 
-func NewRouter(services *service.Services) *Router {
+func NewRouter(services *service.Services, cfg *config.Config) *Router {
 	return &Router{
 		services: services,
+		cfg:      cfg,
 	}
 }
 
 func (r *Router) Init() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(logger.Middleware(), gin.Recovery())
 	router.Use(cors.Default())
 	router.GET("/ping", func(c *gin.Context) {
 		c.String(http.StatusOK, "pong")
 	})
+	if r.cfg.Tracing.Exporter != tracing.ExporterNone {
+		router.Use(otelgin.Middleware(r.cfg.Tracing.ServiceName))
+	}
+	if r.cfg.Metrics.Enabled {
+		router.Use(metrics.Middleware())
+		router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})))
+	}
 	r.initApi(router)
 
 	return router
@@ -0,0 +1,95 @@
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type operator int
+
+const (
+	opEquals operator = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key   string
+	op    operator
+	value string
+}
+
+// Selector matches label sets against requirements such as
+// "team=backend,device!=phone". Requirements are joined with AND; a bare key
+// requires the label to be present and "!key" requires it to be absent.
+type Selector []requirement
+
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`)
+
+// Parse reads a selector. An empty string selects everything.
+func Parse(value string) (Selector, error) {
+	selector := Selector{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var r requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = requirement{key: kv[0], op: opNotEquals, value: kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			r = requirement{key: kv[0], op: opEquals, value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = requirement{key: kv[0], op: opEquals, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			r = requirement{key: part[1:], op: opNotExists}
+		default:
+			r = requirement{key: part, op: opExists}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if !keyPattern.MatchString(r.key) {
+			return nil, fmt.Errorf("invalid label key %q in selector", r.key)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// Matches reports whether labels satisfy every requirement
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+		switch r.op {
+		case opEquals:
+			if !ok || value != r.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && value == r.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidKey reports whether key can be used as a label key
+func ValidKey(key string) bool {
+	return len(key) <= 63 && keyPattern.MatchString(key)
+}
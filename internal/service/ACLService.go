@@ -0,0 +1,313 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/firewall"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/selector"
+	"vpn-wg/internal/store"
+)
+
+type ACLService struct {
+	store     store.IStore
+	cfg       config.FirewallConfig
+	wireguard WireguardServiceInterface
+}
+
+type ACLServiceInterface interface {
+	GetRules(ctx context.Context) ([]model.ACLRule, error)
+	GetRuleByID(ctx context.Context, id string) (model.ACLRule, error)
+	CreateRule(ctx context.Context, rule model.ACLRule) (model.ACLRule, error)
+	EditRule(ctx context.Context, id string, ruleValue model.ACLRule) (model.ACLRule, error)
+	DeleteRule(ctx context.Context, id string) error
+	Ruleset(ctx context.Context) (string, error)
+}
+
+func NewACLService(store store.IStore, cfg config.FirewallConfig, wireguard WireguardServiceInterface) *ACLService {
+	return &ACLService{
+		store:     store,
+		cfg:       cfg,
+		wireguard: wireguard,
+	}
+}
+
+// GetRules lists the rules in evaluation order
+func (a *ACLService) GetRules(ctx context.Context) ([]model.ACLRule, error) {
+	rules, err := a.store.GetACLRules(ctx)
+	if err != nil {
+		return rules, storeError(err, "acl rules", "")
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules, nil
+}
+
+func (a *ACLService) GetRuleByID(ctx context.Context, id string) (model.ACLRule, error) {
+	rule, err := a.store.GetACLRuleByID(ctx, id)
+	if err != nil {
+		return rule, storeError(err, "acl rule", id)
+	}
+	return rule, nil
+}
+
+func (a *ACLService) CreateRule(ctx context.Context, rule model.ACLRule) (model.ACLRule, error) {
+	ctx, span := tracer.Start(ctx, "ACLService.CreateRule")
+	defer span.End()
+
+	if err := a.validateRule(ctx, rule); err != nil {
+		return rule, err
+	}
+	rule.ID = uuid.NewV4().String()
+	rule.CreatedAt = time.Now().UTC()
+	rule.UpdatedAt = rule.CreatedAt
+
+	if err := a.store.SaveACLRule(ctx, rule); err != nil {
+		return rule, storeError(err, "acl rule", rule.ID)
+	}
+	logger.FromContext(ctx).WithField("acl_rule_id", rule.ID).Info("[Firewall] Created acl rule")
+	return rule, a.applyRule(ctx, rule.ID, nil)
+}
+
+func (a *ACLService) EditRule(ctx context.Context, id string, ruleValue model.ACLRule) (model.ACLRule, error) {
+	ctx, span := tracer.Start(ctx, "ACLService.EditRule")
+	defer span.End()
+
+	rule, err := a.store.GetACLRuleByID(ctx, id)
+	if err != nil {
+		return rule, storeError(err, "acl rule", id)
+	}
+	if err := a.validateRule(ctx, ruleValue); err != nil {
+		return rule, err
+	}
+	previous := rule
+	rule.Description = ruleValue.Description
+	rule.Priority = ruleValue.Priority
+	rule.Action = ruleValue.Action
+	rule.Source = ruleValue.Source
+	rule.Destination = ruleValue.Destination
+	rule.Enabled = ruleValue.Enabled
+	rule.UpdatedAt = time.Now().UTC()
+
+	if err := a.store.SaveACLRule(ctx, rule); err != nil {
+		return rule, storeError(err, "acl rule", id)
+	}
+	logger.FromContext(ctx).WithField("acl_rule_id", id).Info("[Firewall] Updated acl rule")
+	if err := a.applyRule(ctx, id, &previous); err != nil {
+		return previous, err
+	}
+	return rule, nil
+}
+
+func (a *ACLService) DeleteRule(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "ACLService.DeleteRule")
+	defer span.End()
+
+	rule, err := a.store.GetACLRuleByID(ctx, id)
+	if err != nil {
+		return storeError(err, "acl rule", id)
+	}
+	if err := a.store.DeleteACLRule(ctx, id); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Firewall] Cannot delete acl rule")
+		return storeError(err, "acl rule", id)
+	}
+	return a.applyRule(ctx, id, &rule)
+}
+
+// applyRule applies a saved rule change. When the firewall refuses the
+// ruleset the rule goes back to previous, or is removed if it is new, so the
+// store does not hold a rule that would go live with the next change.
+func (a *ACLService) applyRule(ctx context.Context, id string, previous *model.ACLRule) error {
+	err := a.wireguard.applyConfig(ctx)
+	if err == nil {
+		return nil
+	}
+	var rollbackErr error
+	if previous == nil {
+		rollbackErr = a.store.DeleteACLRule(ctx, id)
+	} else {
+		rollbackErr = a.store.SaveACLRule(ctx, *previous)
+	}
+	if rollbackErr != nil {
+		logger.FromContext(ctx).WithError(rollbackErr).WithField("acl_rule_id", id).Error("[Firewall] Cannot roll back acl rule")
+	}
+	return err
+}
+
+// Ruleset renders the nftables script for the current rules, whether or
+// not the firewall is enabled
+func (a *ACLService) Ruleset(ctx context.Context) (string, error) {
+	peers, err := a.store.GetPeers(ctx)
+	if err != nil {
+		return "", storeError(err, "peers", "")
+	}
+	active := make([]model.PeerData, 0, len(peers))
+	for _, peerData := range peers {
+		if !peerData.Peer.Deleted() {
+			active = append(active, peerData)
+		}
+	}
+	ruleset, err := renderFirewall(ctx, a.store, a.cfg, active)
+	if err != nil {
+		return "", Internal(err, "cannot render firewall ruleset")
+	}
+	return ruleset, nil
+}
+
+func (a *ACLService) validateRule(ctx context.Context, rule model.ACLRule) error {
+	fields := make([]FieldError, 0)
+	if strings.ContainsAny(rule.Description, "\r\n") {
+		fields = append(fields, FieldError{Field: "description", Message: "must not contain line breaks"})
+	}
+
+	source := rule.Source
+	switch countSet(source.PeerID, source.GroupID, source.Selector) {
+	case 1:
+		if source.Selector != "" {
+			if _, err := selector.Parse(source.Selector); err != nil {
+				fields = append(fields, FieldError{Field: "source.selector", Message: err.Error()})
+			}
+		}
+		fields = append(fields, a.validateReferences(ctx, "source", source.PeerID, source.GroupID)...)
+	default:
+		fields = append(fields, FieldError{Field: "source", Message: "must name exactly one of peer_id, group_id or selector"})
+	}
+
+	destination := rule.Destination
+	if countSet(destination.PeerID, destination.GroupID, destination.CIDR) > 1 {
+		fields = append(fields, FieldError{Field: "destination", Message: "must name at most one of peer_id, group_id or cidr"})
+	}
+	if destination.CIDR != "" {
+		if _, _, err := net.ParseCIDR(destination.CIDR); err != nil {
+			fields = append(fields, FieldError{Field: "destination.cidr", Message: "must be a CIDR"})
+		}
+	}
+	fields = append(fields, a.validateReferences(ctx, "destination", destination.PeerID, destination.GroupID)...)
+	switch destination.Protocol {
+	case "", "icmp":
+		if len(destination.Ports) > 0 {
+			fields = append(fields, FieldError{Field: "destination.ports", Message: "need the tcp or udp protocol"})
+		}
+	case "tcp", "udp":
+		for _, port := range destination.Ports {
+			if !validPortRange(port) {
+				fields = append(fields, FieldError{Field: "destination.ports", Message: fmt.Sprintf("%q is not a port or port range", port)})
+			}
+		}
+	default:
+		fields = append(fields, FieldError{Field: "destination.protocol", Message: "must be tcp, udp or icmp"})
+	}
+
+	if len(fields) > 0 {
+		return Validation(fields...)
+	}
+	return nil
+}
+
+// validateReferences checks that the peer and group a rule side names exist
+func (a *ACLService) validateReferences(ctx context.Context, side string, peerID string, groupID string) []FieldError {
+	fields := make([]FieldError, 0)
+	if peerID != "" {
+		if _, err := a.store.GetPeerByID(ctx, peerID); err != nil {
+			fields = append(fields, FieldError{Field: side + ".peer_id", Message: fmt.Sprintf("peer %s not found", peerID)})
+		}
+	}
+	if groupID != "" {
+		if _, err := a.store.GetGroupByID(ctx, groupID); err != nil {
+			fields = append(fields, FieldError{Field: side + ".group_id", Message: fmt.Sprintf("group %s not found", groupID)})
+		}
+	}
+	return fields
+}
+
+// renderFirewall renders the nftables script for the given live peers
+func renderFirewall(ctx context.Context, s store.IStore, cfg config.FirewallConfig, peers []model.PeerData) (string, error) {
+	ruleset, err := loadRuleset(ctx, s, cfg, peers)
+	if err != nil {
+		return "", err
+	}
+	return firewall.Render(ruleset)
+}
+
+// peerRoutes returns the LAN subnets of the router peers the peer may
+// reach. With the firewall disabled no rule is enforced, so every subnet
+// is reachable.
+func peerRoutes(ctx context.Context, s store.IStore, cfg config.FirewallConfig, peer model.Peer) ([]string, error) {
+	peers, err := s.GetPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ruleset, err := loadRuleset(ctx, s, cfg, peers)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled {
+		ruleset.Rules = nil
+		ruleset.DefaultPolicy = firewall.PolicyAccept
+	}
+	return ruleset.Routes(peer), nil
+}
+
+func loadRuleset(ctx context.Context, s store.IStore, cfg config.FirewallConfig, peers []model.PeerData) (firewall.Ruleset, error) {
+	rules, err := s.GetACLRules(ctx)
+	if err != nil {
+		return firewall.Ruleset{}, err
+	}
+	groups, err := s.GetGroups(ctx)
+	if err != nil {
+		return firewall.Ruleset{}, err
+	}
+	forwards, err := s.GetPortForwards(ctx)
+	if err != nil {
+		return firewall.Ruleset{}, err
+	}
+	ruleset := firewall.Ruleset{
+		Table:         cfg.Table,
+		Interface:     cfg.Interface,
+		DefaultPolicy: cfg.DefaultPolicy,
+		Rules:         rules,
+		Groups:        groups,
+		Forwards:      forwards,
+		Peers:         make([]model.Peer, 0, len(peers)),
+	}
+	for _, peerData := range peers {
+		ruleset.Peers = append(ruleset.Peers, *peerData.Peer)
+	}
+	return ruleset, nil
+}
+
+func countSet(values ...string) int {
+	count := 0
+	for _, value := range values {
+		if value != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// validPortRange accepts a port or a range of ports such as 8000-8100
+func validPortRange(value string) bool {
+	bounds := strings.SplitN(value, "-", 2)
+	ports := make([]int, 0, 2)
+	for _, bound := range bounds {
+		port, err := strconv.Atoi(bound)
+		if err != nil || port < 1 || port > 65535 {
+			return false
+		}
+		ports = append(ports, port)
+	}
+	return len(ports) == 1 || ports[0] <= ports[1]
+}
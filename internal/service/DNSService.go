@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/resolver"
+	"vpn-wg/internal/store"
+)
+
+const dnsListenRetryInterval = 5 * time.Second
+
+type DNSService struct {
+	store  store.IStore
+	cfg    config.DNSConfig
+	zone   *resolver.Zone
+	server *resolver.Server
+}
+
+type DNSServiceInterface interface {
+	Run(ctx context.Context)
+	Refresh(ctx context.Context, e event.Event)
+}
+
+func NewDNSService(store store.IStore, cfg config.DNSConfig) *DNSService {
+	d := &DNSService{
+		store: store,
+		cfg:   cfg,
+		zone:  resolver.NewZone(cfg.Domain, cfg.TTL),
+	}
+	d.server = resolver.NewServer(d.zone, d.upstreams, cfg.ForwardTimeout)
+	return d
+}
+
+// Refresh reloads the zone after every applied config and every peer change,
+// a rename does not touch the server config but changes the host name
+func (d *DNSService) Refresh(ctx context.Context, e event.Event) {
+	if !d.cfg.Enabled {
+		return
+	}
+	switch e.Type {
+	case event.ConfigApplied, event.PeerCreated, event.PeerUpdated, event.PeerEnabled, event.PeerDisabled,
+		event.PeerDeleted, event.PeerRestored, event.PeerPurged:
+		d.reload(ctx)
+	}
+}
+
+// Run serves DNS on the listen addresses until ctx is cancelled. Addresses
+// that cannot be bound yet, such as a tunnel address before the interface
+// is up, are retried.
+func (d *DNSService) Run(ctx context.Context) {
+	if !d.cfg.Enabled {
+		return
+	}
+	d.reload(ctx)
+
+	addresses := d.cfg.ListenAddresses
+	if len(addresses) == 0 {
+		server, err := d.store.GetServer(ctx)
+		if err != nil {
+			logger.FromContext(ctx).WithError(err).Error("[DNS] Cannot get server config")
+			return
+		}
+		addresses = server.Interface.HostAddresses()
+	}
+	for _, address := range addresses {
+		go d.listen(ctx, net.JoinHostPort(address, strconv.Itoa(d.cfg.Port)))
+	}
+	<-ctx.Done()
+}
+
+func (d *DNSService) listen(ctx context.Context, address string) {
+	log := logger.FromContext(ctx).WithField("address", address)
+	for {
+		conn, err := net.ListenPacket("udp", address)
+		if err == nil {
+			listener, err := net.Listen("tcp", address)
+			if err == nil {
+				log.WithField("domain", d.zone.Domain()).Info("[DNS] Listening")
+				go func() {
+					if err := d.server.ServeStream(ctx, listener); err != nil {
+						log.WithError(err).Error("[DNS] TCP server stopped")
+					}
+				}()
+				if err := d.server.ServePacket(ctx, conn); err != nil {
+					log.WithError(err).Error("[DNS] UDP server stopped")
+				}
+				return
+			}
+			conn.Close()
+		}
+		log.WithError(err).Warn("[DNS] Cannot listen, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dnsListenRetryInterval):
+		}
+	}
+}
+
+func (d *DNSService) reload(ctx context.Context) {
+	peers, err := d.store.GetPeers(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[DNS] Cannot get peers")
+		return
+	}
+	zonePeers := make([]model.Peer, 0, len(peers))
+	for _, peerData := range peers {
+		zonePeers = append(zonePeers, *peerData.Peer)
+	}
+	d.zone.Update(zonePeers)
+	logger.FromContext(ctx).WithField("hosts", d.zone.Len()).Debug("[DNS] Zone updated")
+}
+
+// upstreams returns the configured upstreams, or the DNS servers of the
+// global settings without the server's own addresses
+func (d *DNSService) upstreams() []string {
+	if len(d.cfg.Upstreams) > 0 {
+		return d.cfg.Upstreams
+	}
+	ctx := context.Background()
+	settings, err := d.store.GetGlobalSettings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[DNS] Cannot get global settings")
+		return nil
+	}
+	own := make(map[string]bool)
+	if server, err := d.store.GetServer(ctx); err == nil {
+		for _, address := range server.Interface.HostAddresses() {
+			own[address] = true
+		}
+	}
+	upstreams := make([]string, 0, len(settings.DNSServers))
+	for _, server := range settings.DNSServers {
+		if !own[server] {
+			upstreams = append(upstreams, server)
+		}
+	}
+	return upstreams
+}
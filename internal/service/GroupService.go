@@ -0,0 +1,397 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"net"
+	"sort"
+	"strings"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+	"vpn-wg/internal/util"
+)
+
+type GroupService struct {
+	store     store.IStore
+	bus       *event.Bus
+	firewall  config.FirewallConfig
+	wireguard WireguardServiceInterface
+}
+
+type GroupServiceInterface interface {
+	GetGroups(ctx context.Context) ([]model.Group, error)
+	GetGroupByID(ctx context.Context, id string) (model.Group, error)
+	CreateGroup(ctx context.Context, group model.Group) (model.Group, error)
+	EditGroup(ctx context.Context, id string, groupValue model.Group) (model.Group, error)
+	DeleteGroup(ctx context.Context, id string) error
+}
+
+func NewGroupService(store store.IStore, bus *event.Bus, firewall config.FirewallConfig, wireguard WireguardServiceInterface) *GroupService {
+	return &GroupService{
+		store:     store,
+		bus:       bus,
+		firewall:  firewall,
+		wireguard: wireguard,
+	}
+}
+
+func (g *GroupService) GetGroups(ctx context.Context) ([]model.Group, error) {
+	groups, err := g.store.GetGroups(ctx)
+	if err != nil {
+		return groups, storeError(err, "groups", "")
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+func (g *GroupService) GetGroupByID(ctx context.Context, id string) (model.Group, error) {
+	group, err := g.store.GetGroupByID(ctx, id)
+	if err != nil {
+		return group, storeError(err, "group", id)
+	}
+	return group, nil
+}
+
+func (g *GroupService) CreateGroup(ctx context.Context, group model.Group) (model.Group, error) {
+	ctx, span := tracer.Start(ctx, "GroupService.CreateGroup")
+	defer span.End()
+
+	group.ID = uuid.NewV4().String()
+	group, err := g.validateGroup(ctx, group)
+	if err != nil {
+		return group, err
+	}
+	group.CreatedAt = time.Now().UTC()
+	group.UpdatedAt = group.CreatedAt
+
+	if err := g.store.SaveGroup(ctx, group); err != nil {
+		return group, storeError(err, "group", group.ID)
+	}
+	logger.FromContext(ctx).WithField("group_id", group.ID).Info("[Groups] Created group")
+
+	if group.Isolated {
+		if err := g.wireguard.applyConfig(ctx); err != nil {
+			return group, err
+		}
+	}
+	g.bus.Publish(ctx, event.GroupCreated, group)
+	return group, nil
+}
+
+// EditGroup replaces a group. The client settings apply to the members right
+// away, the AllowedIPs only to peers created afterwards since they are copied
+// at creation. The pool must still hold the addresses of every member.
+func (g *GroupService) EditGroup(ctx context.Context, id string, groupValue model.Group) (model.Group, error) {
+	ctx, span := tracer.Start(ctx, "GroupService.EditGroup")
+	defer span.End()
+
+	previous, err := g.store.GetGroupByID(ctx, id)
+	if err != nil {
+		return previous, storeError(err, "group", id)
+	}
+
+	group := previous
+	group.Name = groupValue.Name
+	group.Description = groupValue.Description
+	group.CIDRs = groupValue.CIDRs
+	group.AllowedIPs = groupValue.AllowedIPs
+	group.AllowedIPsSpec = groupValue.AllowedIPsSpec
+	group.DNSServers = groupValue.DNSServers
+	group.SearchDomains = groupValue.SearchDomains
+	group.DNSRoutes = groupValue.DNSRoutes
+	group.PersistentKeepalive = groupValue.PersistentKeepalive
+	group.Isolated = groupValue.Isolated
+	group, err = g.validateGroup(ctx, group)
+	if err != nil {
+		return previous, err
+	}
+	group.UpdatedAt = time.Now().UTC()
+
+	if err := g.store.SaveGroup(ctx, group); err != nil {
+		return previous, storeError(err, "group", id)
+	}
+	logger.FromContext(ctx).WithField("group_id", id).Info("[Groups] Updated group")
+
+	// the pool shows up in the isolation rules and in the acl rules naming the group
+	if previous.Isolated || group.Isolated || strings.Join(previous.CIDRs, ",") != strings.Join(group.CIDRs, ",") {
+		if err := g.wireguard.applyConfig(ctx); err != nil {
+			return group, err
+		}
+	}
+	g.bus.Publish(ctx, event.GroupUpdated, group)
+	return group, nil
+}
+
+// DeleteGroup removes a group that no peer belongs to, peers in the trash
+// included
+func (g *GroupService) DeleteGroup(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "GroupService.DeleteGroup")
+	defer span.End()
+
+	group, err := g.store.GetGroupByID(ctx, id)
+	if err != nil {
+		return storeError(err, "group", id)
+	}
+	peers, err := g.store.GetPeers(ctx)
+	if err != nil {
+		return storeError(err, "peers", "")
+	}
+	for _, peerData := range peers {
+		if peerData.Peer.GroupID == id {
+			return Conflict("group %s still has peer %s", id, peerData.Peer.ID)
+		}
+	}
+	rules, err := g.store.GetACLRules(ctx)
+	if err != nil {
+		return storeError(err, "acl rules", "")
+	}
+	for _, rule := range rules {
+		if rule.Source.GroupID == id || rule.Destination.GroupID == id {
+			return Conflict("group %s is used by acl rule %s", id, rule.ID)
+		}
+	}
+
+	if err := g.store.DeleteGroup(ctx, id); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Groups] Cannot delete group")
+		return storeError(err, "group", id)
+	}
+	if group.Isolated {
+		if err := g.wireguard.applyConfig(ctx); err != nil {
+			return err
+		}
+	}
+	g.bus.Publish(ctx, event.GroupDeleted, group)
+	return nil
+}
+
+// validateGroup checks a group against the server networks, the other groups
+// and the addresses peers already hold. The returned group has its CIDRs in
+// canonical network form.
+func (g *GroupService) validateGroup(ctx context.Context, group model.Group) (model.Group, error) {
+	server, err := g.store.GetServer(ctx)
+	if err != nil {
+		return group, storeError(err, "server", "")
+	}
+	groups, err := g.store.GetGroups(ctx)
+	if err != nil {
+		return group, storeError(err, "groups", "")
+	}
+	peers, err := g.store.GetPeers(ctx)
+	if err != nil {
+		return group, storeError(err, "peers", "")
+	}
+
+	fields := make([]FieldError, 0)
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" || strings.ContainsAny(group.Name, "\r\n") {
+		fields = append(fields, FieldError{Field: "name", Message: "must be a single non-empty line"})
+	}
+	for _, other := range groups {
+		if other.ID != group.ID && strings.EqualFold(other.Name, group.Name) {
+			return group, Conflict("group name %q is already used by group %s", group.Name, other.ID)
+		}
+	}
+
+	serverNetworks := parseNetworks(server.Interface.Addresses)
+	networks := make([]*net.IPNet, 0, len(group.CIDRs))
+	if len(group.CIDRs) == 0 {
+		fields = append(fields, FieldError{Field: "cidrs", Message: "must not be empty"})
+	}
+	for _, cidr := range group.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "cidrs", Message: fmt.Sprintf("%q is not a CIDR", cidr)})
+			continue
+		}
+		inside := false
+		for _, serverNetwork := range serverNetworks {
+			if util.NetworkContains(serverNetwork, network) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			fields = append(fields, FieldError{Field: "cidrs", Message: fmt.Sprintf("%s is not inside a network of the server", network)})
+			continue
+		}
+		for _, other := range networks {
+			if util.NetworksOverlap(other, network) {
+				fields = append(fields, FieldError{Field: "cidrs", Message: fmt.Sprintf("%s overlaps %s", network, other)})
+			}
+		}
+		networks = append(networks, network)
+	}
+	if group.AllowedIPsSpec != nil {
+		if cidrs, err := util.BuildAllowedIPs(*group.AllowedIPsSpec, server.Interface.Addresses); err != nil {
+			fields = append(fields, FieldError{Field: "allowed_ips_spec", Message: err.Error()})
+		} else {
+			group.AllowedIPs = cidrs
+		}
+	}
+	if util.ValidateAllowedIPs(group.AllowedIPs) == false {
+		fields = append(fields, FieldError{Field: "allowed_ips", Message: "must be a list of CIDRs"})
+	}
+	fields = append(fields, validateDNS(group.DNSServers, group.SearchDomains, group.DNSRoutes)...)
+	if group.PersistentKeepalive < 0 || group.PersistentKeepalive > 65535 {
+		fields = append(fields, FieldError{Field: "persistent_keepalive", Message: "must be between 0 and 65535"})
+	}
+	// isolation is enforced by the firewall table only
+	if group.Isolated && !g.firewall.Enabled {
+		fields = append(fields, FieldError{Field: "isolated", Message: "needs the firewall, which is disabled"})
+	}
+	if len(fields) > 0 {
+		return group, Validation(fields...)
+	}
+
+	group.CIDRs = make([]string, 0, len(networks))
+	for _, network := range networks {
+		group.CIDRs = append(group.CIDRs, network.String())
+	}
+	for _, other := range groups {
+		if other.ID == group.ID {
+			continue
+		}
+		for _, otherNetwork := range parseNetworks(other.CIDRs) {
+			for _, network := range networks {
+				if util.NetworksOverlap(otherNetwork, network) {
+					return group, Conflict("%s overlaps %s of group %s", network, otherNetwork, other.ID)
+				}
+			}
+		}
+	}
+
+	// members must keep their addresses inside the pool and nobody else may
+	// hold an address in it
+	for _, peerData := range peers {
+		peer := peerData.Peer
+		for _, cidr := range peer.AllocatedIPs {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			inPool := networksContain(networks, ip)
+			if peer.GroupID == group.ID && !inPool {
+				return group, Conflict("address %s of peer %s is outside the group networks", ip, peer.ID)
+			}
+			if peer.GroupID != group.ID && inPool {
+				return group, Conflict("address %s of peer %s is inside the group networks", ip, peer.ID)
+			}
+		}
+	}
+	return group, nil
+}
+
+func (w *WireguardService) loadGroups(ctx context.Context) (map[string]model.Group, error) {
+	groups, err := w.store.GetGroups(ctx)
+	if err != nil {
+		return nil, storeError(err, "groups", "")
+	}
+	index := make(map[string]model.Group, len(groups))
+	for _, group := range groups {
+		index[group.ID] = group
+	}
+	return index, nil
+}
+
+// allocationPool returns the networks a peer of the group takes its
+// addresses from and the networks it has to stay out of. Peers without a
+// group use the server networks outside of every group pool.
+func allocationPool(server model.Server, groups map[string]model.Group, groupID string) ([]string, []*net.IPNet) {
+	if group, ok := groups[groupID]; ok {
+		return group.CIDRs, nil
+	}
+	reserved := make([]*net.IPNet, 0)
+	for _, group := range groups {
+		reserved = append(reserved, parseNetworks(group.CIDRs)...)
+	}
+	return server.Interface.Addresses, reserved
+}
+
+// assignGroup fills in the group defaults a new peer left out and allocates
+// its addresses from the matching pool
+func assignGroup(ctx context.Context, server model.Server, groups map[string]model.Group, peer *model.Peer, allocatedIPs []string) error {
+	if peer.GroupID != "" {
+		group, ok := groups[peer.GroupID]
+		if !ok {
+			return FieldInvalid("group_id", "group %s not found", peer.GroupID)
+		}
+		if len(peer.AllowedIPs) == 0 && peer.AllowedIPsSpec == nil {
+			if group.AllowedIPsSpec != nil {
+				peer.AllowedIPsSpec = group.AllowedIPsSpec
+			} else {
+				peer.AllowedIPs = group.AllowedIPs
+			}
+		}
+	}
+	if err := expandAllowedIPs(server, peer, nil); err != nil {
+		return err
+	}
+	pools, reserved := allocationPool(server, groups, peer.GroupID)
+	ips, err := suggestIPs(ctx, pools, allocatedIPs, reserved)
+	if err != nil {
+		return err
+	}
+	peer.AllocatedIPs = ips
+	return nil
+}
+
+// validateGroupAllocation checks that the addresses of a peer lie in the
+// pool of its group, or outside every pool for a peer without a group
+func validateGroupAllocation(peer model.Peer, groups map[string]model.Group) []FieldError {
+	fields := make([]FieldError, 0)
+	if peer.GroupID != "" {
+		if _, ok := groups[peer.GroupID]; !ok {
+			return append(fields, FieldError{Field: "group_id", Message: fmt.Sprintf("group %s not found", peer.GroupID)})
+		}
+	}
+	for _, cidr := range peer.AllocatedIPs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		for id, group := range groups {
+			inPool := networksContain(parseNetworks(group.CIDRs), ip)
+			if id == peer.GroupID && !inPool {
+				fields = append(fields, FieldError{Field: "allocated_ips", Message: fmt.Sprintf("IP %s is outside the networks of group %s", ip, id)})
+			}
+			if id != peer.GroupID && inPool {
+				fields = append(fields, FieldError{Field: "allocated_ips", Message: fmt.Sprintf("IP %s belongs to group %s", ip, id)})
+			}
+		}
+	}
+	return fields
+}
+
+// clientSettings returns the settings a peer's client config is built with
+func clientSettings(groups map[string]model.Group, peer model.Peer, settings model.GlobalSetting) model.GlobalSetting {
+	if group, ok := groups[peer.GroupID]; ok {
+		settings = group.ClientSettings(settings)
+	}
+	return peer.ClientSettings(settings)
+}
+
+func parseNetworks(cidrs []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+type IdempotencyService struct {
+	store  store.IStore
+	cfg    config.IdempotencyConfig
+	cipher cipher.AEAD
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+type IdempotencyServiceInterface interface {
+	Begin(ctx context.Context, key string, fingerprint string) (*model.IdempotencyRecord, error)
+	Complete(ctx context.Context, key string, fingerprint string, statusCode int, header map[string]string, body []byte) error
+	Release(key string)
+	Run(ctx context.Context)
+}
+
+func NewIdempotencyService(store store.IStore, cfg config.IdempotencyConfig) *IdempotencyService {
+	return &IdempotencyService{
+		store:    store,
+		cfg:      cfg,
+		cipher:   newResponseCipher(cfg.EncryptionKey),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// newResponseCipher seals the stored responses, which hold the keys of the
+// created peers. The key is checked when the config is read, a random key
+// stands in when none is configured.
+func newResponseCipher(encodedKey string) cipher.AEAD {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		logger.FromContext(context.Background()).Warn("[Idempotency] IDEMPOTENCY_ENCRYPTION_KEY is not set, responses stored before a restart cannot be replayed and their keys are answered with a conflict")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// Begin claims key for a request. It returns the stored record when the key
+// was already used with the same fingerprint, in which case the caller
+// replays it. Otherwise the key stays claimed until Complete or Release.
+func (s *IdempotencyService) Begin(ctx context.Context, key string, fingerprint string) (*model.IdempotencyRecord, error) {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return nil, FieldInvalid(IdempotencyKeyHeader, "must be between 1 and %d characters", maxIdempotencyKeyLength)
+	}
+
+	s.mu.Lock()
+	if s.inFlight[key] {
+		s.mu.Unlock()
+		return nil, Conflict("a request with this idempotency key is still in progress")
+	}
+	s.inFlight[key] = true
+	s.mu.Unlock()
+
+	record, err := s.store.GetIdempotencyRecordByID(ctx, idempotencyRecordID(key))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return nil, nil
+	case err != nil:
+		s.Release(key)
+		return nil, storeError(err, "idempotency key", "")
+	case record.ExpiresAt.Before(time.Now().UTC()):
+		return nil, nil
+	case record.Fingerprint != fingerprint:
+		s.Release(key)
+		return nil, FieldInvalid(IdempotencyKeyHeader, "was already used with a different request")
+	}
+	s.Release(key)
+
+	body, err := s.open(record)
+	if err != nil {
+		// sealed with another key, most likely the random one of an earlier run
+		logger.FromContext(ctx).WithError(err).Warn("[Idempotency] Cannot open stored response")
+		return nil, Conflict("the response to this idempotency key can no longer be replayed, it was stored under another encryption key")
+	}
+	record.Body = body
+	return &record, nil
+}
+
+// Complete stores the response for a claimed key and releases it
+func (s *IdempotencyService) Complete(ctx context.Context, key string, fingerprint string, statusCode int, header map[string]string, body []byte) error {
+	defer s.Release(key)
+
+	now := time.Now().UTC()
+	record := model.IdempotencyRecord{
+		ID:          idempotencyRecordID(key),
+		Key:         key,
+		Fingerprint: fingerprint,
+		StatusCode:  statusCode,
+		Header:      header,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.cfg.Retention),
+	}
+	sealed, err := s.seal(record.ID, body)
+	if err != nil {
+		return Internal(err, "cannot seal idempotent response")
+	}
+	record.Body = sealed
+	if err := s.store.SaveIdempotencyRecord(ctx, record); err != nil {
+		return storeError(err, "idempotency key", "")
+	}
+	return nil
+}
+
+// Release frees a claimed key without storing a response, so the request can be retried
+func (s *IdempotencyService) Release(key string) {
+	s.mu.Lock()
+	delete(s.inFlight, key)
+	s.mu.Unlock()
+}
+
+// Run removes expired records until ctx is cancelled
+func (s *IdempotencyService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		s.purgeExpired(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *IdempotencyService) purgeExpired(ctx context.Context) {
+	records, err := s.store.GetIdempotencyRecords(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Idempotency] Cannot get records")
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, record := range records {
+		if record.ExpiresAt.After(now) {
+			continue
+		}
+		if err := s.store.DeleteIdempotencyRecord(ctx, record.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			logger.FromContext(ctx).WithError(err).Error("[Idempotency] Cannot delete expired record")
+		}
+	}
+}
+
+// seal encrypts a response body, the record id is bound to it so a body cannot
+// be moved to another key
+func (s *IdempotencyService) seal(recordID string, body []byte) ([]byte, error) {
+	nonce := make([]byte, s.cipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.cipher.Seal(nonce, nonce, body, []byte(recordID)), nil
+}
+
+func (s *IdempotencyService) open(record model.IdempotencyRecord) ([]byte, error) {
+	if len(record.Body) < s.cipher.NonceSize() {
+		return nil, errors.New("sealed body is too short")
+	}
+	nonce, sealed := record.Body[:s.cipher.NonceSize()], record.Body[s.cipher.NonceSize():]
+	return s.cipher.Open(nil, nonce, sealed, []byte(record.ID))
+}
+
+// Fingerprint identifies a request by method, path and body
+func Fingerprint(method string, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotencyRecordID derives a file name safe record id from a client supplied key
+func idempotencyRecordID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+	"vpn-wg/internal/importer"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+)
+
+type ImportService struct {
+	wireguard WireguardServiceInterface
+}
+
+type ImportServiceInterface interface {
+	ImportPeers(ctx context.Context, rows []importer.Row, dryRun bool) (ImportReport, error)
+}
+
+func NewImportService(wireguard WireguardServiceInterface) *ImportService {
+	return &ImportService{
+		wireguard: wireguard,
+	}
+}
+
+// ImportReport lists the outcome of every imported row
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Created int               `json:"created"`
+	Planned int               `json:"planned"`
+	Failed  int               `json:"failed"`
+	Skipped int               `json:"skipped"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+type ImportRowResult struct {
+	Line         int         `json:"line"`
+	Name         string      `json:"name"`
+	Email        string      `json:"email"`
+	Status       string      `json:"status"`
+	PeerID       string      `json:"peer_id,omitempty"`
+	AllocatedIPs []string    `json:"allocated_ips,omitempty"`
+	Error        *BatchError `json:"error,omitempty"`
+	PeerConfig   string      `json:"-"`
+}
+
+// ImportPeers creates a peer for every row in one best effort batch. Rows
+// that could not be read are reported without being sent to the batch.
+func (s *ImportService) ImportPeers(ctx context.Context, rows []importer.Row, dryRun bool) (ImportReport, error) {
+	ctx, span := tracer.Start(ctx, "ImportService.ImportPeers")
+	defer span.End()
+
+	report := ImportReport{DryRun: dryRun, Rows: make([]ImportRowResult, len(rows))}
+	request := BatchRequest{Mode: BatchBestEffort, DryRun: dryRun}
+	batchRows := make([]int, 0, len(rows))
+
+	for i, row := range rows {
+		report.Rows[i] = ImportRowResult{Line: row.Line, Name: row.Name, Email: row.Email}
+		if row.Error != "" {
+			report.Rows[i].Status = BatchFailed
+			report.Rows[i].Error = &BatchError{Code: CodeValidation, Message: row.Error}
+			continue
+		}
+
+		peer := model.Peer{
+			Name:            strings.TrimSpace(row.Name),
+			Email:           row.Email,
+			PublicKey:       row.PublicKey,
+			AllowedIPs:      row.AllowedIPs,
+			ExtraAllowedIPs: row.ExtraAllowedIPs,
+			Tags:            row.Tags,
+			Enabled:         row.Enabled == nil || *row.Enabled,
+		}
+		document, err := json.Marshal(peer)
+		if err != nil {
+			return report, Internal(err, "cannot encode peer")
+		}
+		request.Operations = append(request.Operations, BatchOperation{Op: BatchCreate, Peer: document})
+		batchRows = append(batchRows, i)
+	}
+
+	if len(request.Operations) > 0 {
+		result, err := s.wireguard.Batch(ctx, request)
+		if err != nil {
+			return report, err
+		}
+		for _, item := range result.Results {
+			row := &report.Rows[batchRows[item.Index]]
+			row.Status = item.Status
+			row.Error = item.Error
+			row.PeerConfig = item.PeerConfig
+			if item.Peer != nil {
+				row.AllocatedIPs = item.Peer.AllocatedIPs
+				if !dryRun {
+					row.PeerID = item.Peer.ID
+				}
+			}
+		}
+	}
+
+	for _, row := range report.Rows {
+		switch row.Status {
+		case BatchSucceeded:
+			report.Created++
+		case BatchPlanned:
+			report.Planned++
+		case BatchFailed:
+			report.Failed++
+		case BatchSkipped:
+			report.Skipped++
+		}
+	}
+	logger.FromContext(ctx).WithFields(map[string]interface{}{
+		"rows":    len(rows),
+		"created": report.Created,
+		"planned": report.Planned,
+		"failed":  report.Failed,
+		"skipped": report.Skipped,
+		"dry_run": dryRun,
+	}).Info("[Peers] Import finished")
+
+	return report, nil
+}
+
+// WriteText writes the report one line per row
+func (r ImportReport) WriteText(w io.Writer) error {
+	for _, row := range r.Rows {
+		var line string
+		switch row.Status {
+		case BatchFailed:
+			line = fmt.Sprintf("line %d: %s: failed: %s", row.Line, row.Name, describeBatchError(row.Error))
+		case BatchPlanned:
+			line = fmt.Sprintf("line %d: %s: would be created with %s", row.Line, row.Name, strings.Join(row.AllocatedIPs, ", "))
+		case BatchSkipped:
+			line = fmt.Sprintf("line %d: %s: skipped", row.Line, row.Name)
+		default:
+			line = fmt.Sprintf("line %d: %s: created peer %s with %s", row.Line, row.Name, row.PeerID, strings.Join(row.AllocatedIPs, ", "))
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	summary := fmt.Sprintf("%d rows, %d created", len(r.Rows), r.Created)
+	if r.DryRun {
+		summary = fmt.Sprintf("%d rows, %d would be created", len(r.Rows), r.Planned)
+	}
+	summary += fmt.Sprintf(", %d failed", r.Failed)
+	if r.Skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", r.Skipped)
+	}
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
+
+var unsafeFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// WriteArchive writes a ZIP with the client config of every created peer
+// and the text report
+func (r ImportReport) WriteArchive(w io.Writer) error {
+	archive := zip.NewWriter(w)
+	create := func(name string) (io.Writer, error) {
+		return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	}
+	used := make(map[string]bool)
+	for _, row := range r.Rows {
+		if row.Status != BatchSucceeded || row.PeerConfig == "" {
+			continue
+		}
+		name := strings.Trim(unsafeFileName.ReplaceAllString(row.Name, "_"), "_")
+		if name == "" || used[name] {
+			name = fmt.Sprintf("%s-line%d", name, row.Line)
+		}
+		used[name] = true
+
+		file, err := create(name + ".conf")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(file, row.PeerConfig); err != nil {
+			return err
+		}
+	}
+	file, err := create("report.txt")
+	if err != nil {
+		return err
+	}
+	if err := r.WriteText(file); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func describeBatchError(err *BatchError) string {
+	if err == nil {
+		return "unknown error"
+	}
+	if len(err.Details) == 0 {
+		return err.Message
+	}
+	details := make([]string, 0, len(err.Details))
+	for _, field := range err.Details {
+		details = append(details, field.Field+" "+field.Message)
+	}
+	return strings.Join(details, "; ")
+}
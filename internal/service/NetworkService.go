@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/netsetup"
+	"vpn-wg/internal/store"
+	"vpn-wg/internal/util"
+)
+
+type NetworkService struct {
+	store   store.IStore
+	cfg     config.NetworkConfig
+	manager *netsetup.Manager
+}
+
+type NetworkServiceInterface interface {
+	Setup(ctx context.Context) error
+	Teardown(ctx context.Context) error
+	Status(ctx context.Context) (ServerStatus, error)
+}
+
+// ServerStatus describes the wireguard interface and the outcome of the
+// managed network setup
+type ServerStatus struct {
+	Interface  string           `json:"interface"`
+	ListenPort int              `json:"listen_port"`
+	Addresses  []string         `json:"addresses"`
+	PublicKey  string           `json:"public_key"`
+	Endpoints  []model.Endpoint `json:"endpoints"` // the default one first, ports resolved
+	Networking netsetup.Status  `json:"networking"`
+}
+
+func NewNetworkService(store store.IStore, cfg config.NetworkConfig, manager *netsetup.Manager) *NetworkService {
+	return &NetworkService{
+		store:   store,
+		cfg:     cfg,
+		manager: manager,
+	}
+}
+
+// Setup configures NAT and forwarding for the server networks when the
+// network is managed. Failed steps are logged and kept in the status.
+func (n *NetworkService) Setup(ctx context.Context) error {
+	if !n.cfg.Managed {
+		return nil
+	}
+	server, err := n.store.GetServer(ctx)
+	if err != nil {
+		return storeError(err, "server", "")
+	}
+	log := logger.FromContext(ctx)
+	if server.Interface.PostUp != "" || server.Interface.PostDown != "" {
+		log.Warn("[Network] PostUp or PostDown scripts are set while the network is managed, they may add the same rules twice")
+	}
+	if err := n.manager.Setup(ctx, server.Interface.Addresses); err != nil {
+		log.WithError(err).Error("[Network] Network setup incomplete")
+		return Internal(err, "network setup incomplete")
+	}
+	status := n.manager.Status()
+	log.WithField("egress_interface", status.EgressInterface).Info("[Network] Network setup done")
+	return nil
+}
+
+// Teardown removes everything Setup added
+func (n *NetworkService) Teardown(ctx context.Context) error {
+	if !n.cfg.Managed {
+		return nil
+	}
+	if err := n.manager.Teardown(ctx); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Network] Cannot remove network setup")
+		return Internal(err, "cannot remove network setup")
+	}
+	logger.FromContext(ctx).Info("[Network] Network setup removed")
+	return nil
+}
+
+func (n *NetworkService) Status(ctx context.Context) (ServerStatus, error) {
+	server, err := n.store.GetServer(ctx)
+	if err != nil {
+		return ServerStatus{}, storeError(err, "server", "")
+	}
+	settings, err := n.store.GetGlobalSettings(ctx)
+	if err != nil {
+		return ServerStatus{}, storeError(err, "settings", "")
+	}
+	endpoints := make([]model.Endpoint, 0, len(settings.Endpoints)+1)
+	if endpoint, err := util.ParseEndpoint(settings.EndpointAddress); err == nil {
+		endpoint.Name = "default"
+		endpoints = append(endpoints, endpoint)
+	}
+	endpoints = append(endpoints, settings.Endpoints...)
+	for i := range endpoints {
+		if endpoints[i].Port == 0 {
+			endpoints[i].Port = server.Interface.ListenPort
+		}
+	}
+	return ServerStatus{
+		Interface:  n.cfg.Interface,
+		ListenPort: server.Interface.ListenPort,
+		Addresses:  server.Interface.Addresses,
+		PublicKey:  server.KeyPair.PublicKey,
+		Endpoints:  endpoints,
+		Networking: n.manager.Status(),
+	}, nil
+}
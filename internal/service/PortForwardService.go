@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+)
+
+type PortForwardService struct {
+	store     store.IStore
+	firewall  config.FirewallConfig
+	wireguard WireguardServiceInterface
+}
+
+type PortForwardServiceInterface interface {
+	GetForwards(ctx context.Context) ([]model.PortForward, error)
+	GetForwardByID(ctx context.Context, id string) (model.PortForward, error)
+	CreateForward(ctx context.Context, forward model.PortForward) (model.PortForward, error)
+	EditForward(ctx context.Context, id string, forwardValue model.PortForward) (model.PortForward, error)
+	DeleteForward(ctx context.Context, id string) error
+}
+
+func NewPortForwardService(store store.IStore, firewall config.FirewallConfig, wireguard WireguardServiceInterface) *PortForwardService {
+	return &PortForwardService{
+		store:     store,
+		firewall:  firewall,
+		wireguard: wireguard,
+	}
+}
+
+func (p *PortForwardService) GetForwards(ctx context.Context) ([]model.PortForward, error) {
+	forwards, err := p.store.GetPortForwards(ctx)
+	if err != nil {
+		return forwards, storeError(err, "port forwards", "")
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		if forwards[i].PublicPort != forwards[j].PublicPort {
+			return forwards[i].PublicPort < forwards[j].PublicPort
+		}
+		return forwards[i].Protocol < forwards[j].Protocol
+	})
+	return forwards, nil
+}
+
+func (p *PortForwardService) GetForwardByID(ctx context.Context, id string) (model.PortForward, error) {
+	forward, err := p.store.GetPortForwardByID(ctx, id)
+	if err != nil {
+		return forward, storeError(err, "port forward", id)
+	}
+	return forward, nil
+}
+
+func (p *PortForwardService) CreateForward(ctx context.Context, forward model.PortForward) (model.PortForward, error) {
+	ctx, span := tracer.Start(ctx, "PortForwardService.CreateForward")
+	defer span.End()
+
+	forward.ID = uuid.NewV4().String()
+	if err := p.validateForward(ctx, forward); err != nil {
+		return forward, err
+	}
+	forward.CreatedAt = time.Now().UTC()
+	forward.UpdatedAt = forward.CreatedAt
+
+	if err := p.store.SavePortForward(ctx, forward); err != nil {
+		return forward, storeError(err, "port forward", forward.ID)
+	}
+	logger.FromContext(ctx).WithField("port_forward_id", forward.ID).Info("[Firewall] Created port forward")
+	return forward, p.applyForward(ctx, forward.ID, nil)
+}
+
+func (p *PortForwardService) EditForward(ctx context.Context, id string, forwardValue model.PortForward) (model.PortForward, error) {
+	ctx, span := tracer.Start(ctx, "PortForwardService.EditForward")
+	defer span.End()
+
+	forward, err := p.store.GetPortForwardByID(ctx, id)
+	if err != nil {
+		return forward, storeError(err, "port forward", id)
+	}
+	forwardValue.ID = id
+	if err := p.validateForward(ctx, forwardValue); err != nil {
+		return forward, err
+	}
+	previous := forward
+	forward.Description = forwardValue.Description
+	forward.Protocol = forwardValue.Protocol
+	forward.PublicPort = forwardValue.PublicPort
+	forward.PeerID = forwardValue.PeerID
+	forward.PeerPort = forwardValue.PeerPort
+	forward.Enabled = forwardValue.Enabled
+	forward.UpdatedAt = time.Now().UTC()
+
+	if err := p.store.SavePortForward(ctx, forward); err != nil {
+		return forward, storeError(err, "port forward", id)
+	}
+	logger.FromContext(ctx).WithField("port_forward_id", id).Info("[Firewall] Updated port forward")
+	if err := p.applyForward(ctx, id, &previous); err != nil {
+		return previous, err
+	}
+	return forward, nil
+}
+
+func (p *PortForwardService) DeleteForward(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "PortForwardService.DeleteForward")
+	defer span.End()
+
+	forward, err := p.store.GetPortForwardByID(ctx, id)
+	if err != nil {
+		return storeError(err, "port forward", id)
+	}
+	if err := p.store.DeletePortForward(ctx, id); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Firewall] Cannot delete port forward")
+		return storeError(err, "port forward", id)
+	}
+	return p.applyForward(ctx, id, &forward)
+}
+
+// applyForward applies a saved forward change and undoes it when the
+// firewall refuses the ruleset, like ACLService.applyRule
+func (p *PortForwardService) applyForward(ctx context.Context, id string, previous *model.PortForward) error {
+	err := p.wireguard.applyConfig(ctx)
+	if err == nil {
+		return nil
+	}
+	var rollbackErr error
+	if previous == nil {
+		rollbackErr = p.store.DeletePortForward(ctx, id)
+	} else {
+		rollbackErr = p.store.SavePortForward(ctx, *previous)
+	}
+	if rollbackErr != nil {
+		logger.FromContext(ctx).WithError(rollbackErr).WithField("port_forward_id", id).Error("[Firewall] Cannot roll back port forward")
+	}
+	return err
+}
+
+// validateForward checks the target peer and that the public port is not
+// taken by wireguard or by another forward
+func (p *PortForwardService) validateForward(ctx context.Context, forward model.PortForward) error {
+	// the DNAT rules live in the firewall table only
+	if !p.firewall.Enabled {
+		return Conflict("port forwards need the firewall, which is disabled")
+	}
+	if strings.ContainsAny(forward.Description, "\r\n") {
+		return FieldInvalid("description", "must not contain line breaks")
+	}
+	peerData, err := p.store.GetPeerByID(ctx, forward.PeerID)
+	if err != nil || peerData.Peer.Deleted() {
+		return FieldInvalid("peer_id", "peer %s not found", forward.PeerID)
+	}
+
+	server, err := p.store.GetServer(ctx)
+	if err != nil {
+		return storeError(err, "server", "")
+	}
+	// wireguard only listens on udp
+	if forward.Protocol == "udp" && forward.PublicPort == server.Interface.ListenPort {
+		return Conflict("udp port %d is the wireguard listen port", forward.PublicPort)
+	}
+	forwards, err := p.store.GetPortForwards(ctx)
+	if err != nil {
+		return storeError(err, "port forwards", "")
+	}
+	for _, other := range forwards {
+		if other.ID != forward.ID && other.Protocol == forward.Protocol && other.PublicPort == forward.PublicPort {
+			return Conflict("%s port %d is already forwarded by %s", forward.Protocol, forward.PublicPort, other.ID)
+		}
+	}
+	return nil
+}
+
+// deletePeerForwards removes the port forwards to a peer that is deleted
+func deletePeerForwards(ctx context.Context, s store.IStore, peerID string) error {
+	forwards, err := s.GetPortForwards(ctx)
+	if err != nil {
+		return err
+	}
+	for _, forward := range forwards {
+		if forward.PeerID != peerID {
+			continue
+		}
+		if err := s.DeletePortForward(ctx, forward.ID); err != nil {
+			return err
+		}
+		logger.FromContext(ctx).WithField("port_forward_id", forward.ID).WithField("peer_id", peerID).Info("[Firewall] Removed port forward of deleted peer")
+	}
+	return nil
+}
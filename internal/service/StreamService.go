@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+	"vpn-wg/internal/wgdevice"
+)
+
+const subscriberBufferSize = 64
+
+// StreamEvent is an event as it is sent to stream subscribers.
+// IDs are sequential within the process so clients can resume with Last-Event-ID.
+type StreamEvent struct {
+	ID     uint64
+	Type   string
+	PeerID string
+	Data   json.RawMessage
+}
+
+func (e StreamEvent) StringID() string {
+	return strconv.FormatUint(e.ID, 10)
+}
+
+// StreamFilter narrows a subscription; empty fields match everything
+type StreamFilter struct {
+	Types   []string
+	PeerIDs []string
+}
+
+func (f StreamFilter) Match(e StreamEvent) bool {
+	return matchAny(f.Types, e.Type) && matchAny(f.PeerIDs, e.PeerID)
+}
+
+type Subscription struct {
+	C      <-chan StreamEvent
+	ch     chan StreamEvent
+	filter StreamFilter
+}
+
+type PeerStatus struct {
+	PeerID          string    `json:"peer_id"`
+	Name            string    `json:"name"`
+	Endpoint        string    `json:"endpoint"`
+	LastHandshakeAt time.Time `json:"last_handshake_at"`
+	ReceiveBytes    int64     `json:"receive_bytes"`
+	TransmitBytes   int64     `json:"transmit_bytes"`
+	Online          bool      `json:"online"`
+}
+
+type StreamService struct {
+	store  store.IStore
+	device wgdevice.Reader
+	cfg    config.StreamConfig
+
+	mu          sync.Mutex
+	nextID      uint64
+	ring        []StreamEvent
+	head        int
+	size        int
+	subscribers map[*Subscription]struct{}
+	lastStats   map[string]wgdevice.PeerStats
+}
+
+type StreamServiceInterface interface {
+	Subscribe(filter StreamFilter, lastEventID uint64) *Subscription
+	Unsubscribe(sub *Subscription)
+	HeartbeatInterval() time.Duration
+	Publish(ctx context.Context, e event.Event)
+	Run(ctx context.Context)
+}
+
+func NewStreamService(store store.IStore, device wgdevice.Reader, cfg config.StreamConfig) *StreamService {
+	return &StreamService{
+		store:       store,
+		device:      device,
+		cfg:         cfg,
+		ring:        make([]StreamEvent, cfg.BufferSize),
+		subscribers: make(map[*Subscription]struct{}),
+		lastStats:   make(map[string]wgdevice.PeerStats),
+	}
+}
+
+// Subscribe registers a new subscriber. Buffered events newer than lastEventID
+// that match the filter are queued on the subscription before live events.
+func (s *StreamService) Subscribe(filter StreamFilter, lastEventID uint64) *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missed := make([]StreamEvent, 0)
+	if lastEventID > 0 {
+		for i := 0; i < s.size; i++ {
+			e := s.ring[(s.head+i)%len(s.ring)]
+			if e.ID > lastEventID && filter.Match(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan StreamEvent, subscriberBufferSize+len(missed))
+	for _, e := range missed {
+		ch <- e
+	}
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+	s.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (s *StreamService) Unsubscribe(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(sub)
+}
+
+func (s *StreamService) HeartbeatInterval() time.Duration {
+	return s.cfg.HeartbeatInterval
+}
+
+// Publish is the event bus handler for config and peer changes
+func (s *StreamService) Publish(ctx context.Context, e event.Event) {
+	peerID := ""
+	if peer, ok := e.Data.(model.Peer); ok {
+		peerID = peer.ID
+	}
+	s.publish(ctx, string(e.Type), peerID, e)
+}
+
+// Run polls the device for handshake and traffic changes until ctx is cancelled
+func (s *StreamService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.StatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.closeAll()
+			return
+		case <-ticker.C:
+			s.pollDevice(ctx)
+		}
+	}
+}
+
+func (s *StreamService) pollDevice(ctx context.Context) {
+	stats, err := s.device.Peers()
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Debug("[Stream] Cannot read wireguard device")
+		return
+	}
+	peers, err := s.store.GetPeers(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Stream] Cannot get peers")
+		return
+	}
+
+	now := time.Now()
+	for _, peerData := range peers {
+		peer := peerData.Peer
+		current, ok := stats[peer.PublicKey]
+		if !ok {
+			continue
+		}
+		if previous, seen := s.lastStats[peer.PublicKey]; seen && previous == current {
+			continue
+		}
+		s.lastStats[peer.PublicKey] = current
+
+		s.publish(ctx, string(event.PeerStatus), peer.ID, PeerStatus{
+			PeerID:          peer.ID,
+			Name:            peer.Name,
+			Endpoint:        current.Endpoint,
+			LastHandshakeAt: current.LastHandshakeTime,
+			ReceiveBytes:    current.ReceiveBytes,
+			TransmitBytes:   current.TransmitBytes,
+			Online:          current.Online(now),
+		})
+	}
+}
+
+func (s *StreamService) publish(ctx context.Context, eventType string, peerID string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Stream] Cannot encode event")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	e := StreamEvent{ID: s.nextID, Type: eventType, PeerID: peerID, Data: payload}
+
+	if len(s.ring) > 0 {
+		if s.size < len(s.ring) {
+			s.ring[(s.head+s.size)%len(s.ring)] = e
+			s.size++
+		} else {
+			s.ring[s.head] = e
+			s.head = (s.head + 1) % len(s.ring)
+		}
+	}
+
+	for sub := range s.subscribers {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			// a subscriber that cannot keep up is disconnected, it can resume with Last-Event-ID
+			logger.FromContext(ctx).Warn("[Stream] Dropping slow subscriber")
+			s.remove(sub)
+		}
+	}
+}
+
+func (s *StreamService) remove(sub *Subscription) {
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (s *StreamService) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		s.remove(sub)
+	}
+}
+
+func matchAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
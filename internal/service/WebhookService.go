@@ -0,0 +1,440 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+)
+
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+type WebhookService struct {
+	store  store.IStore
+	cfg    config.WebhookConfig
+	client *http.Client
+	wakeup chan struct{}
+
+	mu       sync.Mutex
+	inFlight map[string]bool          // deliveries being attempted
+	slots    map[string]chan struct{} // bounds the parallel deliveries per webhook
+	running  sync.WaitGroup
+}
+
+type WebhookServiceInterface interface {
+	GetWebhooks(ctx context.Context) ([]model.Webhook, error)
+	GetWebhookByID(ctx context.Context, id string) (model.Webhook, error)
+	CreateWebhook(ctx context.Context, webhook model.Webhook) (model.Webhook, error)
+	EditWebhook(ctx context.Context, id string, webhookValue model.Webhook) (model.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	GetDeliveries(ctx context.Context, webhookID string) ([]model.WebhookDelivery, error)
+	Redeliver(ctx context.Context, webhookID string, deliveryID string) (model.WebhookDelivery, error)
+	Dispatch(ctx context.Context, e event.Event)
+	Run(ctx context.Context)
+}
+
+func NewWebhookService(store store.IStore, cfg config.WebhookConfig) *WebhookService {
+	return &WebhookService{
+		store:  store,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		wakeup: make(chan struct{}, 1),
+
+		inFlight: make(map[string]bool),
+		slots:    make(map[string]chan struct{}),
+	}
+}
+
+func (w *WebhookService) GetWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	webhooks, err := w.store.GetWebhooks(ctx)
+	if err != nil {
+		return webhooks, storeError(err, "webhooks", "")
+	}
+	for i := range webhooks {
+		webhooks[i] = redactWebhook(webhooks[i])
+	}
+	return webhooks, nil
+}
+
+func (w *WebhookService) GetWebhookByID(ctx context.Context, id string) (model.Webhook, error) {
+	webhook, err := w.store.GetWebhookByID(ctx, id)
+	if err != nil {
+		return webhook, storeError(err, "webhook", id)
+	}
+	return redactWebhook(webhook), nil
+}
+
+func (w *WebhookService) CreateWebhook(ctx context.Context, webhook model.Webhook) (model.Webhook, error) {
+	webhook.ID = uuid.NewV4().String()
+	if webhook.Secret == "" {
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			logger.FromContext(ctx).WithError(err).Error("Cannot generate webhook secret")
+			return webhook, Internal(err, "cannot generate webhook secret")
+		}
+		webhook.Secret = secret
+	}
+	webhook.CreatedAt = time.Now().UTC()
+	webhook.UpdatedAt = webhook.CreatedAt
+
+	if err := w.store.SaveWebhook(ctx, webhook); err != nil {
+		return webhook, storeError(err, "webhook", webhook.ID)
+	}
+	return webhook, nil
+}
+
+func (w *WebhookService) EditWebhook(ctx context.Context, id string, webhookValue model.Webhook) (model.Webhook, error) {
+	webhook, err := w.store.GetWebhookByID(ctx, id)
+	if err != nil {
+		return webhook, storeError(err, "webhook", id)
+	}
+
+	webhook.URL = webhookValue.URL
+	webhook.Events = webhookValue.Events
+	webhook.Enabled = webhookValue.Enabled
+	if webhookValue.Secret != "" {
+		webhook.Secret = webhookValue.Secret
+	}
+	webhook.UpdatedAt = time.Now().UTC()
+
+	if err := w.store.SaveWebhook(ctx, webhook); err != nil {
+		return redactWebhook(webhook), storeError(err, "webhook", id)
+	}
+	return redactWebhook(webhook), nil
+}
+
+func (w *WebhookService) DeleteWebhook(ctx context.Context, id string) error {
+	if err := w.store.DeleteWebhook(ctx, id); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("Cannot delete webhook")
+		return storeError(err, "webhook", id)
+	}
+	w.mu.Lock()
+	delete(w.slots, id)
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *WebhookService) GetDeliveries(ctx context.Context, webhookID string) ([]model.WebhookDelivery, error) {
+	if _, err := w.store.GetWebhookByID(ctx, webhookID); err != nil {
+		return nil, storeError(err, "webhook", webhookID)
+	}
+	deliveries, err := w.store.GetWebhookDeliveries(ctx)
+	if err != nil {
+		return nil, storeError(err, "webhook deliveries", "")
+	}
+
+	result := make([]model.WebhookDelivery, 0)
+	for _, delivery := range deliveries {
+		if delivery.WebhookID == webhookID {
+			result = append(result, delivery)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// Redeliver queues a fresh copy of an earlier delivery, keeping the original in the log
+func (w *WebhookService) Redeliver(ctx context.Context, webhookID string, deliveryID string) (model.WebhookDelivery, error) {
+	original, err := w.store.GetWebhookDeliveryByID(ctx, deliveryID)
+	if err != nil {
+		return original, storeError(err, "webhook delivery", deliveryID)
+	}
+	if original.WebhookID != webhookID {
+		return original, NotFound("webhook delivery %s not found", deliveryID)
+	}
+
+	delivery := newDelivery(webhookID, original.EventID, original.EventType, original.Payload)
+	if err := w.store.SaveWebhookDelivery(ctx, delivery); err != nil {
+		return delivery, storeError(err, "webhook delivery", delivery.ID)
+	}
+	w.wake()
+	return delivery, nil
+}
+
+// Dispatch records a pending delivery for every enabled webhook subscribed to the event
+func (w *WebhookService) Dispatch(ctx context.Context, e event.Event) {
+	webhooks, err := w.store.GetWebhooks(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot get webhooks")
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot encode event")
+		return
+	}
+
+	queued := false
+	for _, webhook := range webhooks {
+		if !webhook.Enabled || !subscribed(webhook, e.Type) {
+			continue
+		}
+		delivery := newDelivery(webhook.ID, e.ID, string(e.Type), payload)
+		if err := w.store.SaveWebhookDelivery(ctx, delivery); err != nil {
+			logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot save delivery")
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		w.wake()
+	}
+}
+
+// Run delivers pending webhooks and purges finished deliveries past the
+// retention until ctx is cancelled. It returns once the running deliveries
+// have stopped.
+func (w *WebhookService) Run(ctx context.Context) {
+	defer w.running.Wait()
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(w.cfg.PurgeInterval)
+	defer purge.Stop()
+
+	w.purgeFinished(ctx)
+	for {
+		w.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wakeup:
+		case <-purge.C:
+			w.purgeFinished(ctx)
+		}
+	}
+}
+
+// purgeFinished removes the succeeded and failed deliveries that were last
+// attempted before the retention period. Pending deliveries are kept.
+func (w *WebhookService) purgeFinished(ctx context.Context) {
+	deliveries, err := w.store.GetWebhookDeliveries(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot get deliveries")
+		return
+	}
+
+	cutoff := time.Now().UTC().Add(-w.cfg.Retention)
+	for _, delivery := range deliveries {
+		if delivery.Status == model.DeliveryPending || delivery.UpdatedAt.After(cutoff) {
+			continue
+		}
+		if err := w.store.DeleteWebhookDelivery(ctx, delivery.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot delete finished delivery")
+		}
+	}
+}
+
+func (w *WebhookService) wake() {
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue starts the due deliveries that are not running yet without
+// waiting for them. Every webhook gets its own slots, so a slow endpoint
+// only holds up its own deliveries.
+func (w *WebhookService) deliverDue(ctx context.Context) {
+	deliveries, err := w.store.GetWebhookDeliveries(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot get deliveries")
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, delivery := range deliveries {
+		if delivery.Status != model.DeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		slot, ok := w.claim(delivery)
+		if !ok {
+			continue
+		}
+		w.running.Add(1)
+		go func(delivery model.WebhookDelivery) {
+			defer w.running.Done()
+			defer w.release(delivery.ID)
+			select {
+			case slot <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slot }()
+			w.attempt(ctx, delivery)
+		}(delivery)
+	}
+}
+
+// claim marks a delivery as running and returns the slots of its webhook,
+// it fails when the delivery is already running
+func (w *WebhookService) claim(delivery model.WebhookDelivery) (chan struct{}, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.inFlight[delivery.ID] {
+		return nil, false
+	}
+	w.inFlight[delivery.ID] = true
+	slot, ok := w.slots[delivery.WebhookID]
+	if !ok {
+		size := w.cfg.Concurrency
+		if size < 1 {
+			size = 1
+		}
+		slot = make(chan struct{}, size)
+		w.slots[delivery.WebhookID] = slot
+	}
+	return slot, true
+}
+
+func (w *WebhookService) release(deliveryID string) {
+	w.mu.Lock()
+	delete(w.inFlight, deliveryID)
+	w.mu.Unlock()
+}
+
+func (w *WebhookService) attempt(ctx context.Context, delivery model.WebhookDelivery) {
+	webhook, err := w.store.GetWebhookByID(ctx, delivery.WebhookID)
+	if err != nil {
+		delivery.Status = model.DeliveryFailed
+		delivery.LastError = "webhook no longer exists"
+		delivery.UpdatedAt = time.Now().UTC()
+		if err := w.store.SaveWebhookDelivery(ctx, delivery); err != nil {
+			logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot save delivery")
+		}
+		return
+	}
+
+	delivery.Attempts++
+	delivery.ResponseCode, err = w.send(ctx, webhook, delivery)
+	delivery.UpdatedAt = time.Now().UTC()
+
+	switch {
+	case err == nil:
+		delivery.Status = model.DeliverySucceeded
+		delivery.LastError = ""
+	case delivery.Attempts >= w.cfg.MaxAttempts:
+		delivery.Status = model.DeliveryFailed
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = delivery.UpdatedAt.Add(w.backoff(delivery.Attempts))
+	}
+
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).WithFields(map[string]interface{}{
+			"delivery_id": delivery.ID,
+			"url":         webhook.URL,
+			"attempt":     delivery.Attempts,
+		}).Warn("[Webhooks] Delivery failed")
+	}
+	if err := w.store.SaveWebhookDelivery(ctx, delivery); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Webhooks] Cannot save delivery")
+	}
+}
+
+func (w *WebhookService) send(ctx context.Context, webhook model.Webhook, delivery model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.EventType)
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+Sign(webhook.Secret, delivery.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff doubles the base delay for every failed attempt up to the configured maximum
+func (w *WebhookService) backoff(attempts int) time.Duration {
+	delay := w.cfg.RetryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= w.cfg.RetryMaxDelay {
+			return w.cfg.RetryMaxDelay
+		}
+	}
+	return delay
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of payload keyed with secret
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribed(webhook model.Webhook, eventType event.Type) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, name := range webhook.Events {
+		if name == "*" || name == string(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func newDelivery(webhookID string, eventID string, eventType string, payload []byte) model.WebhookDelivery {
+	now := time.Now().UTC()
+	return model.WebhookDelivery{
+		ID:            uuid.NewV4().String(),
+		WebhookID:     webhookID,
+		EventID:       eventID,
+		EventType:     eventType,
+		Payload:       payload,
+		Status:        model.DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+// redactWebhook leaves out the signing secret, which is only shown once
+// when the webhook is created
+func redactWebhook(webhook model.Webhook) model.Webhook {
+	webhook.Secret = ""
+	return webhook
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,416 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/satori/go.uuid"
+	"strings"
+	"time"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/util"
+)
+
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+
+	BatchCreate  = "create"
+	BatchEnable  = "enable"
+	BatchDisable = "disable"
+	BatchDelete  = "delete"
+	BatchTag     = "tag"
+
+	BatchSucceeded = "succeeded"
+	BatchPlanned   = "planned"
+	BatchFailed    = "failed"
+	BatchSkipped   = "skipped"
+)
+
+// BatchRequest runs many peer operations with a single config apply. In
+// atomic mode nothing is stored unless every operation succeeds, in
+// best_effort mode the failed operations are reported and the rest are kept.
+// A dry run validates and plans the operations without storing anything.
+type BatchRequest struct {
+	Mode       string           `json:"mode" binding:"omitempty,oneof=atomic best_effort"`
+	DryRun     bool             `json:"dry_run"`
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,max=1000,dive"`
+}
+
+// BatchOperation is a single step of a batch. Create takes the new peer in
+// Peer, the other operations name an existing peer by ID and may pin the
+// revision it is expected to have. Tag adds Tags to the peer.
+type BatchOperation struct {
+	Op       string          `json:"op" binding:"required,oneof=create enable disable delete tag"`
+	ID       string          `json:"id"`
+	Revision *int64          `json:"revision"`
+	Peer     json.RawMessage `json:"peer"`
+	Tags     []string        `json:"tags"`
+}
+
+type BatchResult struct {
+	Mode    string            `json:"mode"`
+	DryRun  bool              `json:"dry_run"`
+	Applied bool              `json:"applied"`
+	Results []BatchItemResult `json:"results"`
+}
+
+type BatchItemResult struct {
+	Index      int         `json:"index"`
+	Op         string      `json:"op"`
+	ID         string      `json:"id,omitempty"`
+	Status     string      `json:"status"`
+	Peer       *model.Peer `json:"peer,omitempty"`
+	PeerConfig string      `json:"peer_config,omitempty"`
+	Error      *BatchError `json:"error,omitempty"`
+}
+
+type BatchError struct {
+	Code    ErrorCode    `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// Failed returns the first failed item, if any
+func (r BatchResult) Failed() *BatchItemResult {
+	for i := range r.Results {
+		if r.Results[i].Status == BatchFailed {
+			return &r.Results[i]
+		}
+	}
+	return nil
+}
+
+// batchChange is a planned write. previous is nil for a create, a delete
+// moves next to the trash and removes its port forwards; next carries the
+// revision the peer will have once stored.
+type batchChange struct {
+	index    int
+	previous *model.Peer
+	next     *model.Peer
+}
+
+// batchState is the in-memory view of the peers a batch is planned against
+type batchState struct {
+	server       model.Server
+	settings     model.GlobalSetting
+	groups       map[string]model.Group
+	peers        map[string]model.Peer
+	allocatedIPs []string
+	usedKeys     map[string]string
+}
+
+func (w *WireguardService) Batch(ctx context.Context, request BatchRequest) (BatchResult, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.Batch")
+	defer span.End()
+
+	if request.Mode == "" {
+		request.Mode = BatchAtomic
+	}
+	result := BatchResult{Mode: request.Mode, DryRun: request.DryRun, Results: make([]BatchItemResult, len(request.Operations))}
+
+	state, err := w.loadBatchState(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	// plan every operation against the in-memory state, so addresses are
+	// allocated in one pass and later operations see the earlier ones
+	changes := make([]batchChange, 0, len(request.Operations))
+	for i, operation := range request.Operations {
+		result.Results[i] = BatchItemResult{Index: i, Op: operation.Op, ID: operation.ID}
+		change, err := w.planBatchOperation(ctx, state, i, operation)
+		if err != nil {
+			failBatchItem(&result.Results[i], err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	if request.Mode == BatchAtomic && result.Failed() != nil {
+		skipPendingBatchItems(&result)
+		return result, nil
+	}
+	if request.DryRun {
+		for _, change := range changes {
+			item := &result.Results[change.index]
+			item.Status = BatchPlanned
+			item.Peer = change.next
+		}
+		return result, nil
+	}
+
+	committed := make([]batchChange, 0, len(changes))
+	for _, change := range changes {
+		if err := w.commitBatchChange(ctx, change); err != nil {
+			failBatchItem(&result.Results[change.index], storeError(err, "peer", result.Results[change.index].ID))
+			if request.Mode == BatchAtomic {
+				w.rollbackBatch(ctx, committed)
+				skipPendingBatchItems(&result)
+				return result, nil
+			}
+			continue
+		}
+		committed = append(committed, change)
+	}
+	// port forwards cannot be rolled back, so they go once the batch is stored
+	for _, change := range committed {
+		if change.previous != nil && change.next.Deleted() {
+			if err := deletePeerForwards(ctx, w.store, change.next.ID); err != nil {
+				logger.FromContext(ctx).WithError(err).Error("[Firewall] Cannot remove port forwards of deleted peer")
+				return result, storeError(err, "port forwards", "")
+			}
+		}
+	}
+
+	applyNeeded := false
+	for _, change := range committed {
+		if change.previous == nil || affectsServerConfig(*change.previous, *change.next) {
+			applyNeeded = true
+			break
+		}
+	}
+	if applyNeeded {
+		if err := w.applyConfig(ctx); err != nil {
+			return result, err
+		}
+	}
+	result.Applied = len(committed) > 0
+
+	for _, change := range committed {
+		item := &result.Results[change.index]
+		item.Status = BatchSucceeded
+		switch {
+		case change.previous == nil:
+			item.ID = change.next.ID
+			item.Peer = change.next
+			item.PeerConfig = util.BuildPeerConfig(w.routedPeer(ctx, *change.next), state.server, clientSettings(state.groups, *change.next, state.settings))
+			w.bus.Publish(ctx, event.PeerCreated, peerEventData(*change.next))
+		case change.next.Deleted():
+			item.Peer = change.next
+			w.bus.Publish(ctx, event.PeerDeleted, peerEventData(*change.next))
+		default:
+			item.Peer = change.next
+			w.publishPeerChange(ctx, *change.previous, *change.next)
+		}
+	}
+	logger.FromContext(ctx).WithFields(map[string]interface{}{
+		"mode":       request.Mode,
+		"operations": len(request.Operations),
+		"committed":  len(committed),
+	}).Info("[Peers] Batch finished")
+
+	return result, nil
+}
+
+func (w *WireguardService) loadBatchState(ctx context.Context) (*batchState, error) {
+	server, err := w.store.GetServer(ctx)
+	if err != nil {
+		return nil, storeError(err, "server", "")
+	}
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		return nil, storeError(err, "peers", "")
+	}
+	allocatedIPs, err := w.allocatedIPs(server, peers, "")
+	if err != nil {
+		return nil, Internal(err, "cannot read allocated ips")
+	}
+	groups, err := w.loadGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		return nil, storeError(err, "settings", "")
+	}
+
+	// peers in the trash cannot be changed by a batch but keep their keys
+	state := &batchState{
+		server:       server,
+		settings:     settings,
+		groups:       groups,
+		peers:        make(map[string]model.Peer, len(peers)),
+		allocatedIPs: allocatedIPs,
+		usedKeys:     publicKeys(peers),
+	}
+	for _, peerData := range peers {
+		if !peerData.Peer.Deleted() {
+			state.peers[peerData.Peer.ID] = *peerData.Peer
+		}
+	}
+	return state, nil
+}
+
+// planBatchOperation validates one operation and records its effect in state
+func (w *WireguardService) planBatchOperation(ctx context.Context, state *batchState, index int, operation BatchOperation) (batchChange, error) {
+	if operation.Op == BatchCreate {
+		peer, err := w.planBatchCreate(ctx, state, operation)
+		if err != nil {
+			return batchChange{}, err
+		}
+		return batchChange{index: index, next: &peer}, nil
+	}
+
+	if operation.ID == "" {
+		return batchChange{}, FieldInvalid("id", "is required for %s", operation.Op)
+	}
+	previous, ok := state.peers[operation.ID]
+	if !ok {
+		return batchChange{}, NotFound("peer %s not found", operation.ID)
+	}
+	if operation.Revision != nil {
+		if err := checkRevision("peer", operation.ID, previous.Revision, *operation.Revision); err != nil {
+			return batchChange{}, err
+		}
+	}
+
+	next := previous
+	now := time.Now().UTC()
+	switch operation.Op {
+	case BatchDelete:
+		next.DeletedAt = &now
+	case BatchEnable:
+		next.Enabled = true
+	case BatchDisable:
+		next.Enabled = false
+	case BatchTag:
+		tags, err := addTags(previous.Tags, operation.Tags)
+		if err != nil {
+			return batchChange{}, err
+		}
+		next.Tags = tags
+	}
+	next.UpdatedAt = now
+	next.Revision = previous.Revision + 1
+	if next.Deleted() {
+		delete(state.peers, next.ID)
+	} else {
+		state.peers[next.ID] = next
+	}
+	return batchChange{index: index, previous: &previous, next: &next}, nil
+}
+
+func (w *WireguardService) planBatchCreate(ctx context.Context, state *batchState, operation BatchOperation) (model.Peer, error) {
+	peer := model.Peer{Enabled: true}
+	if len(operation.Peer) == 0 {
+		return peer, FieldInvalid("peer", "is required for create")
+	}
+	if err := json.Unmarshal(operation.Peer, &peer); err != nil {
+		return peer, FieldInvalid("peer", err.Error())
+	}
+	if util.ValidateAllowedIPs(peer.AllowedIPs) == false {
+		return peer, FieldInvalid("allowed_ips", "must be a list of CIDRs")
+	}
+	if util.ValidateExtraAllowedIPs(peer.ExtraAllowedIPs) == false {
+		return peer, FieldInvalid("extra_allowed_ips", "must be a list of CIDRs")
+	}
+	tags, err := addTags(nil, peer.Tags)
+	if err != nil {
+		return peer, err
+	}
+	peer.Tags = tags
+	fields := validateDNS(peer.DNSServers, peer.SearchDomains, nil)
+	fields = append(fields, validateOverrides(peer)...)
+	fields = append(fields, validateEndpoint(peer, state.settings)...)
+	fields = append(fields, validateMetadata(peer)...)
+	if len(fields) > 0 {
+		return peer, Validation(fields...)
+	}
+	others := make([]model.Peer, 0, len(state.peers))
+	for _, other := range state.peers {
+		others = append(others, other)
+	}
+	if err := validateRouter(state.server, others, peer); err != nil {
+		return peer, err
+	}
+
+	peer, err = w.prepareKeys(ctx, peer, state.usedKeys)
+	if err != nil {
+		return peer, err
+	}
+	if err := assignGroup(ctx, state.server, state.groups, &peer, state.allocatedIPs); err != nil {
+		return peer, err
+	}
+	for _, cidr := range peer.AllocatedIPs {
+		ip, _ := util.GetIPFromCIDR(cidr)
+		state.allocatedIPs = append(state.allocatedIPs, ip)
+	}
+
+	peer.ID = uuid.NewV4().String()
+	peer.CreatedAt = time.Now().UTC()
+	peer.UpdatedAt = peer.CreatedAt
+	peer.Revision = 1
+	peer.DeletedAt = nil
+	state.peers[peer.ID] = peer
+	state.usedKeys[peer.PublicKey] = peer.ID
+	return peer, nil
+}
+
+// commitBatchChange stores a planned change, expecting the revision it was planned against
+func (w *WireguardService) commitBatchChange(ctx context.Context, change batchChange) error {
+	peer := *change.next
+	peer.Revision--
+	return w.store.SavePeer(ctx, peer)
+}
+
+// rollbackBatch undoes committed changes in reverse order. Restored peers
+// get a new revision so clients holding the batch result notice the change.
+func (w *WireguardService) rollbackBatch(ctx context.Context, committed []batchChange) {
+	for i := len(committed) - 1; i >= 0; i-- {
+		change := committed[i]
+		var err error
+		if change.previous == nil {
+			err = w.store.DeletePeer(ctx, change.next.ID)
+		} else {
+			peer := *change.previous
+			peer.Revision = change.next.Revision
+			err = w.store.SavePeer(ctx, peer)
+		}
+		if err != nil {
+			logger.FromContext(ctx).WithError(err).WithField("index", change.index).Error("[Peers] Cannot roll back batch operation")
+		}
+	}
+}
+
+// addTags appends the new tags that are not present yet
+func addTags(tags []string, added []string) ([]string, error) {
+	result := append([]string{}, tags...)
+	for _, tag := range added {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, FieldInvalid("tags", "must not contain empty tags")
+		}
+		if !containsString(result, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func failBatchItem(item *BatchItemResult, err error) {
+	domainErr := AsError(err)
+	item.Status = BatchFailed
+	item.Peer = nil
+	item.Error = &BatchError{Code: domainErr.Code, Message: domainErr.Message, Details: domainErr.Fields}
+}
+
+// skipPendingBatchItems marks everything that did not fail as not applied
+func skipPendingBatchItems(result *BatchResult) {
+	result.Applied = false
+	for i := range result.Results {
+		if result.Results[i].Status != BatchFailed {
+			result.Results[i].Status = BatchSkipped
+			result.Results[i].Peer = nil
+		}
+	}
+}
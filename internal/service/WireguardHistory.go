@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+)
+
+// PeerChange is a field that differs between two revisions of a peer
+type PeerChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type PeerDiff struct {
+	PeerID  string       `json:"peer_id"`
+	From    int64        `json:"from"`
+	To      int64        `json:"to"`
+	Changes []PeerChange `json:"changes"`
+}
+
+func (w *WireguardService) GetPeerRevisions(ctx context.Context, id string) ([]model.PeerRevision, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.GetPeerRevisions")
+	defer span.End()
+
+	if _, err := w.store.GetPeerByID(ctx, id); err != nil {
+		return nil, storeError(err, "peer", id)
+	}
+	revisions, err := w.store.GetPeerRevisions(ctx, id)
+	if err != nil {
+		return nil, storeError(err, "peer revisions", id)
+	}
+	return revisions, nil
+}
+
+// DiffPeerRevisions compares two revisions of a peer field by field. A to
+// of 0 compares against the current revision.
+func (w *WireguardService) DiffPeerRevisions(ctx context.Context, id string, from int64, to int64) (PeerDiff, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.DiffPeerRevisions")
+	defer span.End()
+
+	diff := PeerDiff{PeerID: id, From: from, To: to, Changes: make([]PeerChange, 0)}
+	peerData, err := w.store.GetPeerByID(ctx, id)
+	if err != nil {
+		return diff, storeError(err, "peer", id)
+	}
+	if to == 0 {
+		diff.To = peerData.Peer.Revision
+	}
+
+	fromPeer, err := w.peerVersion(ctx, *peerData.Peer, diff.From)
+	if err != nil {
+		return diff, err
+	}
+	toPeer, err := w.peerVersion(ctx, *peerData.Peer, diff.To)
+	if err != nil {
+		return diff, err
+	}
+	diff.Changes, err = diffPeers(fromPeer, toPeer)
+	if err != nil {
+		return diff, Internal(err, "cannot compare peer revisions")
+	}
+	return diff, nil
+}
+
+// RestorePeerRevision brings the editable fields of an earlier revision
+// back. Keys are never restored, and the addresses are validated against the
+// current allocation like any other edit. revision works as in EditPeer.
+func (w *WireguardService) RestorePeerRevision(ctx context.Context, id string, restore int64, revision int64) (model.PeerData, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.RestorePeerRevision")
+	defer span.End()
+
+	peerData, err := w.store.GetPeerByID(ctx, id)
+	if err != nil {
+		return peerData, storeError(err, "peer", id)
+	}
+	if err := checkRevision("peer", id, peerData.Peer.Revision, revision); err != nil {
+		return peerData, err
+	}
+	if peerData.Peer.Deleted() {
+		return peerData, Conflict("peer %s is deleted, restore it first", id)
+	}
+	old, err := w.peerVersion(ctx, *peerData.Peer, restore)
+	if err != nil {
+		return peerData, err
+	}
+
+	previous := *peerData.Peer
+	peer := previous
+	peer.Name = old.Name
+	peer.Email = old.Email
+	peer.Enabled = old.Enabled
+	peer.UseServerDNS = old.UseServerDNS
+	peer.DNSServers = old.DNSServers
+	peer.SearchDomains = old.SearchDomains
+	peer.MTU = old.MTU
+	peer.PersistentKeepalive = old.PersistentKeepalive
+	peer.ForwardMark = old.ForwardMark
+	peer.EndpointAddress = old.EndpointAddress
+	peer.Endpoint = old.Endpoint
+	peer.AllocatedIPs = old.AllocatedIPs
+	peer.AllowedIPs = old.AllowedIPs
+	peer.AllowedIPsSpec = old.AllowedIPsSpec
+	peer.ExtraAllowedIPs = old.ExtraAllowedIPs
+	peer.Type = old.Type
+	peer.LANSubnets = old.LANSubnets
+	peer.LANInterface = old.LANInterface
+	peer.LANMasquerade = old.LANMasquerade
+	peer.GroupID = old.GroupID
+	peer.Tags = old.Tags
+	peer.Labels = old.Labels
+	peer.Owner = old.Owner
+	peer.Notes = old.Notes
+
+	if err := w.savePeerChange(ctx, previous, &peer); err != nil {
+		return peerData, err
+	}
+	logger.FromContext(ctx).WithFields(map[string]interface{}{
+		"peer_id":  id,
+		"restored": restore,
+	}).Info("Restored client revision")
+	peerData.Peer = &peer
+	w.describePeers(ctx, &peerData)
+
+	return peerData, nil
+}
+
+// peerVersion returns a revision of a peer with hashed secrets. The current
+// revision is taken from the peer itself, it may predate the history.
+func (w *WireguardService) peerVersion(ctx context.Context, current model.Peer, revision int64) (model.Peer, error) {
+	if revision == current.Revision {
+		return current.HashSecrets(), nil
+	}
+	peerRevision, err := w.store.GetPeerRevision(ctx, current.ID, revision)
+	if errors.Is(err, store.ErrNotFound) {
+		return model.Peer{}, NotFound("revision %d of peer %s not found", revision, current.ID)
+	}
+	if err != nil {
+		return model.Peer{}, storeError(err, "peer revision", current.ID)
+	}
+	return peerRevision.Peer, nil
+}
+
+// diffPeers lists the JSON fields that differ between two peers
+func diffPeers(from model.Peer, to model.Peer) ([]PeerChange, error) {
+	fromFields, err := peerFields(from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := peerFields(to)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(toFields))
+	for name := range toFields {
+		names = append(names, name)
+	}
+	for name := range fromFields {
+		if _, ok := toFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]PeerChange, 0)
+	for _, name := range names {
+		if name == "revision" {
+			continue
+		}
+		if !reflect.DeepEqual(fromFields[name], toFields[name]) {
+			changes = append(changes, PeerChange{Field: name, From: fromFields[name], To: toFields[name]})
+		}
+	}
+	return changes, nil
+}
+
+func peerFields(peer model.Peer) (map[string]interface{}, error) {
+	document, err := json.Marshal(peer)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	return fields, json.Unmarshal(document, &fields)
+}
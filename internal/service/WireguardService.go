@@ -1,52 +1,166 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/satori/go.uuid"
-	"github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+	"go.opentelemetry.io/otel"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
+	"vpn-wg/internal/cidrset"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/firewall"
+	"vpn-wg/internal/logger"
+	"vpn-wg/internal/metrics"
 	"vpn-wg/internal/model"
+	"vpn-wg/internal/selector"
 	"vpn-wg/internal/store"
 	"vpn-wg/internal/util"
 )
 
+var tracer = otel.Tracer("vpn-wg/internal/service")
+
 type WireguardService struct {
-	store store.IStore
+	store    store.IStore
+	bus      *event.Bus
+	trash    config.TrashConfig
+	firewall config.FirewallConfig
+	executor firewall.Executor
 }
 
 type WireguardServiceInterface interface {
-	CreateNew(peer model.Peer) (model.Peer, string, error)
-	EditPeer(id string, peerValue model.Peer) (model.PeerData, error)
-	DeletePeer(id string) error
-	applyConfig() error
+	CreateNew(ctx context.Context, peer model.Peer) (model.Peer, string, error)
+	GetPeers(ctx context.Context, filter PeerFilter) ([]model.PeerData, error)
+	GetPeer(ctx context.Context, id string, qrCode model.QRCodeSettings) (model.PeerData, error)
+	GetPeerConfig(ctx context.Context, id string, format string) (string, error)
+	CalculateAllowedIPs(ctx context.Context, spec model.AllowedIPsSpec) ([]string, error)
+	EditPeer(ctx context.Context, id string, revision int64, peerValue model.Peer) (model.PeerData, error)
+	PatchPeer(ctx context.Context, id string, revision int64, patch []byte) (model.PeerData, error)
+	DeletePeer(ctx context.Context, id string, revision int64) error
+	RestorePeer(ctx context.Context, id string, revision int64) (model.PeerData, error)
+	GetPeerRevisions(ctx context.Context, id string) ([]model.PeerRevision, error)
+	DiffPeerRevisions(ctx context.Context, id string, from int64, to int64) (PeerDiff, error)
+	RestorePeerRevision(ctx context.Context, id string, restore int64, revision int64) (model.PeerData, error)
+	Batch(ctx context.Context, request BatchRequest) (BatchResult, error)
+	GetSettings(ctx context.Context) (model.GlobalSetting, error)
+	UpdateSettings(ctx context.Context, revision int64, value model.GlobalSetting) (model.GlobalSetting, error)
+	Run(ctx context.Context)
+	ApplyFirewall(ctx context.Context) error
+	applyConfig(ctx context.Context) error
 }
 
-func NewWireguardService(store store.IStore) *WireguardService {
+func NewWireguardService(store store.IStore, bus *event.Bus, trash config.TrashConfig, firewallCfg config.FirewallConfig, executor firewall.Executor) *WireguardService {
 	return &WireguardService{
-		store: store,
+		store:    store,
+		bus:      bus,
+		trash:    trash,
+		firewall: firewallCfg,
+		executor: executor,
 	}
 }
 
 // TODO refactoring method to small function and add text message for error
-func (w *WireguardService) CreateNew(peer model.Peer) (model.Peer, string, error) {
-	server, err := w.store.GetServer()
+func (w *WireguardService) CreateNew(ctx context.Context, peer model.Peer) (model.Peer, string, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.CreateNew")
+	defer span.End()
+
+	server, err := w.store.GetServer(ctx)
 	var qrCode string
 	if err != nil {
-		logrus.Error("Cannot fetch server from database: ", err)
+		logger.FromContext(ctx).WithError(err).Error("Cannot fetch server from database")
+		return peer, qrCode, storeError(err, "server", "")
+	}
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		return peer, qrCode, storeError(err, "peers", "")
+	}
+	groups, err := w.loadGroups(ctx)
+	if err != nil {
+		return peer, qrCode, err
+	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get peers config")
+		return peer, qrCode, storeError(err, "settings", "")
+	}
+	allocatedIPs, err := w.allocatedIPs(server, peers, "")
+	if err != nil {
+		return peer, qrCode, Internal(err, "cannot read allocated ips")
+	}
+	if err := assignGroup(ctx, server, groups, &peer, allocatedIPs); err != nil {
 		return peer, qrCode, err
 	}
-	allocatedIPs, err := util.GetAllocatedIPs("")
+	if _, err := util.ValidateIPAllocation(server.Interface.Addresses, allocatedIPs, peer.AllocatedIPs); err != nil {
+		return peer, qrCode, FieldInvalid("allocated_ips", err.Error())
+	}
+
+	if util.ValidateAllowedIPs(peer.AllowedIPs) == false {
+		logger.FromContext(ctx).WithField("allowed_ips", peer.AllowedIPs).Warn("Invalid Allowed IPs input from user")
+		return peer, qrCode, FieldInvalid("allowed_ips", "must be a list of CIDRs")
+	}
+
+	if util.ValidateExtraAllowedIPs(peer.ExtraAllowedIPs) == false {
+		logger.FromContext(ctx).WithField("extra_allowed_ips", peer.ExtraAllowedIPs).Warn("Invalid Extra AllowedIPs input from user")
+		return peer, qrCode, FieldInvalid("extra_allowed_ips", "must be a list of CIDRs")
+	}
+	fields := validateDNS(peer.DNSServers, peer.SearchDomains, nil)
+	fields = append(fields, validateOverrides(peer)...)
+	fields = append(fields, validateEndpoint(peer, settings)...)
+	fields = append(fields, validateMetadata(peer)...)
+	if len(fields) > 0 {
+		return peer, qrCode, Validation(fields...)
+	}
+	if err := validateRouter(server, peerValues(peers), peer); err != nil {
+		return peer, qrCode, err
+	}
+	// generate ID
+	PeerUuid := uuid.NewV4()
+	peer.ID = PeerUuid.String()
+
+	peer, err = w.prepareKeys(ctx, peer, publicKeys(peers))
+	if err != nil {
+		return peer, qrCode, err
+	}
+	peer.CreatedAt = time.Now().UTC()
+	peer.UpdatedAt = peer.CreatedAt
+	peer.Revision = 0
+	peer.DeletedAt = nil
+
+	if err := w.store.SavePeer(ctx, peer); err != nil {
+		return peer, qrCode, storeError(err, "peer", peer.ID)
+	}
+	peer.Revision++
+	err = w.applyConfig(ctx)
+	if err != nil {
+		return model.Peer{}, qrCode, err
+	}
+	w.bus.Publish(ctx, event.PeerCreated, peerEventData(peer))
+	peerConfig := util.BuildPeerConfig(w.routedPeer(ctx, peer), server, clientSettings(groups, peer, settings))
+
+	return peer, peerConfig, nil
+}
+
+// suggestIPs picks the first free address outside the reserved networks in
+// every pool
+func suggestIPs(ctx context.Context, pools []string, allocatedIPs []string, reserved []*net.IPNet) ([]string, error) {
 	suggestedIPs := make([]string, 0)
 
-	for _, cidr := range server.Interface.Addresses {
-		ip, err := util.GetAvailableIP(cidr, allocatedIPs)
+	for _, cidr := range pools {
+		ip, err := util.GetAvailableIP(cidr, allocatedIPs, reserved...)
 		if err != nil {
-			logrus.Error("Failed to get available ip from a CIDR: ", err)
-			return peer, qrCode, err
+			logger.FromContext(ctx).WithError(err).Error("Failed to get available ip from a CIDR")
+			return nil, Conflict("no available ip address in %s", cidr)
 		}
 		if strings.Contains(ip, ":") {
 			suggestedIPs = append(suggestedIPs, fmt.Sprintf("%s/128", ip))
@@ -54,31 +168,43 @@ func (w *WireguardService) CreateNew(peer model.Peer) (model.Peer, string, error
 			suggestedIPs = append(suggestedIPs, fmt.Sprintf("%s/32", ip))
 		}
 	}
+	return suggestedIPs, nil
+}
 
-	peer.AllocatedIPs = suggestedIPs
-	check, err := util.ValidateIPAllocation(server.Interface.Addresses, allocatedIPs, peer.AllocatedIPs)
-	if !check {
-		return peer, qrCode, err
+// publicKeys maps the public key of every stored peer to the peer id.
+// Deleted peers keep their key until they are purged.
+func publicKeys(peers []model.PeerData) map[string]string {
+	usedKeys := make(map[string]string, len(peers))
+	for _, other := range peers {
+		usedKeys[other.Peer.PublicKey] = other.Peer.ID
 	}
+	return usedKeys
+}
 
-	if util.ValidateAllowedIPs(peer.AllowedIPs) == false {
-		logrus.Warnf("Invalid Allowed IPs input from user: %v", peer.AllowedIPs)
-		return peer, qrCode, err
+// allocatedIPs lists the addresses that cannot be handed out: the server's,
+// those of live peers and those of deleted peers still in quarantine
+func (w *WireguardService) allocatedIPs(server model.Server, peers []model.PeerData, ignorePeerID string) ([]string, error) {
+	now := time.Now().UTC()
+	holding := make([]model.PeerData, 0, len(peers))
+	for _, peerData := range peers {
+		if !peerData.Peer.Deleted() || peerData.Peer.DeletedAt.Add(w.trash.IPQuarantine).After(now) {
+			holding = append(holding, peerData)
+		}
 	}
+	return util.CollectAllocatedIPs(server.Interface.Addresses, holding, ignorePeerID)
+}
 
-	if util.ValidateExtraAllowedIPs(peer.ExtraAllowedIPs) == false {
-		logrus.Warnf("Invalid Extra AllowedIPs input from user: %v", peer.ExtraAllowedIPs)
-		return peer, qrCode, err
-	}
-	// generate ID
-	PeerUuid := uuid.NewV4()
-	peer.ID = PeerUuid.String()
+// prepareKeys generates the key pair and preshared key the request left out
+// and verifies the ones it provided against the keys already in use
+func (w *WireguardService) prepareKeys(ctx context.Context, peer model.Peer, usedKeys map[string]string) (model.Peer, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.prepareKeys")
+	defer span.End()
 
 	if peer.PublicKey == "" {
 		key, err := wgtypes.GeneratePrivateKey()
 		if err != nil {
-			logrus.Error("Cannot generate wireguard key pair: ", err)
-			return peer, qrCode, err
+			logger.FromContext(ctx).WithError(err).Error("Cannot generate wireguard key pair")
+			return peer, Internal(err, "cannot generate wireguard key pair")
 		}
 		peer.PrivateKey = key.String()
 		peer.PublicKey = key.PublicKey().String()
@@ -86,136 +212,937 @@ func (w *WireguardService) CreateNew(peer model.Peer) (model.Peer, string, error
 		_, err := wgtypes.ParseKey(peer.PublicKey)
 
 		if err != nil {
-			logrus.Error("Cannot verify wireguard public key: ", err)
-			return peer, qrCode, err
+			logger.FromContext(ctx).WithError(err).Error("Cannot verify wireguard public key")
+			return peer, FieldInvalid("public_key", "is not a valid wireguard key")
 		}
 		// check for duplicates
-		peers, err := w.store.GetPeers(false)
-		if err != nil {
-			logrus.Error("Cannot get clients for duplicate check")
-			return peer, qrCode, err
-		}
-		for _, other := range peers {
-			if other.Peer.PublicKey == peer.PublicKey {
-				logrus.Error("Duplicate Public Key")
-				return peer, qrCode, err
-			}
+		if otherID, ok := usedKeys[peer.PublicKey]; ok {
+			logger.FromContext(ctx).WithField("public_key", peer.PublicKey).Error("Duplicate Public Key")
+			return peer, Conflict("public key is already used by peer %s", otherID)
 		}
 	}
 
 	if peer.PresharedKey == "" {
 		presharedKey, err := wgtypes.GenerateKey()
 		if err != nil {
-			logrus.Error("Cannot generated preshared key: ", err)
-			return peer, qrCode, err
+			logger.FromContext(ctx).WithError(err).Error("Cannot generated preshared key")
+			return peer, Internal(err, "cannot generate preshared key")
 		}
 		peer.PresharedKey = presharedKey.String()
 	} else if peer.PresharedKey == "-" {
 		peer.PresharedKey = ""
-		logrus.Infof("skipped PresharedKey generation for user: %v", peer.Name)
+		logger.FromContext(ctx).WithField("name", peer.Name).Info("Skipped PresharedKey generation")
 	} else {
 		_, err := wgtypes.ParseKey(peer.PresharedKey)
 		if err != nil {
-			logrus.Error("Cannot verify wireguard preshared key: ", err)
-			return peer, qrCode, err
+			logger.FromContext(ctx).WithError(err).Error("Cannot verify wireguard preshared key")
+			return peer, FieldInvalid("preshared_key", "is not a valid wireguard key")
 		}
 	}
-	peer.CreatedAt = time.Now().UTC()
-	peer.UpdatedAt = peer.CreatedAt
+	return peer, nil
+}
 
-	if err := w.store.SavePeer(peer); err != nil {
-		return peer, qrCode, err
+// PeerFilter narrows a peer listing. Deleted lists the trash instead of the live peers.
+type PeerFilter struct {
+	Selector selector.Selector
+	Deleted  bool
+}
+
+func (w *WireguardService) GetPeers(ctx context.Context, filter PeerFilter) ([]model.PeerData, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.GetPeers")
+	defer span.End()
+
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		return nil, storeError(err, "peers", "")
+	}
+	matched := make([]model.PeerData, 0, len(peers))
+	for _, peerData := range peers {
+		if peerData.Peer.Deleted() == filter.Deleted && filter.Selector.Matches(peerData.Peer.Labels) {
+			matched = append(matched, peerData)
+		}
 	}
-	settings, err := w.store.GetGlobalSettings()
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Peer.CreatedAt.Before(matched[j].Peer.CreatedAt)
+	})
+	described := make([]*model.PeerData, 0, len(matched))
+	for i := range matched {
+		described = append(described, &matched[i])
+	}
+	w.describePeers(ctx, described...)
+	return matched, nil
+}
+
+// GetPeer returns a peer, with the QR code of its client config when
+// qrCode is enabled
+func (w *WireguardService) GetPeer(ctx context.Context, id string, qrCode model.QRCodeSettings) (model.PeerData, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.GetPeer")
+	defer span.End()
+
+	peerData, err := w.store.GetPeerByID(ctx, id)
 	if err != nil {
-		logrus.Error("[Peers] Cannot get peers config")
-		return peer, qrCode, err
+		return peerData, storeError(err, "peer", id)
 	}
-	err = w.applyConfig()
+	w.describePeers(ctx, &peerData)
+	if qrCode.Enabled && peerData.Peer.PrivateKey != "" && !peerData.Peer.Deleted() {
+		peerData.QRCode = w.peerQRCode(ctx, *peerData.Peer, qrCode)
+	}
+	return peerData, nil
+}
+
+// peerQRCode renders the wg-quick config of a peer as a PNG data URL. The
+// settings left out by qrCode are dropped from the config. It only logs
+// failures and returns an empty string then.
+func (w *WireguardService) peerQRCode(ctx context.Context, peer model.Peer, qrCode model.QRCodeSettings) string {
+	ctx, span := tracer.Start(ctx, "WireguardService.peerQRCode")
+	defer span.End()
+
+	server, err := w.store.GetServer(ctx)
 	if err != nil {
-		return model.Peer{}, qrCode, err
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get server config")
+		return ""
+	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get global settings")
+		return ""
+	}
+	groups, err := w.loadGroups(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get groups")
+		return ""
 	}
-	peerConfig := util.BuildPeerConfig(peer, server, settings)
 
-	return peer, peerConfig, nil
+	qrPeer := w.routedPeer(ctx, peer)
+	settings = clientSettings(groups, peer, settings)
+	if !qrCode.IncludeDNS {
+		settings.DNSServers = []string{}
+		qrPeer.UseServerDNS = false
+	}
+	if !qrCode.IncludeMTU {
+		settings.MTU = 0
+	}
+	if !qrCode.IncludeFwMark {
+		settings.ForwardMark = ""
+	}
+	png, err := qrcode.Encode(util.BuildPeerConfig(qrPeer, server, settings), qrcode.Medium, 256)
+	if err != nil {
+		span.RecordError(err)
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot generate QR code")
+		return ""
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+}
+
+// describePeers fills in the effective client settings of the peers. It
+// only logs failures, the peers are still worth returning without them.
+func (w *WireguardService) describePeers(ctx context.Context, peers ...*model.PeerData) {
+	server, err := w.store.GetServer(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get server config")
+		return
+	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get global settings")
+		return
+	}
+	groups, err := w.loadGroups(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get groups")
+		return
+	}
+	for _, peerData := range peers {
+		var group *model.Group
+		if g, ok := groups[peerData.Peer.GroupID]; ok {
+			group = &g
+		}
+		effective := util.EffectiveSettings(*peerData.Peer, server, settings, group)
+		peerData.Effective = &effective
+	}
 }
 
-func (w *WireguardService) EditPeer(id string, peerValue model.Peer) (model.PeerData, error) {
-	peerData, err := w.store.GetPeerByID(id, model.QRCodeSettings{Enabled: false})
+// GetPeerConfig renders the client config of a peer with its group defaults
+// in one of the util.ConfigFormat formats
+func (w *WireguardService) GetPeerConfig(ctx context.Context, id string, format string) (string, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.GetPeerConfig")
+	defer span.End()
 
+	peerData, err := w.store.GetPeerByID(ctx, id)
 	if err != nil {
-		return peerData, err
+		return "", storeError(err, "peer", id)
+	}
+	if peerData.Peer.Deleted() {
+		return "", NotFound("peer %s not found", id)
 	}
+	server, err := w.store.GetServer(ctx)
+	if err != nil {
+		return "", storeError(err, "server", "")
+	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		return "", storeError(err, "settings", "")
+	}
+	groups, err := w.loadGroups(ctx)
+	if err != nil {
+		return "", err
+	}
+	config, err := util.BuildClientConfig(format, w.routedPeer(ctx, *peerData.Peer), server, clientSettings(groups, *peerData.Peer, settings))
+	if err != nil {
+		return "", FieldInvalid("format", "must be %s, %s or %s", util.ConfigFormatWgQuick, util.ConfigFormatNetworkManager, util.ConfigFormatResolved)
+	}
+	return config, nil
+}
 
-	server, err := w.store.GetServer()
+// routedPeer adds the LAN subnets of the router peers it may reach to the
+// client AllowedIPs of a peer. The peer is left as is when the routes
+// cannot be loaded.
+func (w *WireguardService) routedPeer(ctx context.Context, peer model.Peer) model.Peer {
+	routes, err := peerRoutes(ctx, w.store, w.firewall, peer)
 	if err != nil {
-		return peerData, err
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot load the router routes")
+		return peer
 	}
+	return util.WithRoutes(peer, routes)
+}
 
-	peer := *peerData.Peer
-	allocatedIPs, err := util.GetAllocatedIPs(peer.ID)
+// EditPeer replaces the editable fields of a peer. revision is the revision
+// the caller last saw, or AnyRevision to skip the check.
+func (w *WireguardService) EditPeer(ctx context.Context, id string, revision int64, peerValue model.Peer) (model.PeerData, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.EditPeer")
+	defer span.End()
 
-	check, err := util.ValidateIPAllocation(server.Interface.Addresses, allocatedIPs, peer.AllocatedIPs)
-	if !check {
-		return peerData, err
+	peerData, err := w.store.GetPeerByID(ctx, id)
+
+	if err != nil {
+		return peerData, storeError(err, "peer", id)
 	}
-	if util.ValidateAllowedIPs(peer.AllowedIPs) == false {
-		logrus.Warnf("Invalid Allowed IPs input from user: %v", peer.AllowedIPs)
+	if err := checkRevision("peer", id, peerData.Peer.Revision, revision); err != nil {
 		return peerData, err
 	}
+	if peerData.Peer.Deleted() {
+		return peerData, Conflict("peer %s is deleted, restore it first", id)
+	}
 
+	previous := *peerData.Peer
+	peer := previous
 	peer.Name = peerValue.Name
 	peer.Email = peerValue.Email
 	peer.Enabled = peerValue.Enabled
 	peer.UseServerDNS = peerValue.UseServerDNS
+	peer.DNSServers = peerValue.DNSServers
+	peer.SearchDomains = peerValue.SearchDomains
+	peer.MTU = peerValue.MTU
+	peer.PersistentKeepalive = peerValue.PersistentKeepalive
+	peer.ForwardMark = peerValue.ForwardMark
+	peer.EndpointAddress = peerValue.EndpointAddress
+	peer.Endpoint = peerValue.Endpoint
 	peer.AllocatedIPs = peerValue.AllocatedIPs
 	peer.AllowedIPs = peerValue.AllowedIPs
-	peer.UpdatedAt = time.Now().UTC()
+	peer.AllowedIPsSpec = peerValue.AllowedIPsSpec
+	peer.ExtraAllowedIPs = peerValue.ExtraAllowedIPs
+	peer.Type = peerValue.Type
+	peer.LANSubnets = peerValue.LANSubnets
+	peer.LANInterface = peerValue.LANInterface
+	peer.LANMasquerade = peerValue.LANMasquerade
+	peer.GroupID = peerValue.GroupID
+	peer.Tags = peerValue.Tags
+	peer.Labels = peerValue.Labels
+	peer.Owner = peerValue.Owner
+	peer.Notes = peerValue.Notes
 
-	if err := w.store.SavePeer(peer); err != nil {
+	if err := w.savePeerChange(ctx, previous, &peer); err != nil {
 		return peerData, err
 	}
-	logrus.Infof("Updated client information successfully => %v", peer)
+	peerData.Peer = &peer
+	w.describePeers(ctx, &peerData)
 
 	return peerData, nil
 }
 
-func (w *WireguardService) DeletePeer(id string) error {
-	fmt.Println(id)
-	if err := w.store.DeletePeer(id); err != nil {
-		logrus.Error("Cannot delete wireguard client: ", err)
-		return err
+// readOnlyPeerFields cannot be changed through a merge patch
+var readOnlyPeerFields = []string{"id", "private_key", "public_key", "created_at", "updated_at", "revision", "deleted_at"}
+
+// PatchPeer applies an RFC 7396 JSON merge patch to a peer. Fields missing
+// from the patch keep their value and null removes a field.
+func (w *WireguardService) PatchPeer(ctx context.Context, id string, revision int64, patch []byte) (model.PeerData, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.PatchPeer")
+	defer span.End()
+
+	peerData, err := w.store.GetPeerByID(ctx, id)
+	if err != nil {
+		return peerData, storeError(err, "peer", id)
+	}
+	if err := checkRevision("peer", id, peerData.Peer.Revision, revision); err != nil {
+		return peerData, err
+	}
+	if peerData.Peer.Deleted() {
+		return peerData, Conflict("peer %s is deleted, restore it first", id)
+	}
+
+	changes := map[string]json.RawMessage{}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return peerData, FieldInvalid("body", "must be a JSON object")
+	}
+	fields := make([]FieldError, 0)
+	for _, name := range readOnlyPeerFields {
+		if _, ok := changes[name]; ok {
+			fields = append(fields, FieldError{Field: name, Message: "is read-only"})
+		}
+	}
+	if len(fields) > 0 {
+		return peerData, Validation(fields...)
+	}
+
+	previous := *peerData.Peer
+	document, err := json.Marshal(previous)
+	if err != nil {
+		return peerData, Internal(err, "cannot encode peer")
+	}
+	merged, err := util.ApplyMergePatch(document, patch)
+	if err != nil {
+		return peerData, FieldInvalid("body", err.Error())
+	}
+
+	peer := model.Peer{}
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&peer); err != nil {
+		return peerData, FieldInvalid("body", err.Error())
+	}
+
+	if err := w.savePeerChange(ctx, previous, &peer); err != nil {
+		return peerData, err
+	}
+	peerData.Peer = &peer
+	w.describePeers(ctx, &peerData)
+
+	return peerData, nil
+}
+
+// validatePeer checks the addresses of a peer that is about to be saved
+// against the server networks and the addresses held by other peers
+func (w *WireguardService) validatePeer(ctx context.Context, peer model.Peer) error {
+	server, err := w.store.GetServer(ctx)
+	if err != nil {
+		return storeError(err, "server", "")
+	}
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		return storeError(err, "peers", "")
 	}
-	if err := w.applyConfig(); err != nil {
+	allocatedIPs, err := w.allocatedIPs(server, peers, peer.ID)
+	if err != nil {
+		return Internal(err, "cannot read allocated ips")
+	}
+	groups, err := w.loadGroups(ctx)
+	if err != nil {
 		return err
 	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		return storeError(err, "settings", "")
+	}
+
+	fields := make([]FieldError, 0)
+	if len(peer.AllocatedIPs) == 0 {
+		fields = append(fields, FieldError{Field: "allocated_ips", Message: "must not be empty"})
+	} else if _, err := util.ValidateIPAllocation(server.Interface.Addresses, allocatedIPs, peer.AllocatedIPs); err != nil {
+		fields = append(fields, FieldError{Field: "allocated_ips", Message: err.Error()})
+	} else {
+		fields = append(fields, validateGroupAllocation(peer, groups)...)
+	}
+	if util.ValidateAllowedIPs(peer.AllowedIPs) == false {
+		logger.FromContext(ctx).WithField("allowed_ips", peer.AllowedIPs).Warn("Invalid Allowed IPs input from user")
+		fields = append(fields, FieldError{Field: "allowed_ips", Message: "must be a list of CIDRs"})
+	}
+	if util.ValidateExtraAllowedIPs(peer.ExtraAllowedIPs) == false {
+		logger.FromContext(ctx).WithField("extra_allowed_ips", peer.ExtraAllowedIPs).Warn("Invalid Extra AllowedIPs input from user")
+		fields = append(fields, FieldError{Field: "extra_allowed_ips", Message: "must be a list of CIDRs"})
+	}
+	fields = append(fields, validateDNS(peer.DNSServers, peer.SearchDomains, nil)...)
+	fields = append(fields, validateOverrides(peer)...)
+	fields = append(fields, validateEndpoint(peer, settings)...)
+	fields = append(fields, validateMetadata(peer)...)
+	if len(fields) > 0 {
+		return Validation(fields...)
+	}
+	return validateRouter(server, peerValues(peers), peer)
+}
+
+func peerValues(peers []model.PeerData) []model.Peer {
+	values := make([]model.Peer, 0, len(peers))
+	for _, peerData := range peers {
+		values = append(values, *peerData.Peer)
+	}
+	return values
+}
+
+// CalculateAllowedIPs returns the minimized AllowedIPs of a spec against
+// the current server networks
+func (w *WireguardService) CalculateAllowedIPs(ctx context.Context, spec model.AllowedIPsSpec) ([]string, error) {
+	server, err := w.store.GetServer(ctx)
+	if err != nil {
+		return nil, storeError(err, "server", "")
+	}
+	peer := model.Peer{AllowedIPsSpec: &spec}
+	if err := expandAllowedIPs(server, &peer, nil); err != nil {
+		return nil, err
+	}
+	return peer.AllowedIPs, nil
+}
+
+// expandAllowedIPs replaces the AllowedIPs of a peer with the result of its
+// spec, peers without a spec keep their list. The spec wins: a list that
+// changed from previous and differs from the spec result is rejected, the
+// spec has to be removed to set the list directly.
+func expandAllowedIPs(server model.Server, peer *model.Peer, previous []string) error {
+	if peer.AllowedIPsSpec == nil {
+		return nil
+	}
+	cidrs, err := util.BuildAllowedIPs(*peer.AllowedIPsSpec, server.Interface.Addresses)
+	if err != nil {
+		return FieldInvalid("allowed_ips_spec", err.Error())
+	}
+	if len(peer.AllowedIPs) > 0 && strings.Join(peer.AllowedIPs, ",") != strings.Join(previous, ",") {
+		if minimized, err := cidrset.Minimize(peer.AllowedIPs); err != nil || strings.Join(minimized, ",") != strings.Join(cidrs, ",") {
+			return FieldInvalid("allowed_ips", "cannot be set together with allowed_ips_spec, remove the spec to set the list directly")
+		}
+	}
+	peer.AllowedIPs = cidrs
 	return nil
 }
 
-func (w *WireguardService) applyConfig() error {
-	server, err := w.store.GetServer()
+// validateRouter checks the LAN subnets of a peer. They must not overlap
+// the server networks or each other, and no other peer may route them.
+func validateRouter(server model.Server, others []model.Peer, peer model.Peer) error {
+	fields := make([]FieldError, 0)
+	switch peer.Type {
+	case "", model.PeerTypeClient:
+		if len(peer.LANSubnets) > 0 {
+			fields = append(fields, FieldError{Field: "lan_subnets", Message: "only router peers have LAN subnets"})
+		}
+	case model.PeerTypeRouter:
+		if len(peer.LANSubnets) == 0 {
+			fields = append(fields, FieldError{Field: "lan_subnets", Message: "must not be empty for a router"})
+		}
+	default:
+		fields = append(fields, FieldError{Field: "type", Message: fmt.Sprintf("must be %s or %s", model.PeerTypeClient, model.PeerTypeRouter)})
+	}
+	if strings.ContainsAny(peer.LANInterface, " \t\r\n;") {
+		fields = append(fields, FieldError{Field: "lan_interface", Message: "must be an interface name"})
+	}
+	serverNetworks := parseNetworks(server.Interface.Addresses)
+	networks := make([]*net.IPNet, 0, len(peer.LANSubnets))
+	for _, cidr := range peer.LANSubnets {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "lan_subnets", Message: fmt.Sprintf("%q is not a CIDR", cidr)})
+			continue
+		}
+		for _, other := range append(append([]*net.IPNet{}, serverNetworks...), networks...) {
+			if util.NetworksOverlap(other, network) {
+				fields = append(fields, FieldError{Field: "lan_subnets", Message: fmt.Sprintf("%s overlaps %s", network, other)})
+			}
+		}
+		networks = append(networks, network)
+	}
+	if len(fields) > 0 {
+		return Validation(fields...)
+	}
+
+	extra := parseNetworks(peer.ExtraAllowedIPs)
+	for _, other := range others {
+		if other.ID == peer.ID || other.Deleted() {
+			continue
+		}
+		otherRanges := append(append(append([]string{}, other.AllocatedIPs...), other.ExtraAllowedIPs...), other.LANSubnets...)
+		for _, otherNetwork := range parseNetworks(otherRanges) {
+			for _, network := range networks {
+				if util.NetworksOverlap(otherNetwork, network) {
+					return Conflict("%s overlaps %s of peer %s", network, otherNetwork, other.ID)
+				}
+			}
+		}
+		for _, otherNetwork := range parseNetworks(other.LANSubnets) {
+			for _, network := range extra {
+				if util.NetworksOverlap(otherNetwork, network) {
+					return Conflict("%s overlaps the LAN subnet %s of peer %s", network, otherNetwork, other.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateOverrides checks the client settings a peer overrides. They end up
+// in the client config, so the strings must stay on one line.
+func validateOverrides(peer model.Peer) []FieldError {
+	fields := make([]FieldError, 0)
+	if peer.MTU != nil && (*peer.MTU < 0 || *peer.MTU > 65535) {
+		fields = append(fields, FieldError{Field: "mtu", Message: "must be between 0 and 65535"})
+	}
+	if peer.PersistentKeepalive != nil && (*peer.PersistentKeepalive < 0 || *peer.PersistentKeepalive > 65535) {
+		fields = append(fields, FieldError{Field: "persistent_keepalive", Message: "must be between 0 and 65535"})
+	}
+	if peer.ForwardMark != nil && *peer.ForwardMark != "" {
+		if _, err := strconv.ParseUint(*peer.ForwardMark, 0, 32); err != nil {
+			fields = append(fields, FieldError{Field: "forward_mark", Message: "must be a 32 bit number such as 0xca6c"})
+		}
+	}
+	if peer.EndpointAddress != nil {
+		if _, err := util.ParseEndpoint(*peer.EndpointAddress); err != nil {
+			fields = append(fields, FieldError{Field: "endpoint_address", Message: err.Error()})
+		}
+	}
+	return fields
+}
+
+// validateEndpoint checks that the endpoint a peer picked is one of the
+// settings endpoints
+func validateEndpoint(peer model.Peer, settings model.GlobalSetting) []FieldError {
+	if _, ok := peer.SelectedEndpoint(settings); peer.Endpoint != "" && !ok {
+		return []FieldError{{Field: "endpoint", Message: fmt.Sprintf("%q is not one of the settings endpoints", peer.Endpoint)}}
+	}
+	return nil
+}
+
+// validateMetadata checks the descriptive fields. Labels and the owner end
+// up as comments in the server config, so they must stay on one line.
+func validateMetadata(peer model.Peer) []FieldError {
+	fields := make([]FieldError, 0)
+	for key, value := range peer.Labels {
+		if !selector.ValidKey(key) {
+			fields = append(fields, FieldError{Field: "labels", Message: fmt.Sprintf("%q is not a valid label key", key)})
+		} else if len(value) > 63 || strings.ContainsAny(value, ",=!\r\n") {
+			fields = append(fields, FieldError{Field: "labels", Message: fmt.Sprintf("value of %q must be at most 63 characters without ',', '=', '!' or line breaks", key)})
+		}
+	}
+	if strings.ContainsAny(peer.Owner, "\r\n") {
+		fields = append(fields, FieldError{Field: "owner", Message: "must not contain line breaks"})
+	}
+	for _, tag := range peer.Tags {
+		if strings.TrimSpace(tag) == "" {
+			fields = append(fields, FieldError{Field: "tags", Message: "must not contain empty tags"})
+			break
+		}
+	}
+	return fields
+}
+
+// savePeerChange validates and stores an edited peer, re-applies the server
+// config when the edit touches it and publishes the matching events. The
+// store rejects the write if the peer changed since previous was read.
+func (w *WireguardService) savePeerChange(ctx context.Context, previous model.Peer, peer *model.Peer) error {
+	server, err := w.store.GetServer(ctx)
 	if err != nil {
-		logrus.Error("[Server] Cannot get server config: ")
+		return storeError(err, "server", "")
+	}
+	if err := expandAllowedIPs(server, peer, previous.AllowedIPs); err != nil {
 		return err
 	}
-	peers, err := w.store.GetPeers(false)
-	if err != nil {
-		logrus.Error("[Peers] Cannot get peers config")
+	if err := w.validatePeer(ctx, *peer); err != nil {
 		return err
 	}
-	settings, err := w.store.GetGlobalSettings()
+	peer.UpdatedAt = time.Now().UTC()
+
+	peer.Revision = previous.Revision
+	if err := w.store.SavePeer(ctx, *peer); err != nil {
+		return storeError(err, "peer", peer.ID)
+	}
+	peer.Revision++
+	logger.FromContext(ctx).WithField("peer_id", peer.ID).Info("Updated client information successfully")
+
+	if affectsServerConfig(previous, *peer) {
+		if err := w.applyConfig(ctx); err != nil {
+			return err
+		}
+	}
+	w.publishPeerChange(ctx, previous, *peer)
+	return nil
+}
+
+// publishPeerChange publishes the update of a stored peer and, when the
+// change toggled it, the enable or disable event
+func (w *WireguardService) publishPeerChange(ctx context.Context, previous model.Peer, peer model.Peer) {
+	w.bus.Publish(ctx, event.PeerUpdated, peerEventData(peer))
+	if peer.Enabled != previous.Enabled {
+		if peer.Enabled {
+			w.bus.Publish(ctx, event.PeerEnabled, peerEventData(peer))
+		} else {
+			w.bus.Publish(ctx, event.PeerDisabled, peerEventData(peer))
+		}
+	}
+}
+
+// affectsServerConfig reports whether the rendered server config or the
+// firewall table differs between two versions of a peer, ignoring the
+// informational comments. The labels and the group decide which ACL rules
+// match the peer.
+func affectsServerConfig(previous model.Peer, peer model.Peer) bool {
+	return previous.Enabled != peer.Enabled ||
+		previous.GroupID != peer.GroupID ||
+		!sameLabels(previous.Labels, peer.Labels) ||
+		previous.Deleted() != peer.Deleted() ||
+		previous.PublicKey != peer.PublicKey ||
+		previous.PresharedKey != peer.PresharedKey ||
+		strings.Join(previous.AllocatedIPs, ",") != strings.Join(peer.AllocatedIPs, ",") ||
+		strings.Join(previous.ExtraAllowedIPs, ",") != strings.Join(peer.ExtraAllowedIPs, ",") ||
+		strings.Join(previous.LANSubnets, ",") != strings.Join(peer.LANSubnets, ",")
+}
+
+func sameLabels(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// DeletePeer moves a peer to the trash. It leaves the rendered config at
+// once but keeps its record, and its addresses stay reserved for the
+// configured quarantine. Its port forwards are removed.
+func (w *WireguardService) DeletePeer(ctx context.Context, id string, revision int64) error {
+	ctx, span := tracer.Start(ctx, "WireguardService.DeletePeer")
+	defer span.End()
+
+	peerData, err := w.store.GetPeerByID(ctx, id)
 	if err != nil {
-		logrus.Error("[Peers] Cannot get peers config")
+		return storeError(err, "peer", id)
+	}
+	if err := checkRevision("peer", id, peerData.Peer.Revision, revision); err != nil {
 		return err
 	}
-	err = writeWireGuardServerConfig(server, peers, settings)
+	if peerData.Peer.Deleted() {
+		return Conflict("peer %s is already deleted", id)
+	}
+
+	peer := *peerData.Peer
+	now := time.Now().UTC()
+	peer.DeletedAt = &now
+	peer.UpdatedAt = now
+	if err := w.store.SavePeer(ctx, peer); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("Cannot delete wireguard client")
+		return storeError(err, "peer", id)
+	}
+	peer.Revision++
+	if err := deletePeerForwards(ctx, w.store, id); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Firewall] Cannot remove port forwards of deleted peer")
+		return storeError(err, "port forwards", "")
+	}
+	if err := w.applyConfig(ctx); err != nil {
+		return err
+	}
+	w.bus.Publish(ctx, event.PeerDeleted, peerEventData(peer))
+	return nil
+}
+
+// RestorePeer takes a peer out of the trash. It fails when another peer was
+// given its addresses after the quarantine ran out.
+func (w *WireguardService) RestorePeer(ctx context.Context, id string, revision int64) (model.PeerData, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.RestorePeer")
+	defer span.End()
+
+	peerData, err := w.store.GetPeerByID(ctx, id)
 	if err != nil {
+		return peerData, storeError(err, "peer", id)
+	}
+	if err := checkRevision("peer", id, peerData.Peer.Revision, revision); err != nil {
+		return peerData, err
+	}
+	if !peerData.Peer.Deleted() {
+		return peerData, Conflict("peer %s is not deleted", id)
+	}
+
+	peer := *peerData.Peer
+	peer.DeletedAt = nil
+	if err := w.validatePeer(ctx, peer); err != nil {
+		return peerData, err
+	}
+	peer.UpdatedAt = time.Now().UTC()
+	if err := w.store.SavePeer(ctx, peer); err != nil {
+		return peerData, storeError(err, "peer", id)
+	}
+	peer.Revision++
+	logger.FromContext(ctx).WithField("peer_id", peer.ID).Info("Restored client successfully")
+
+	if err := w.applyConfig(ctx); err != nil {
+		return peerData, err
+	}
+	w.bus.Publish(ctx, event.PeerRestored, peerEventData(peer))
+	peerData.Peer = &peer
+	w.describePeers(ctx, &peerData)
+
+	return peerData, nil
+}
+
+// Run purges peers that stayed in the trash past the retention period
+// until ctx is cancelled
+func (w *WireguardService) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.trash.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		w.purgeDeleted(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *WireguardService) purgeDeleted(ctx context.Context) {
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get peers to purge")
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, peerData := range peers {
+		peer := *peerData.Peer
+		if !peer.Deleted() || peer.DeletedAt.Add(w.trash.Retention).After(now) {
+			continue
+		}
+		if err := w.store.DeletePeer(ctx, peer.ID); err != nil {
+			logger.FromContext(ctx).WithError(err).WithField("peer_id", peer.ID).Error("[Peers] Cannot purge deleted peer")
+			continue
+		}
+		logger.FromContext(ctx).WithField("peer_id", peer.ID).Info("[Peers] Purged deleted peer")
+		w.bus.Publish(ctx, event.PeerPurged, peerEventData(peer))
+	}
+}
+
+func (w *WireguardService) GetSettings(ctx context.Context) (model.GlobalSetting, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.GetSettings")
+	defer span.End()
+
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		return settings, storeError(err, "settings", "")
+	}
+	return settings, nil
+}
+
+// UpdateSettings replaces the global settings and re-applies the server
+// config. revision works as in EditPeer.
+func (w *WireguardService) UpdateSettings(ctx context.Context, revision int64, value model.GlobalSetting) (model.GlobalSetting, error) {
+	ctx, span := tracer.Start(ctx, "WireguardService.UpdateSettings")
+	defer span.End()
+
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		return settings, storeError(err, "settings", "")
+	}
+	if err := checkRevision("settings", "", settings.Revision, revision); err != nil {
+		return settings, err
+	}
+	if err := validateSettings(&value); err != nil {
+		return settings, err
+	}
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		return settings, storeError(err, "peers", "")
+	}
+	for _, peerData := range peers {
+		peer := *peerData.Peer
+		if _, ok := peer.SelectedEndpoint(value); peer.Endpoint != "" && !peer.Deleted() && !ok {
+			return settings, Conflict("endpoint %s is used by peer %s", peer.Endpoint, peer.ID)
+		}
+	}
+
+	// the path is set from WG_CONFIG_FILE_PATH when the store is created, the
+	// API must not choose which file the daemon writes
+	value.ConfigFilePath = settings.ConfigFilePath
+	value.EndpointSource = settings.EndpointSource
+	if value.EndpointAddress != settings.EndpointAddress {
+		value.EndpointSource = model.EndpointSourceManual
+	}
+	value.Revision = settings.Revision
+	value.UpdatedAt = time.Now().UTC()
+	if err := w.store.SaveGlobalSettings(ctx, value); err != nil {
+		return settings, storeError(err, "settings", "")
+	}
+	value.Revision++
+	logger.FromContext(ctx).WithField("revision", value.Revision).Info("Updated global settings successfully")
+
+	if err := w.applyConfig(ctx); err != nil {
+		return value, err
+	}
+	return value, nil
+}
+
+// validateSettings checks the settings and fills in the endpoint families
+func validateSettings(settings *model.GlobalSetting) error {
+	fields := validateDNS(settings.DNSServers, settings.SearchDomains, settings.DNSRoutes)
+	if _, err := util.ParseEndpoint(settings.EndpointAddress); err != nil {
+		fields = append(fields, FieldError{Field: "endpoint_address", Message: err.Error()})
+	}
+	names := make(map[string]bool)
+	for i, endpoint := range settings.Endpoints {
+		field := fmt.Sprintf("endpoints[%d]", i)
+		if endpoint.Name == "" || strings.ContainsAny(endpoint.Name, " \t\r\n") {
+			fields = append(fields, FieldError{Field: field + ".name", Message: "must be a name without spaces"})
+		} else if endpoint.Name == "default" {
+			fields = append(fields, FieldError{Field: field + ".name", Message: "\"default\" is reserved for the endpoint address"})
+		} else if names[endpoint.Name] {
+			fields = append(fields, FieldError{Field: field + ".name", Message: fmt.Sprintf("%q is used twice", endpoint.Name)})
+		}
+		names[endpoint.Name] = true
+		normalized, err := util.NewEndpoint(endpoint.Name, endpoint.Host, endpoint.Port)
+		if err != nil {
+			fields = append(fields, FieldError{Field: field, Message: err.Error()})
+			continue
+		}
+		settings.Endpoints[i] = normalized
+	}
+	if settings.MTU < 0 || settings.MTU > 65535 {
+		fields = append(fields, FieldError{Field: "mtu", Message: "must be between 0 and 65535"})
+	}
+	if settings.PersistentKeepalive < 0 || settings.PersistentKeepalive > 65535 {
+		fields = append(fields, FieldError{Field: "persistent_keepalive", Message: "must be between 0 and 65535"})
+	}
+	if len(fields) > 0 {
+		return Validation(fields...)
+	}
+	return nil
+}
+
+// validateDNS checks DNS servers, search domains and split DNS routes
+func validateDNS(servers []string, searchDomains []string, routes []model.DNSRoute) []FieldError {
+	fields := make([]FieldError, 0)
+	for _, dns := range servers {
+		if net.ParseIP(dns) == nil {
+			fields = append(fields, FieldError{Field: "dns_servers", Message: fmt.Sprintf("%q is not an ip address", dns)})
+		}
+	}
+	for _, domain := range searchDomains {
+		if !util.ValidateDomain(domain) {
+			fields = append(fields, FieldError{Field: "search_domains", Message: fmt.Sprintf("%q is not a domain name", domain)})
+		}
+	}
+	for i, route := range routes {
+		if !util.ValidateDomain(route.Domain) {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("dns_routes[%d].domain", i), Message: fmt.Sprintf("%q is not a domain name", route.Domain)})
+		}
+		if len(route.Servers) == 0 {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("dns_routes[%d].servers", i), Message: "must not be empty"})
+		}
+		for _, dns := range route.Servers {
+			if net.ParseIP(dns) == nil {
+				fields = append(fields, FieldError{Field: fmt.Sprintf("dns_routes[%d].servers", i), Message: fmt.Sprintf("%q is not an ip address", dns)})
+			}
+		}
+	}
+	return fields
+}
+
+func (w *WireguardService) applyConfig(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "WireguardService.applyConfig")
+	defer span.End()
+
+	start := time.Now()
+	peers, settings, err := w.writeConfig(ctx)
+	if err == nil {
+		err = w.applyFirewall(ctx, peers)
+	}
+	metrics.ObserveApplyConfig(time.Since(start), err)
+	if err != nil {
+		return Internal(err, "cannot apply wireguard config")
+	}
+	w.bus.Publish(ctx, event.ConfigApplied, map[string]interface{}{
+		"config_file_path": settings.ConfigFilePath,
+		"peers":            len(peers),
+	})
+	return nil
+}
+
+func (w *WireguardService) writeConfig(ctx context.Context) ([]model.PeerData, model.GlobalSetting, error) {
+	server, err := w.store.GetServer(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Server] Cannot get server config")
+		return nil, model.GlobalSetting{}, err
+	}
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get peers config")
+		return nil, model.GlobalSetting{}, err
+	}
+	settings, err := w.store.GetGlobalSettings(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Peers] Cannot get peers config")
+		return nil, settings, err
+	}
+	active := make([]model.PeerData, 0, len(peers))
+	for _, peerData := range peers {
+		if !peerData.Peer.Deleted() {
+			active = append(active, peerData)
+		}
+	}
+	peers = active
+	err = writeWireGuardServerConfig(ctx, server, peers, settings)
+	if err != nil {
+		return nil, settings, err
+	}
+	return peers, settings, nil
+}
+
+// ApplyFirewall loads the nftables table at startup, afterwards it is only
+// replaced when a change is applied
+func (w *WireguardService) ApplyFirewall(ctx context.Context) error {
+	peers, err := w.store.GetPeers(ctx)
+	if err != nil {
+		return storeError(err, "peers", "")
+	}
+	active := make([]model.PeerData, 0, len(peers))
+	for _, peerData := range peers {
+		if !peerData.Peer.Deleted() {
+			active = append(active, peerData)
+		}
+	}
+	if err := w.applyFirewall(ctx, active); err != nil {
+		return Internal(err, "cannot apply firewall ruleset")
+	}
+	return nil
+}
+
+// applyFirewall replaces the nftables table with the current ACL rules
+func (w *WireguardService) applyFirewall(ctx context.Context, peers []model.PeerData) error {
+	if !w.firewall.Enabled {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "firewall.Apply")
+	defer span.End()
+
+	ruleset, err := renderFirewall(ctx, w.store, w.firewall, peers)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Firewall] Cannot render ruleset")
+		return err
+	}
+	if err := w.executor.Apply(ctx, ruleset); err != nil {
+		logger.FromContext(ctx).WithError(err).Error("[Firewall] Cannot apply ruleset")
 		return err
 	}
 	return nil
 }
 
-func writeWireGuardServerConfig(serverConfig model.Server, peersData []model.PeerData, globalSettings model.GlobalSetting) error {
+// peerEventData strips key material before a peer leaves the process in an event
+func peerEventData(peer model.Peer) model.Peer {
+	peer.PrivateKey = ""
+	peer.PresharedKey = ""
+	return peer
+}
+
+func writeWireGuardServerConfig(ctx context.Context, serverConfig model.Server, peersData []model.PeerData, globalSettings model.GlobalSetting) error {
+	_, span := tracer.Start(ctx, "wireguard.WriteConfig")
+	defer span.End()
+
 	var tmplWireguardConf string
 	fileContentBytes, err := os.ReadFile("./template/wg.conf")
 	if err != nil {
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"vpn-wg/internal/store"
+)
+
+type ErrorCode string
+
+const (
+	CodeNotFound   ErrorCode = "not_found"
+	CodeConflict   ErrorCode = "conflict"
+	CodeValidation ErrorCode = "validation_failed"
+	CodeInternal   ErrorCode = "internal_error"
+
+	CodePreconditionFailed   ErrorCode = "precondition_failed"
+	CodePreconditionRequired ErrorCode = "precondition_required"
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+)
+
+// FieldError describes why a single input field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is the error type returned by services. Handlers map Code to an HTTP
+// status, so services never need to know about the transport.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NotFound(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func Conflict(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func PreconditionFailed(format string, args ...interface{}) *Error {
+	return &Error{Code: CodePreconditionFailed, Message: fmt.Sprintf(format, args...)}
+}
+
+func PreconditionRequired(format string, args ...interface{}) *Error {
+	return &Error{Code: CodePreconditionRequired, Message: fmt.Sprintf(format, args...)}
+}
+
+func UnsupportedMediaType(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeUnsupportedMediaType, Message: fmt.Sprintf(format, args...)}
+}
+
+func Validation(fields ...FieldError) *Error {
+	return &Error{Code: CodeValidation, Message: "validation failed", Fields: fields}
+}
+
+func FieldInvalid(field string, format string, args ...interface{}) *Error {
+	return Validation(FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Internal wraps an unexpected failure; the cause is logged but not shown to clients
+func Internal(err error, message string) *Error {
+	return &Error{Code: CodeInternal, Message: message, Err: err}
+}
+
+// storeError turns a store failure into NotFound for missing records,
+// PreconditionFailed for lost compare-and-swap races and Internal for
+// everything else. Domain errors pass through untouched.
+func storeError(err error, resource string, id string) error {
+	var domainErr *Error
+	if errors.As(err, &domainErr) {
+		return err
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return NotFound("%s %s not found", resource, id)
+	}
+	if errors.Is(err, store.ErrRevisionMismatch) {
+		return PreconditionFailed("%s %s was modified by another request", resource, id)
+	}
+	return Internal(err, fmt.Sprintf("cannot access %s", resource))
+}
+
+// AnyRevision matches every revision, it is what "If-Match: *" asks for
+const AnyRevision int64 = -1
+
+// checkRevision fails unless the caller saw the current revision of a record
+func checkRevision(resource string, id string, current int64, expected int64) error {
+	if expected != AnyRevision && current != expected {
+		return PreconditionFailed("%s %s is at revision %d, not %d", resource, id, current, expected)
+	}
+	return nil
+}
+
+// AsError returns err as a domain error, treating unknown errors as internal
+func AsError(err error) *Error {
+	var domainErr *Error
+	if errors.As(err, &domainErr) {
+		return domainErr
+	}
+	return Internal(err, "internal server error")
+}
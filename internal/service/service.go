@@ -1,15 +1,63 @@
 package service
 
-import "vpn-wg/internal/store"
+import (
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/firewall"
+	"vpn-wg/internal/netsetup"
+	"vpn-wg/internal/store"
+	"vpn-wg/internal/wgdevice"
+)
 
 type Services struct {
-	WireguardService WireguardServiceInterface
+	WireguardService   WireguardServiceInterface
+	WebhookService     WebhookServiceInterface
+	StreamService      StreamServiceInterface
+	IdempotencyService IdempotencyServiceInterface
+	ImportService      ImportServiceInterface
+	GroupService       GroupServiceInterface
+	ACLService         ACLServiceInterface
+	NetworkService     NetworkServiceInterface
+	PortForwardService PortForwardServiceInterface
+	DNSService         DNSServiceInterface
 }
 
-func NewServices(store store.IStore) *Services {
-	wireguardService := NewWireguardService(store)
+type Deps struct {
+	Store       store.IStore
+	Bus         *event.Bus
+	Device      wgdevice.Reader
+	Webhook     config.WebhookConfig
+	Stream      config.StreamConfig
+	Idempotency config.IdempotencyConfig
+	Trash       config.TrashConfig
+	Firewall    config.FirewallConfig
+	Executor    firewall.Executor
+	Network     config.NetworkConfig
+	NetSetup    *netsetup.Manager
+	DNS         config.DNSConfig
+}
+
+func NewServices(deps Deps) *Services {
+	wireguardService := NewWireguardService(deps.Store, deps.Bus, deps.Trash, deps.Firewall, deps.Executor)
+	webhookService := NewWebhookService(deps.Store, deps.Webhook)
+	streamService := NewStreamService(deps.Store, deps.Device, deps.Stream)
+	idempotencyService := NewIdempotencyService(deps.Store, deps.Idempotency)
+	dnsService := NewDNSService(deps.Store, deps.DNS)
+
+	deps.Bus.Subscribe(webhookService.Dispatch)
+	deps.Bus.Subscribe(streamService.Publish)
+	deps.Bus.Subscribe(dnsService.Refresh)
 
 	return &Services{
-		WireguardService: wireguardService,
+		WireguardService:   wireguardService,
+		WebhookService:     webhookService,
+		StreamService:      streamService,
+		IdempotencyService: idempotencyService,
+		ImportService:      NewImportService(wireguardService),
+		GroupService:       NewGroupService(deps.Store, deps.Bus, deps.Firewall, wireguardService),
+		ACLService:         NewACLService(deps.Store, deps.Firewall, wireguardService),
+		NetworkService:     NewNetworkService(deps.Store, deps.Network, deps.NetSetup),
+		PortForwardService: NewPortForwardService(deps.Store, deps.Firewall, wireguardService),
+		DNSService:         dnsService,
 	}
 }
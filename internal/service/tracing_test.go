@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"vpn-wg/internal/config"
+	"vpn-wg/internal/event"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+	"vpn-wg/internal/store/traced"
+	"vpn-wg/internal/tracing"
+)
+
+// peerStore serves a single peer, the calls GetPeer does not make panic
+type peerStore struct {
+	store.IStore
+	peer model.Peer
+}
+
+func (s *peerStore) GetPeerByID(ctx context.Context, peerID string) (model.PeerData, error) {
+	if peerID != s.peer.ID {
+		return model.PeerData{}, store.ErrNotFound
+	}
+	peer := s.peer
+	return model.PeerData{Peer: &peer}, nil
+}
+
+func (s *peerStore) GetServer(ctx context.Context) (model.Server, error) {
+	return model.Server{}, nil
+}
+
+func (s *peerStore) GetGlobalSettings(ctx context.Context) (model.GlobalSetting, error) {
+	return model.GlobalSetting{}, nil
+}
+
+func (s *peerStore) GetGroups(ctx context.Context) ([]model.Group, error) {
+	return nil, nil
+}
+
+func TestGetPeerSpans(t *testing.T) {
+	provider, exporter := tracing.NewTestProvider()
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	w := NewWireguardService(traced.New(&peerStore{peer: model.Peer{ID: "alice"}}), event.NewBus(), config.TrashConfig{}, config.FirewallConfig{}, nil)
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{name: "found", id: "alice"},
+		{name: "not found", id: "bob", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter.Reset()
+			_, err := w.GetPeer(context.Background(), test.id, model.QRCodeSettings{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("GetPeer() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil && AsError(err).Code != CodeNotFound {
+				t.Fatalf("GetPeer() error = %v, want not found", err)
+			}
+
+			spans := exporter.GetSpans()
+			service := findSpan(t, spans, "WireguardService.GetPeer")
+			lookup := findSpan(t, spans, "store.GetPeerByID")
+			if lookup.Parent.SpanID() != service.SpanContext.SpanID() {
+				t.Errorf("store.GetPeerByID is not a child of WireguardService.GetPeer")
+			}
+			if got := attributeValue(lookup.Attributes, "peer.id"); got != test.id {
+				t.Errorf("store.GetPeerByID peer.id = %q, want %q", got, test.id)
+			}
+			wantStatus := codes.Unset
+			if test.wantErr {
+				wantStatus = codes.Error
+			}
+			if lookup.Status.Code != wantStatus {
+				t.Errorf("store.GetPeerByID status = %v, want %v", lookup.Status.Code, wantStatus)
+			}
+		})
+	}
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	t.Fatalf("no span %q in %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+func attributeValue(attributes []attribute.KeyValue, key string) string {
+	for _, kv := range attributes {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
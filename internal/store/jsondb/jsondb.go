@@ -1,29 +1,41 @@
 package jsondb
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sdomino/scribble"
-	"github.com/sirupsen/logrus"
-	"github.com/skip2/go-qrcode"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 	"vpn-wg/internal/config"
+	"vpn-wg/internal/logger"
 	"vpn-wg/internal/model"
-	"vpn-wg/internal/util"
+	"vpn-wg/internal/publicip"
+	"vpn-wg/internal/store"
 )
 
 type JsonDB struct {
+	mu           sync.Mutex // serializes compare-and-swap writes
 	conn         *scribble.Driver
 	dbPath       string
 	configServer config.ServerConfig
 	configGlobal config.GlobalConfig
+	configDNS    config.DNSConfig
+	detector     *publicip.Chain
+	lock         *os.File
 }
 
-func New(dbPath string, cfgServer config.ServerConfig, cfgGlobal config.GlobalConfig) (*JsonDB, error) {
+// ErrLocked is returned by Lock when another process holds the database
+var ErrLocked = errors.New("the database is used by another process")
+
+func New(dbPath string, cfgServer config.ServerConfig, cfgGlobal config.GlobalConfig, cfgDNS config.DNSConfig, detector *publicip.Chain) (*JsonDB, error) {
 	conn, err := scribble.New(dbPath, nil)
 	if err != nil {
 		return nil, err
@@ -33,13 +45,41 @@ func New(dbPath string, cfgServer config.ServerConfig, cfgGlobal config.GlobalCo
 		dbPath:       dbPath,
 		configServer: cfgServer,
 		configGlobal: cfgGlobal,
+		configDNS:    cfgDNS,
+		detector:     detector,
 	}
 	return &ans, nil
 }
 
-func (o *JsonDB) Init() error {
+// Lock takes an exclusive lock on the database directory for the life of
+// the process. Writes are only serialized within a process, a second one
+// writing the same files would hand out the same addresses.
+func (o *JsonDB) Lock() error {
+	file, err := os.OpenFile(path.Join(o.dbPath, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrLocked
+		}
+		return err
+	}
+	o.lock = file
+	return nil
+}
+
+func (o *JsonDB) Init(ctx context.Context) error {
 	var clientPath string = path.Join(o.dbPath, "clients")
 	var serverPath string = path.Join(o.dbPath, "server")
+	var webhookPath string = path.Join(o.dbPath, "webhooks")
+	var webhookDeliveryPath string = path.Join(o.dbPath, "webhook_deliveries")
+	var idempotencyPath string = path.Join(o.dbPath, "idempotency_keys")
+	var peerRevisionPath string = path.Join(o.dbPath, "peer_revisions")
+	var groupPath string = path.Join(o.dbPath, "groups")
+	var aclRulePath string = path.Join(o.dbPath, "acl_rules")
+	var portForwardPath string = path.Join(o.dbPath, "port_forwards")
 
 	var serverInterfacePath string = path.Join(serverPath, "interfaces.json")
 	var serverKeyPairPath string = path.Join(serverPath, "keypair.json")
@@ -52,6 +92,34 @@ func (o *JsonDB) Init() error {
 	if _, err := os.Stat(serverPath); os.IsNotExist(err) {
 		os.MkdirAll(serverPath, os.ModePerm)
 	}
+
+	if _, err := os.Stat(webhookPath); os.IsNotExist(err) {
+		os.MkdirAll(webhookPath, os.ModePerm)
+	}
+
+	if _, err := os.Stat(webhookDeliveryPath); os.IsNotExist(err) {
+		os.MkdirAll(webhookDeliveryPath, os.ModePerm)
+	}
+
+	if _, err := os.Stat(idempotencyPath); os.IsNotExist(err) {
+		os.MkdirAll(idempotencyPath, os.ModePerm)
+	}
+
+	if _, err := os.Stat(peerRevisionPath); os.IsNotExist(err) {
+		os.MkdirAll(peerRevisionPath, os.ModePerm)
+	}
+
+	if _, err := os.Stat(groupPath); os.IsNotExist(err) {
+		os.MkdirAll(groupPath, os.ModePerm)
+	}
+
+	if _, err := os.Stat(aclRulePath); os.IsNotExist(err) {
+		os.MkdirAll(aclRulePath, os.ModePerm)
+	}
+
+	if _, err := os.Stat(portForwardPath); os.IsNotExist(err) {
+		os.MkdirAll(portForwardPath, os.ModePerm)
+	}
 	// server's interface
 	if _, err := os.Stat(serverInterfacePath); os.IsNotExist(err) {
 		serverInterface := new(model.ServerInterface)
@@ -77,18 +145,8 @@ func (o *JsonDB) Init() error {
 	}
 
 	if _, err := os.Stat(globalSettingPath); os.IsNotExist(err) {
-		endpointAddress := o.configGlobal.Addresses
-
-		if endpointAddress == "" {
-			publicInterface, err := util.GetPublicIP()
-			if err != nil {
-				return err
-			}
-			endpointAddress = publicInterface.IPAddress
-		}
-
 		globalSetting := new(model.GlobalSetting)
-		globalSetting.EndpointAddress = endpointAddress
+		globalSetting.EndpointAddress, globalSetting.EndpointSource = o.detectEndpoint(ctx)
 		globalSetting.DNSServers = []string{o.configGlobal.DNS}
 		globalSetting.MTU = o.configGlobal.MTU
 		globalSetting.PersistentKeepalive = o.configGlobal.PersistentKeepalive
@@ -101,7 +159,23 @@ func (o *JsonDB) Init() error {
 	return nil
 }
 
-func (o *JsonDB) GetServer() (model.Server, error) {
+// detectEndpoint finds the endpoint address on first boot. Without one the
+// settings start with an empty address, so hosts without network access
+// still come up and the address can be set later.
+func (o *JsonDB) detectEndpoint(ctx context.Context) (string, string) {
+	result, err := o.detector.Detect(ctx)
+	if err != nil {
+		logger.FromContext(ctx).WithError(err).Warn("Cannot detect the endpoint address, set it in the global settings")
+		return "", ""
+	}
+	logger.FromContext(ctx).WithFields(map[string]interface{}{
+		"address": result.Address,
+		"source":  result.Source,
+	}).Info("Detected the endpoint address")
+	return result.Address, result.Source
+}
+
+func (o *JsonDB) GetServer(ctx context.Context) (model.Server, error) {
 	server := model.Server{}
 	serverInterface := model.ServerInterface{}
 
@@ -114,15 +188,33 @@ func (o *JsonDB) GetServer() (model.Server, error) {
 	}
 	server.Interface = &serverInterface
 	server.KeyPair = &serverKeyPair
+	if o.configDNS.Enabled {
+		server.Resolver = &model.Resolver{
+			Addresses: serverInterface.HostAddresses(),
+			Domain:    o.configDNS.Domain,
+		}
+	}
 	return server, nil
 }
 
-func (o *JsonDB) GetGlobalSettings() (model.GlobalSetting, error) {
+func (o *JsonDB) GetGlobalSettings(ctx context.Context) (model.GlobalSetting, error) {
 	settings := model.GlobalSetting{}
 	return settings, o.conn.Read("server", "global_settings", &settings)
 }
 
-func (o *JsonDB) GetPeers(hasQRCode bool) ([]model.PeerData, error) {
+func (o *JsonDB) SaveGlobalSettings(ctx context.Context, settings model.GlobalSetting) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	current := model.GlobalSetting{}
+	if err := o.checkRevision("server", "global_settings", &current, &current.Revision, settings.Revision); err != nil {
+		return err
+	}
+	settings.Revision++
+	return o.conn.Write("server", "global_settings", settings)
+}
+
+func (o *JsonDB) GetPeers(ctx context.Context) ([]model.PeerData, error) {
 	peers := []model.PeerData{}
 
 	records, err := o.conn.ReadAll("clients")
@@ -132,71 +224,310 @@ func (o *JsonDB) GetPeers(hasQRCode bool) ([]model.PeerData, error) {
 
 	for _, f := range records {
 		peer := model.Peer{}
-		peersData := model.PeerData{}
-
 		if err := json.Unmarshal([]byte(f), &peer); err != nil {
 			return peers, fmt.Errorf("cannot decode client json structure: %v", err)
 		}
-
-		// generate peer qrcode image in base64
-		if hasQRCode && peer.PrivateKey != "" {
-			server, _ := o.GetServer()
-			globalSettings, _ := o.GetGlobalSettings()
-
-			png, err := qrcode.Encode(util.BuildPeerConfig(peer, server, globalSettings), qrcode.Medium, 256)
-			if err == nil {
-				peersData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(png))
-			} else {
-				fmt.Print("Cannot generate QR code: ", err)
-			}
-		}
-
-		peersData.Peer = &peer
-		peers = append(peers, peersData)
+		peers = append(peers, model.PeerData{Peer: &peer})
 	}
 
 	return peers, nil
 }
 
-func (o *JsonDB) SavePeer(peer model.Peer) error {
-	return o.conn.Write("clients", peer.ID, peer)
+func (o *JsonDB) SavePeer(ctx context.Context, peer model.Peer) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	current := model.Peer{}
+	if err := o.checkRevision("clients", peer.ID, &current, &current.Revision, peer.Revision); err != nil {
+		return err
+	}
+	peer.Revision++
+	if err := o.conn.Write("clients", peer.ID, peer); err != nil {
+		return err
+	}
+	return o.conn.Write(path.Join("peer_revisions", peer.ID), strconv.FormatInt(peer.Revision, 10), model.PeerRevision{
+		PeerID:    peer.ID,
+		Revision:  peer.Revision,
+		Peer:      peer.HashSecrets(),
+		CreatedAt: peer.UpdatedAt,
+	})
 }
 
-func (o *JsonDB) GetPeerByID(peerID string, qrCodeSettings model.QRCodeSettings) (model.PeerData, error) {
+func (o *JsonDB) GetPeerByID(ctx context.Context, peerID string) (model.PeerData, error) {
 	peer := model.Peer{}
 	peerData := model.PeerData{}
 
 	if err := o.conn.Read("clients", peerID, &peer); err != nil {
-		logrus.Error("[Peer not found]")
-		return peerData, err
+		logger.FromContext(ctx).WithField("peer_id", peerID).Debug("[Peer not found]")
+		return peerData, notFound(err)
 	}
+	peerData.Peer = &peer
+
+	return peerData, nil
+}
+
+func (o *JsonDB) DeletePeer(ctx context.Context, peerID string) error {
+	if err := o.delete("clients", peerID); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(o.dbPath, "peer_revisions", peerID)); err == nil {
+		return o.conn.Delete("peer_revisions", peerID)
+	}
+	return nil
+}
+
+func (o *JsonDB) GetPeerRevisions(ctx context.Context, peerID string) ([]model.PeerRevision, error) {
+	revisions := []model.PeerRevision{}
 
-	if qrCodeSettings.Enabled && peer.PrivateKey != "" {
-		server, _ := o.GetServer()
-		globalSettings, _ := o.GetGlobalSettings()
+	records, err := o.conn.ReadAll(path.Join("peer_revisions", peerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return revisions, nil
+	}
+	if err != nil {
+		return revisions, err
+	}
 
-		if !qrCodeSettings.IncludeDNS {
-			globalSettings.DNSServers = []string{}
+	for _, f := range records {
+		revision := model.PeerRevision{}
+		if err := json.Unmarshal(f, &revision); err != nil {
+			return revisions, fmt.Errorf("cannot decode peer revision json structure: %v", err)
 		}
-		if !qrCodeSettings.IncludeMTU {
-			globalSettings.MTU = 0
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+
+	return revisions, nil
+}
+
+func (o *JsonDB) GetPeerRevision(ctx context.Context, peerID string, revision int64) (model.PeerRevision, error) {
+	peerRevision := model.PeerRevision{}
+	return peerRevision, notFound(o.conn.Read(path.Join("peer_revisions", peerID), strconv.FormatInt(revision, 10), &peerRevision))
+}
+
+func (o *JsonDB) GetGroups(ctx context.Context) ([]model.Group, error) {
+	groups := []model.Group{}
+
+	records, err := o.conn.ReadAll("groups")
+	if err != nil {
+		return groups, err
+	}
+
+	for _, f := range records {
+		group := model.Group{}
+		if err := json.Unmarshal(f, &group); err != nil {
+			return groups, fmt.Errorf("cannot decode group json structure: %v", err)
 		}
-		if !qrCodeSettings.IncludeFwMark {
-			globalSettings.ForwardMark = ""
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func (o *JsonDB) GetGroupByID(ctx context.Context, groupID string) (model.Group, error) {
+	group := model.Group{}
+	return group, notFound(o.conn.Read("groups", groupID, &group))
+}
+
+func (o *JsonDB) SaveGroup(ctx context.Context, group model.Group) error {
+	return o.conn.Write("groups", group.ID, group)
+}
+
+func (o *JsonDB) DeleteGroup(ctx context.Context, groupID string) error {
+	return o.delete("groups", groupID)
+}
+
+func (o *JsonDB) GetACLRules(ctx context.Context) ([]model.ACLRule, error) {
+	rules := []model.ACLRule{}
+
+	records, err := o.conn.ReadAll("acl_rules")
+	if err != nil {
+		return rules, err
+	}
+
+	for _, f := range records {
+		rule := model.ACLRule{}
+		if err := json.Unmarshal(f, &rule); err != nil {
+			return rules, fmt.Errorf("cannot decode acl rule json structure: %v", err)
 		}
-		png, err := qrcode.Encode(util.BuildPeerConfig(peer, server, globalSettings), qrcode.Medium, 256)
-		if err == nil {
-			peerData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(png))
-		} else {
-			fmt.Print("Cannot generate QR code: ", err)
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (o *JsonDB) GetACLRuleByID(ctx context.Context, ruleID string) (model.ACLRule, error) {
+	rule := model.ACLRule{}
+	return rule, notFound(o.conn.Read("acl_rules", ruleID, &rule))
+}
+
+func (o *JsonDB) SaveACLRule(ctx context.Context, rule model.ACLRule) error {
+	return o.conn.Write("acl_rules", rule.ID, rule)
+}
+
+func (o *JsonDB) DeleteACLRule(ctx context.Context, ruleID string) error {
+	return o.delete("acl_rules", ruleID)
+}
+
+func (o *JsonDB) GetPortForwards(ctx context.Context) ([]model.PortForward, error) {
+	forwards := []model.PortForward{}
+
+	records, err := o.conn.ReadAll("port_forwards")
+	if err != nil {
+		return forwards, err
+	}
+
+	for _, f := range records {
+		forward := model.PortForward{}
+		if err := json.Unmarshal(f, &forward); err != nil {
+			return forwards, fmt.Errorf("cannot decode port forward json structure: %v", err)
 		}
+		forwards = append(forwards, forward)
 	}
-	peerData.Peer = &peer
 
-	return peerData, nil
+	return forwards, nil
+}
+
+func (o *JsonDB) GetPortForwardByID(ctx context.Context, forwardID string) (model.PortForward, error) {
+	forward := model.PortForward{}
+	return forward, notFound(o.conn.Read("port_forwards", forwardID, &forward))
+}
+
+func (o *JsonDB) SavePortForward(ctx context.Context, forward model.PortForward) error {
+	return o.conn.Write("port_forwards", forward.ID, forward)
+}
+
+func (o *JsonDB) DeletePortForward(ctx context.Context, forwardID string) error {
+	return o.delete("port_forwards", forwardID)
+}
+
+func (o *JsonDB) GetWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+
+	records, err := o.conn.ReadAll("webhooks")
+	if err != nil {
+		return webhooks, err
+	}
+
+	for _, f := range records {
+		webhook := model.Webhook{}
+		if err := json.Unmarshal(f, &webhook); err != nil {
+			return webhooks, fmt.Errorf("cannot decode webhook json structure: %v", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, nil
+}
+
+func (o *JsonDB) GetWebhookByID(ctx context.Context, webhookID string) (model.Webhook, error) {
+	webhook := model.Webhook{}
+	return webhook, notFound(o.conn.Read("webhooks", webhookID, &webhook))
+}
+
+func (o *JsonDB) SaveWebhook(ctx context.Context, webhook model.Webhook) error {
+	return o.conn.Write("webhooks", webhook.ID, webhook)
+}
+
+func (o *JsonDB) DeleteWebhook(ctx context.Context, webhookID string) error {
+	return o.delete("webhooks", webhookID)
+}
+
+func (o *JsonDB) GetWebhookDeliveries(ctx context.Context) ([]model.WebhookDelivery, error) {
+	deliveries := []model.WebhookDelivery{}
+
+	records, err := o.conn.ReadAll("webhook_deliveries")
+	if err != nil {
+		return deliveries, err
+	}
+
+	for _, f := range records {
+		delivery := model.WebhookDelivery{}
+		if err := json.Unmarshal(f, &delivery); err != nil {
+			return deliveries, fmt.Errorf("cannot decode webhook delivery json structure: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+func (o *JsonDB) GetWebhookDeliveryByID(ctx context.Context, deliveryID string) (model.WebhookDelivery, error) {
+	delivery := model.WebhookDelivery{}
+	return delivery, notFound(o.conn.Read("webhook_deliveries", deliveryID, &delivery))
+}
+
+func (o *JsonDB) SaveWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	return o.conn.Write("webhook_deliveries", delivery.ID, delivery)
+}
+
+func (o *JsonDB) DeleteWebhookDelivery(ctx context.Context, deliveryID string) error {
+	return o.delete("webhook_deliveries", deliveryID)
+}
+
+func (o *JsonDB) GetIdempotencyRecords(ctx context.Context) ([]model.IdempotencyRecord, error) {
+	idempotencyRecords := []model.IdempotencyRecord{}
+
+	records, err := o.conn.ReadAll("idempotency_keys")
+	if err != nil {
+		return idempotencyRecords, err
+	}
+
+	for _, f := range records {
+		record := model.IdempotencyRecord{}
+		if err := json.Unmarshal(f, &record); err != nil {
+			return idempotencyRecords, fmt.Errorf("cannot decode idempotency record json structure: %v", err)
+		}
+		idempotencyRecords = append(idempotencyRecords, record)
+	}
+
+	return idempotencyRecords, nil
+}
+
+func (o *JsonDB) GetIdempotencyRecordByID(ctx context.Context, recordID string) (model.IdempotencyRecord, error) {
+	record := model.IdempotencyRecord{}
+	return record, notFound(o.conn.Read("idempotency_keys", recordID, &record))
+}
+
+func (o *JsonDB) SaveIdempotencyRecord(ctx context.Context, record model.IdempotencyRecord) error {
+	return o.conn.Write("idempotency_keys", record.ID, record)
+}
+
+func (o *JsonDB) DeleteIdempotencyRecord(ctx context.Context, recordID string) error {
+	return o.delete("idempotency_keys", recordID)
+}
+
+// checkRevision reads the stored record into current and fails unless its
+// revision, as pointed to by revision, equals expected. A missing record
+// matches revision 0 only.
+func (o *JsonDB) checkRevision(collection string, resource string, current interface{}, revision *int64, expected int64) error {
+	err := o.conn.Read(collection, resource, current)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if expected != 0 {
+			return store.ErrRevisionMismatch
+		}
+		return nil
+	case err != nil:
+		return err
+	case *revision != expected:
+		return store.ErrRevisionMismatch
+	}
+	return nil
 }
 
-func (o *JsonDB) DeletePeer(peerID string) error {
-	fmt.Println(peerID)
-	return o.conn.Delete("clients", peerID)
+// delete removes a record, reporting store.ErrNotFound when it does not exist
+func (o *JsonDB) delete(collection string, resource string) error {
+	if _, err := os.Stat(path.Join(o.dbPath, collection, resource+".json")); err != nil {
+		return notFound(err)
+	}
+	return o.conn.Delete(collection, resource)
+}
+
+func notFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return store.ErrNotFound
+	}
+	return err
 }
@@ -1,13 +1,55 @@
 package store
 
-import "vpn-wg/internal/model"
+import (
+	"context"
+	"errors"
+	"vpn-wg/internal/model"
+)
 
+var (
+	ErrNotFound         = errors.New("record not found")
+	ErrRevisionMismatch = errors.New("record was modified concurrently")
+)
+
+// IStore persists the server state. SavePeer and SaveGlobalSettings are
+// compare-and-swap operations: the record is only written when the stored
+// revision still equals the Revision of the given value, and it is written
+// with the revision incremented by one. A new peer must have Revision 0.
+// Every peer version SavePeer writes is also kept as a PeerRevision with
+// hashed secrets until the peer is deleted.
 type IStore interface {
-	Init() error
-	GetServer() (model.Server, error)
-	GetPeers(hasQRCode bool) ([]model.PeerData, error)
-	SavePeer(client model.Peer) error
-	GetPeerByID(peerID string, qrCode model.QRCodeSettings) (model.PeerData, error)
-	DeletePeer(peerID string) error
-	GetGlobalSettings() (model.GlobalSetting, error)
+	Init(ctx context.Context) error
+	GetServer(ctx context.Context) (model.Server, error)
+	GetPeers(ctx context.Context) ([]model.PeerData, error)
+	SavePeer(ctx context.Context, client model.Peer) error
+	GetPeerByID(ctx context.Context, peerID string) (model.PeerData, error)
+	DeletePeer(ctx context.Context, peerID string) error
+	GetPeerRevisions(ctx context.Context, peerID string) ([]model.PeerRevision, error)
+	GetPeerRevision(ctx context.Context, peerID string, revision int64) (model.PeerRevision, error)
+	GetGlobalSettings(ctx context.Context) (model.GlobalSetting, error)
+	SaveGlobalSettings(ctx context.Context, settings model.GlobalSetting) error
+	GetGroups(ctx context.Context) ([]model.Group, error)
+	GetGroupByID(ctx context.Context, groupID string) (model.Group, error)
+	SaveGroup(ctx context.Context, group model.Group) error
+	DeleteGroup(ctx context.Context, groupID string) error
+	GetACLRules(ctx context.Context) ([]model.ACLRule, error)
+	GetACLRuleByID(ctx context.Context, ruleID string) (model.ACLRule, error)
+	SaveACLRule(ctx context.Context, rule model.ACLRule) error
+	DeleteACLRule(ctx context.Context, ruleID string) error
+	GetPortForwards(ctx context.Context) ([]model.PortForward, error)
+	GetPortForwardByID(ctx context.Context, forwardID string) (model.PortForward, error)
+	SavePortForward(ctx context.Context, forward model.PortForward) error
+	DeletePortForward(ctx context.Context, forwardID string) error
+	GetWebhooks(ctx context.Context) ([]model.Webhook, error)
+	GetWebhookByID(ctx context.Context, webhookID string) (model.Webhook, error)
+	SaveWebhook(ctx context.Context, webhook model.Webhook) error
+	DeleteWebhook(ctx context.Context, webhookID string) error
+	GetWebhookDeliveries(ctx context.Context) ([]model.WebhookDelivery, error)
+	GetWebhookDeliveryByID(ctx context.Context, deliveryID string) (model.WebhookDelivery, error)
+	SaveWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error
+	DeleteWebhookDelivery(ctx context.Context, deliveryID string) error
+	GetIdempotencyRecords(ctx context.Context) ([]model.IdempotencyRecord, error)
+	GetIdempotencyRecordByID(ctx context.Context, recordID string) (model.IdempotencyRecord, error)
+	SaveIdempotencyRecord(ctx context.Context, record model.IdempotencyRecord) error
+	DeleteIdempotencyRecord(ctx context.Context, recordID string) error
 }
@@ -0,0 +1,244 @@
+package traced
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"vpn-wg/internal/model"
+	"vpn-wg/internal/store"
+)
+
+var tracer = otel.Tracer("vpn-wg/internal/store")
+
+// Store wraps an IStore and records a span for every call
+type Store struct {
+	next store.IStore
+}
+
+func New(next store.IStore) *Store {
+	return &Store{next: next}
+}
+
+func start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "store."+name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *Store) Init(ctx context.Context) (err error) {
+	ctx, span := start(ctx, "Init")
+	defer func() { end(span, err) }()
+	return s.next.Init(ctx)
+}
+
+func (s *Store) GetServer(ctx context.Context) (server model.Server, err error) {
+	ctx, span := start(ctx, "GetServer")
+	defer func() { end(span, err) }()
+	return s.next.GetServer(ctx)
+}
+
+func (s *Store) GetPeers(ctx context.Context) (peers []model.PeerData, err error) {
+	ctx, span := start(ctx, "GetPeers")
+	defer func() {
+		span.SetAttributes(attribute.Int("peers", len(peers)))
+		end(span, err)
+	}()
+	return s.next.GetPeers(ctx)
+}
+
+func (s *Store) SavePeer(ctx context.Context, client model.Peer) (err error) {
+	ctx, span := start(ctx, "SavePeer", attribute.String("peer.id", client.ID), attribute.Int64("revision", client.Revision))
+	defer func() { end(span, err) }()
+	return s.next.SavePeer(ctx, client)
+}
+
+func (s *Store) GetPeerByID(ctx context.Context, peerID string) (peerData model.PeerData, err error) {
+	ctx, span := start(ctx, "GetPeerByID", attribute.String("peer.id", peerID))
+	defer func() { end(span, err) }()
+	return s.next.GetPeerByID(ctx, peerID)
+}
+
+func (s *Store) DeletePeer(ctx context.Context, peerID string) (err error) {
+	ctx, span := start(ctx, "DeletePeer", attribute.String("peer.id", peerID))
+	defer func() { end(span, err) }()
+	return s.next.DeletePeer(ctx, peerID)
+}
+
+func (s *Store) GetPeerRevisions(ctx context.Context, peerID string) (revisions []model.PeerRevision, err error) {
+	ctx, span := start(ctx, "GetPeerRevisions", attribute.String("peer.id", peerID))
+	defer func() {
+		span.SetAttributes(attribute.Int("revisions", len(revisions)))
+		end(span, err)
+	}()
+	return s.next.GetPeerRevisions(ctx, peerID)
+}
+
+func (s *Store) GetPeerRevision(ctx context.Context, peerID string, revision int64) (peerRevision model.PeerRevision, err error) {
+	ctx, span := start(ctx, "GetPeerRevision", attribute.String("peer.id", peerID), attribute.Int64("revision", revision))
+	defer func() { end(span, err) }()
+	return s.next.GetPeerRevision(ctx, peerID, revision)
+}
+
+func (s *Store) GetGlobalSettings(ctx context.Context) (settings model.GlobalSetting, err error) {
+	ctx, span := start(ctx, "GetGlobalSettings")
+	defer func() { end(span, err) }()
+	return s.next.GetGlobalSettings(ctx)
+}
+
+func (s *Store) SaveGlobalSettings(ctx context.Context, settings model.GlobalSetting) (err error) {
+	ctx, span := start(ctx, "SaveGlobalSettings", attribute.Int64("revision", settings.Revision))
+	defer func() { end(span, err) }()
+	return s.next.SaveGlobalSettings(ctx, settings)
+}
+
+func (s *Store) GetGroups(ctx context.Context) (groups []model.Group, err error) {
+	ctx, span := start(ctx, "GetGroups")
+	defer func() { end(span, err) }()
+	return s.next.GetGroups(ctx)
+}
+
+func (s *Store) GetGroupByID(ctx context.Context, groupID string) (group model.Group, err error) {
+	ctx, span := start(ctx, "GetGroupByID", attribute.String("group.id", groupID))
+	defer func() { end(span, err) }()
+	return s.next.GetGroupByID(ctx, groupID)
+}
+
+func (s *Store) SaveGroup(ctx context.Context, group model.Group) (err error) {
+	ctx, span := start(ctx, "SaveGroup", attribute.String("group.id", group.ID))
+	defer func() { end(span, err) }()
+	return s.next.SaveGroup(ctx, group)
+}
+
+func (s *Store) DeleteGroup(ctx context.Context, groupID string) (err error) {
+	ctx, span := start(ctx, "DeleteGroup", attribute.String("group.id", groupID))
+	defer func() { end(span, err) }()
+	return s.next.DeleteGroup(ctx, groupID)
+}
+
+func (s *Store) GetACLRules(ctx context.Context) (rules []model.ACLRule, err error) {
+	ctx, span := start(ctx, "GetACLRules")
+	defer func() { end(span, err) }()
+	return s.next.GetACLRules(ctx)
+}
+
+func (s *Store) GetACLRuleByID(ctx context.Context, ruleID string) (rule model.ACLRule, err error) {
+	ctx, span := start(ctx, "GetACLRuleByID", attribute.String("acl_rule.id", ruleID))
+	defer func() { end(span, err) }()
+	return s.next.GetACLRuleByID(ctx, ruleID)
+}
+
+func (s *Store) SaveACLRule(ctx context.Context, rule model.ACLRule) (err error) {
+	ctx, span := start(ctx, "SaveACLRule", attribute.String("acl_rule.id", rule.ID))
+	defer func() { end(span, err) }()
+	return s.next.SaveACLRule(ctx, rule)
+}
+
+func (s *Store) DeleteACLRule(ctx context.Context, ruleID string) (err error) {
+	ctx, span := start(ctx, "DeleteACLRule", attribute.String("acl_rule.id", ruleID))
+	defer func() { end(span, err) }()
+	return s.next.DeleteACLRule(ctx, ruleID)
+}
+
+func (s *Store) GetPortForwards(ctx context.Context) (forwards []model.PortForward, err error) {
+	ctx, span := start(ctx, "GetPortForwards")
+	defer func() { end(span, err) }()
+	return s.next.GetPortForwards(ctx)
+}
+
+func (s *Store) GetPortForwardByID(ctx context.Context, forwardID string) (forward model.PortForward, err error) {
+	ctx, span := start(ctx, "GetPortForwardByID", attribute.String("port_forward.id", forwardID))
+	defer func() { end(span, err) }()
+	return s.next.GetPortForwardByID(ctx, forwardID)
+}
+
+func (s *Store) SavePortForward(ctx context.Context, forward model.PortForward) (err error) {
+	ctx, span := start(ctx, "SavePortForward", attribute.String("port_forward.id", forward.ID))
+	defer func() { end(span, err) }()
+	return s.next.SavePortForward(ctx, forward)
+}
+
+func (s *Store) DeletePortForward(ctx context.Context, forwardID string) (err error) {
+	ctx, span := start(ctx, "DeletePortForward", attribute.String("port_forward.id", forwardID))
+	defer func() { end(span, err) }()
+	return s.next.DeletePortForward(ctx, forwardID)
+}
+
+func (s *Store) GetWebhooks(ctx context.Context) (webhooks []model.Webhook, err error) {
+	ctx, span := start(ctx, "GetWebhooks")
+	defer func() { end(span, err) }()
+	return s.next.GetWebhooks(ctx)
+}
+
+func (s *Store) GetWebhookByID(ctx context.Context, webhookID string) (webhook model.Webhook, err error) {
+	ctx, span := start(ctx, "GetWebhookByID", attribute.String("webhook.id", webhookID))
+	defer func() { end(span, err) }()
+	return s.next.GetWebhookByID(ctx, webhookID)
+}
+
+func (s *Store) SaveWebhook(ctx context.Context, webhook model.Webhook) (err error) {
+	ctx, span := start(ctx, "SaveWebhook", attribute.String("webhook.id", webhook.ID))
+	defer func() { end(span, err) }()
+	return s.next.SaveWebhook(ctx, webhook)
+}
+
+func (s *Store) DeleteWebhook(ctx context.Context, webhookID string) (err error) {
+	ctx, span := start(ctx, "DeleteWebhook", attribute.String("webhook.id", webhookID))
+	defer func() { end(span, err) }()
+	return s.next.DeleteWebhook(ctx, webhookID)
+}
+
+func (s *Store) GetWebhookDeliveries(ctx context.Context) (deliveries []model.WebhookDelivery, err error) {
+	ctx, span := start(ctx, "GetWebhookDeliveries")
+	defer func() { end(span, err) }()
+	return s.next.GetWebhookDeliveries(ctx)
+}
+
+func (s *Store) GetWebhookDeliveryByID(ctx context.Context, deliveryID string) (delivery model.WebhookDelivery, err error) {
+	ctx, span := start(ctx, "GetWebhookDeliveryByID", attribute.String("delivery.id", deliveryID))
+	defer func() { end(span, err) }()
+	return s.next.GetWebhookDeliveryByID(ctx, deliveryID)
+}
+
+func (s *Store) SaveWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) (err error) {
+	ctx, span := start(ctx, "SaveWebhookDelivery", attribute.String("delivery.id", delivery.ID))
+	defer func() { end(span, err) }()
+	return s.next.SaveWebhookDelivery(ctx, delivery)
+}
+
+func (s *Store) DeleteWebhookDelivery(ctx context.Context, deliveryID string) (err error) {
+	ctx, span := start(ctx, "DeleteWebhookDelivery", attribute.String("delivery.id", deliveryID))
+	defer func() { end(span, err) }()
+	return s.next.DeleteWebhookDelivery(ctx, deliveryID)
+}
+
+func (s *Store) GetIdempotencyRecords(ctx context.Context) (records []model.IdempotencyRecord, err error) {
+	ctx, span := start(ctx, "GetIdempotencyRecords")
+	defer func() { end(span, err) }()
+	return s.next.GetIdempotencyRecords(ctx)
+}
+
+func (s *Store) GetIdempotencyRecordByID(ctx context.Context, recordID string) (record model.IdempotencyRecord, err error) {
+	ctx, span := start(ctx, "GetIdempotencyRecordByID", attribute.String("idempotency.id", recordID))
+	defer func() { end(span, err) }()
+	return s.next.GetIdempotencyRecordByID(ctx, recordID)
+}
+
+func (s *Store) SaveIdempotencyRecord(ctx context.Context, record model.IdempotencyRecord) (err error) {
+	ctx, span := start(ctx, "SaveIdempotencyRecord", attribute.String("idempotency.id", record.ID))
+	defer func() { end(span, err) }()
+	return s.next.SaveIdempotencyRecord(ctx, record)
+}
+
+func (s *Store) DeleteIdempotencyRecord(ctx context.Context, recordID string) (err error) {
+	ctx, span := start(ctx, "DeleteIdempotencyRecord", attribute.String("idempotency.id", recordID))
+	defer func() { end(span, err) }()
+	return s.next.DeleteIdempotencyRecord(ctx, recordID)
+}
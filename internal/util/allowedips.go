@@ -0,0 +1,52 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"vpn-wg/internal/cidrset"
+	"vpn-wg/internal/model"
+)
+
+var (
+	fullTunnel      = cidrset.MustParse("0.0.0.0/0", "::/0")
+	privateNetworks = cidrset.MustParse("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16")
+)
+
+// AllowedIPsPresets lists the presets BuildAllowedIPs knows
+var AllowedIPsPresets = []string{model.PresetFullTunnel, model.PresetVPNSubnet, model.PresetExcludePrivate}
+
+// BuildAllowedIPs returns the minimized client AllowedIPs of a spec, IPv4
+// networks first. serverAddresses are the server networks the presets
+// refer to.
+func BuildAllowedIPs(spec model.AllowedIPsSpec, serverAddresses []string) ([]string, error) {
+	include, err := cidrset.Parse(spec.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %v", err)
+	}
+	exclude, err := cidrset.Parse(spec.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %v", err)
+	}
+	server, err := cidrset.Parse(serverAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("server addresses: %v", err)
+	}
+
+	switch spec.Preset {
+	case "":
+	case model.PresetFullTunnel:
+		include = include.Union(fullTunnel)
+	case model.PresetVPNSubnet:
+		include = include.Union(server)
+	case model.PresetExcludePrivate:
+		include = include.Union(fullTunnel.Subtract(privateNetworks).Union(server))
+	default:
+		return nil, fmt.Errorf("unknown preset %q", spec.Preset)
+	}
+
+	result := include.Subtract(exclude)
+	if result.Empty() {
+		return nil, errors.New("no network is left after the exclusions")
+	}
+	return result.Strings(), nil
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+	"vpn-wg/internal/model"
+)
+
+var serverAddresses = []string{"10.252.1.0/24", "fd42:42:42::/64"}
+
+func TestBuildAllowedIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		spec model.AllowedIPsSpec
+		want []string
+	}{
+		{
+			name: "full tunnel",
+			spec: model.AllowedIPsSpec{Preset: model.PresetFullTunnel},
+			want: []string{"0.0.0.0/0", "::/0"},
+		},
+		{
+			name: "vpn subnet",
+			spec: model.AllowedIPsSpec{Preset: model.PresetVPNSubnet},
+			want: []string{"10.252.1.0/24", "fd42:42:42::/64"},
+		},
+		{
+			name: "exclude private keeps the server networks",
+			spec: model.AllowedIPsSpec{Preset: model.PresetExcludePrivate},
+			want: []string{
+				"0.0.0.0/5", "8.0.0.0/7", "10.252.1.0/24", "11.0.0.0/8", "12.0.0.0/6", "16.0.0.0/4", "32.0.0.0/3", "64.0.0.0/2",
+				"128.0.0.0/3", "160.0.0.0/5", "168.0.0.0/6", "172.0.0.0/12", "172.32.0.0/11", "172.64.0.0/10", "172.128.0.0/9",
+				"173.0.0.0/8", "174.0.0.0/7", "176.0.0.0/4", "192.0.0.0/9", "192.128.0.0/11", "192.160.0.0/13", "192.169.0.0/16",
+				"192.170.0.0/15", "192.172.0.0/14", "192.176.0.0/12", "192.192.0.0/10", "193.0.0.0/8", "194.0.0.0/7", "196.0.0.0/6",
+				"200.0.0.0/5", "208.0.0.0/4", "224.0.0.0/3", "::/0",
+			},
+		},
+		{
+			name: "full tunnel without ipv6",
+			spec: model.AllowedIPsSpec{Preset: model.PresetFullTunnel, Exclude: []string{"::/0"}},
+			want: []string{"0.0.0.0/0"},
+		},
+		{
+			name: "exclusions at the ends of the address space",
+			spec: model.AllowedIPsSpec{Preset: model.PresetFullTunnel, Exclude: []string{"0.0.0.0/1", "255.0.0.0/8", "::/1"}},
+			want: []string{"128.0.0.0/2", "192.0.0.0/3", "224.0.0.0/4", "240.0.0.0/5", "248.0.0.0/6", "252.0.0.0/7", "254.0.0.0/8", "8000::/1"},
+		},
+		{
+			name: "include only",
+			spec: model.AllowedIPsSpec{Include: []string{"192.168.1.0/24", "192.168.0.0/24"}},
+			want: []string{"192.168.0.0/23"},
+		},
+		{
+			name: "include on top of a preset",
+			spec: model.AllowedIPsSpec{Preset: model.PresetVPNSubnet, Include: []string{"192.168.10.0/24"}},
+			want: []string{"10.252.1.0/24", "192.168.10.0/24", "fd42:42:42::/64"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := BuildAllowedIPs(test.spec, serverAddresses)
+			if err != nil {
+				t.Fatalf("BuildAllowedIPs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("BuildAllowedIPs() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildAllowedIPsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec model.AllowedIPsSpec
+	}{
+		{
+			name: "unknown preset",
+			spec: model.AllowedIPsSpec{Preset: "split"},
+		},
+		{
+			name: "bad include",
+			spec: model.AllowedIPsSpec{Include: []string{"10.0.0.0/33"}},
+		},
+		{
+			name: "bad exclude",
+			spec: model.AllowedIPsSpec{Preset: model.PresetFullTunnel, Exclude: []string{"example.com"}},
+		},
+		{
+			name: "nothing left",
+			spec: model.AllowedIPsSpec{Preset: model.PresetVPNSubnet, Exclude: []string{"10.0.0.0/8", "fd00::/8"}},
+		},
+		{
+			name: "empty spec",
+			spec: model.AllowedIPsSpec{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := BuildAllowedIPs(test.spec, serverAddresses); err == nil {
+				t.Errorf("BuildAllowedIPs() error = nil, want an error")
+			}
+		})
+	}
+}
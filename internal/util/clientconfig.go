@@ -0,0 +1,263 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"vpn-wg/internal/model"
+)
+
+const (
+	ConfigFormatWgQuick        = "wg-quick"
+	ConfigFormatNetworkManager = "networkmanager"
+	ConfigFormatResolved       = "systemd-resolved"
+)
+
+// ClientDNS is the DNS setup of one peer. Default is set when all names go
+// to Servers, otherwise only the Routes apply.
+type ClientDNS struct {
+	Default       bool
+	Servers       []string
+	SearchDomains []string
+	Routes        []model.DNSRoute
+}
+
+// PeerDNS resolves the DNS setup of a peer. The servers and search domains
+// of the peer win over the embedded resolver, which wins over the settings.
+// Without the server DNS the resolver domain becomes a route, so peer names
+// still resolve.
+func PeerDNS(peer model.Peer, server model.Server, setting model.GlobalSetting) ClientDNS {
+	dns := ClientDNS{Routes: setting.DNSRoutes}
+	if server.Resolver != nil && !peer.UseServerDNS {
+		dns.Routes = append([]model.DNSRoute{{Domain: server.Resolver.Domain, Servers: server.Resolver.Addresses}}, dns.Routes...)
+	}
+	if !peer.UseServerDNS {
+		return dns
+	}
+
+	dns.Default = true
+	dns.Servers = setting.DNSServers
+	dns.SearchDomains = setting.SearchDomains
+	if server.Resolver != nil {
+		dns.Servers = server.Resolver.Addresses
+		dns.SearchDomains = append([]string{server.Resolver.Domain}, setting.SearchDomains...)
+	}
+	if len(peer.DNSServers) > 0 {
+		dns.Servers = peer.DNSServers
+	}
+	if len(peer.SearchDomains) > 0 {
+		dns.SearchDomains = peer.SearchDomains
+	}
+	return dns
+}
+
+// linkServers returns every server of the setup without duplicates. Split
+// DNS clients configure the servers per link and not per domain, so the
+// route servers join the default ones.
+func (d ClientDNS) linkServers() []string {
+	seen := make(map[string]bool)
+	servers := make([]string, 0, len(d.Servers))
+	add := func(values []string) {
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				servers = append(servers, value)
+			}
+		}
+	}
+	add(d.Servers)
+	for _, route := range d.Routes {
+		add(route.Servers)
+	}
+	return servers
+}
+
+// linkDomains returns the search domains followed by the routing domains
+// in the ~domain form, and ~. when all names go to the link
+func (d ClientDNS) linkDomains() []string {
+	domains := append([]string{}, d.SearchDomains...)
+	for _, route := range d.Routes {
+		domains = append(domains, "~"+strings.TrimSuffix(route.Domain, "."))
+	}
+	if d.Default {
+		domains = append(domains, "~.")
+	}
+	return domains
+}
+
+// BuildClientConfig renders the client config of a peer in one of the
+// ConfigFormat formats
+func BuildClientConfig(format string, peer model.Peer, server model.Server, setting model.GlobalSetting) (string, error) {
+	switch format {
+	case "", ConfigFormatWgQuick:
+		return BuildPeerConfig(peer, server, setting), nil
+	case ConfigFormatNetworkManager:
+		return BuildNetworkManagerConfig(peer, server, setting), nil
+	case ConfigFormatResolved:
+		return BuildResolvedScript(peer, server, setting), nil
+	}
+	return "", fmt.Errorf("unknown config format %q", format)
+}
+
+// BuildNetworkManagerConfig renders a NetworkManager keyfile connection
+// with the split DNS setup of the peer
+func BuildNetworkManagerConfig(peer model.Peer, server model.Server, setting model.GlobalSetting) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[connection]\n")
+	fmt.Fprintf(b, "id=%s\n", peer.Name)
+	fmt.Fprintf(b, "uuid=%s\n", peer.ID)
+	fmt.Fprintf(b, "type=wireguard\n")
+	fmt.Fprintf(b, "interface-name=wg0\n")
+
+	fmt.Fprintf(b, "\n[wireguard]\n")
+	fmt.Fprintf(b, "private-key=%s\n", peer.PrivateKey)
+	if setting.MTU > 0 {
+		fmt.Fprintf(b, "mtu=%d\n", setting.MTU)
+	}
+	if mark, err := strconv.ParseUint(setting.ForwardMark, 0, 32); err == nil {
+		fmt.Fprintf(b, "fwmark=%d\n", mark)
+	}
+
+	fmt.Fprintf(b, "\n[wireguard-peer.%s]\n", server.KeyPair.PublicKey)
+	fmt.Fprintf(b, "endpoint=%s\n", peerEndpoint(server, setting))
+	if peer.PresharedKey != "" {
+		fmt.Fprintf(b, "preshared-key=%s\n", peer.PresharedKey)
+		fmt.Fprintf(b, "preshared-key-flags=0\n")
+	}
+	if setting.PersistentKeepalive > 0 {
+		fmt.Fprintf(b, "persistent-keepalive=%d\n", setting.PersistentKeepalive)
+	}
+	fmt.Fprintf(b, "allowed-ips=%s\n", nmList(peer.AllowedIPs))
+
+	dns := PeerDNS(peer, server, setting)
+	servers := dns.linkServers()
+	for _, family := range []struct {
+		name string
+		v4   bool
+	}{{"ipv4", true}, {"ipv6", false}} {
+		addresses := make([]string, 0)
+		for _, cidr := range peer.AllocatedIPs {
+			if ip, _, err := net.ParseCIDR(cidr); err == nil && (ip.To4() != nil) == family.v4 {
+				addresses = append(addresses, cidr)
+			}
+		}
+		familyServers := make([]string, 0)
+		for _, server := range servers {
+			if ip := net.ParseIP(server); ip != nil && (ip.To4() != nil) == family.v4 {
+				familyServers = append(familyServers, server)
+			}
+		}
+
+		fmt.Fprintf(b, "\n[%s]\n", family.name)
+		if len(addresses) == 0 {
+			fmt.Fprintf(b, "method=disabled\n")
+			continue
+		}
+		fmt.Fprintf(b, "method=manual\n")
+		for i, address := range addresses {
+			fmt.Fprintf(b, "address%d=%s\n", i+1, address)
+		}
+		if len(familyServers) > 0 {
+			fmt.Fprintf(b, "dns=%s\n", nmList(familyServers))
+			fmt.Fprintf(b, "dns-search=%s\n", nmList(dns.linkDomains()))
+			if dns.Default {
+				// a negative priority keeps other connections from answering
+				fmt.Fprintf(b, "dns-priority=-50\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// BuildResolvedScript renders a script that applies the split DNS setup of
+// the peer to the tunnel link with resolvectl
+func BuildResolvedScript(peer model.Peer, server model.Server, setting model.GlobalSetting) string {
+	dns := PeerDNS(peer, server, setting)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#!/bin/sh\n")
+	fmt.Fprintf(b, "# DNS setup of %s for systemd-resolved, run it once the tunnel\n", peer.Name)
+	fmt.Fprintf(b, "# is up. The link defaults to wg0.\n")
+	fmt.Fprintf(b, "set -e\n")
+	fmt.Fprintf(b, "link=\"${1:-wg0}\"\n")
+	servers := dns.linkServers()
+	if len(servers) == 0 {
+		fmt.Fprintf(b, "resolvectl revert \"$link\"\n")
+		return b.String()
+	}
+	fmt.Fprintf(b, "resolvectl dns \"$link\" %s\n", strings.Join(servers, " "))
+	fmt.Fprintf(b, "resolvectl domain \"$link\" %s\n", strings.Join(dns.linkDomains(), " "))
+	fmt.Fprintf(b, "resolvectl default-route \"$link\" %t\n", dns.Default)
+	return b.String()
+}
+
+// nmList renders a NetworkManager keyfile list
+func nmList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.Join(values, ";") + ";"
+}
+
+// EffectiveSettings reports the client settings of a peer and the level
+// each one comes from. group is nil for peers outside a group.
+func EffectiveSettings(peer model.Peer, server model.Server, settings model.GlobalSetting, group *model.Group) model.EffectiveSettings {
+	resolved := settings
+	if group != nil {
+		resolved = group.ClientSettings(resolved)
+	}
+	resolved = peer.ClientSettings(resolved)
+	dns := PeerDNS(peer, server, resolved)
+	_, selected := peer.SelectedEndpoint(settings)
+
+	source := func(peerSet bool, resolverSet bool, groupSet bool) string {
+		switch {
+		case peerSet:
+			return model.SourcePeer
+		case resolverSet:
+			return model.SourceResolver
+		case groupSet:
+			return model.SourceGroup
+		}
+		return model.SourceSettings
+	}
+	inGroup := func(set func(model.Group) bool) bool {
+		return group != nil && set(*group)
+	}
+	// without the server DNS the peer decides that no DNS is rendered
+	noDNS := !peer.UseServerDNS
+
+	return model.EffectiveSettings{
+		DNSServers: model.EffectiveValue{
+			Value:  nonNil(dns.Servers),
+			Source: source(noDNS || len(peer.DNSServers) > 0, server.Resolver != nil, inGroup(func(g model.Group) bool { return len(g.DNSServers) > 0 })),
+		},
+		SearchDomains: model.EffectiveValue{
+			Value:  nonNil(dns.SearchDomains),
+			Source: source(noDNS || len(peer.SearchDomains) > 0, server.Resolver != nil, inGroup(func(g model.Group) bool { return len(g.SearchDomains) > 0 })),
+		},
+		MTU: model.EffectiveValue{
+			Value:  resolved.MTU,
+			Source: source(peer.MTU != nil, false, false),
+		},
+		PersistentKeepalive: model.EffectiveValue{
+			Value:  resolved.PersistentKeepalive,
+			Source: source(peer.PersistentKeepalive != nil, false, inGroup(func(g model.Group) bool { return g.PersistentKeepalive > 0 })),
+		},
+		ForwardMark: model.EffectiveValue{
+			Value:  resolved.ForwardMark,
+			Source: source(peer.ForwardMark != nil, false, false),
+		},
+		EndpointAddress: model.EffectiveValue{
+			Value:  peerEndpoint(server, resolved),
+			Source: source(peer.EndpointAddress != nil || selected, false, false),
+		},
+	}
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"vpn-wg/internal/model"
+)
+
+// NewEndpoint checks host and port and fills in the family. IPv6 literals
+// may be given with or without brackets.
+func NewEndpoint(name string, host string, port int) (model.Endpoint, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(host), "["), "]")
+	if host == "" {
+		return model.Endpoint{}, errors.New("host must not be empty")
+	}
+	if port < 0 || port > 65535 {
+		return model.Endpoint{}, fmt.Errorf("port %d must be between 1 and 65535", port)
+	}
+	endpoint := model.Endpoint{Name: name, Host: host, Port: port}
+	switch ip := net.ParseIP(host); {
+	case ip != nil && ip.To4() != nil:
+		endpoint.Family = model.FamilyIPv4
+	case ip != nil:
+		endpoint.Family = model.FamilyIPv6
+	case ValidateDomain(host):
+		endpoint.Family = model.FamilyHostname
+	default:
+		return model.Endpoint{}, fmt.Errorf("%q is neither an ip address nor a host name", host)
+	}
+	return endpoint, nil
+}
+
+// ParseEndpoint reads an endpoint address: a host name or IPv4 address with
+// an optional :port, a bare IPv6 address or [IPv6]:port
+func ParseEndpoint(address string) (model.Endpoint, error) {
+	address = strings.TrimSpace(address)
+	if net.ParseIP(address) != nil || !strings.Contains(address, ":") || strings.HasSuffix(address, "]") {
+		return NewEndpoint("", address, 0)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return model.Endpoint{}, fmt.Errorf("%q is not a valid endpoint, IPv6 addresses with a port need brackets", address)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n == 0 {
+		return model.Endpoint{}, fmt.Errorf("%q has an invalid port", address)
+	}
+	return NewEndpoint("", host, n)
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"vpn-wg/internal/cidrset"
+	"vpn-wg/internal/model"
+)
+
+const defaultLANInterface = "eth0"
+
+// WithRoutes returns the peer with the routes its AllowedIPs do not cover
+// yet appended to them
+func WithRoutes(peer model.Peer, routes []string) model.Peer {
+	allowed, err := cidrset.Parse(peer.AllowedIPs)
+	if err != nil {
+		return peer
+	}
+	extra := make([]string, 0)
+	for _, route := range routes {
+		set, err := cidrset.Parse([]string{route})
+		if err != nil || allowed.Contains(set) {
+			continue
+		}
+		extra = append(extra, route)
+		allowed = allowed.Union(set)
+	}
+	if len(extra) == 0 {
+		return peer
+	}
+	peer.AllowedIPs = append(append([]string{}, peer.AllowedIPs...), extra...)
+	return peer
+}
+
+// gatewayHints renders the PostUp and PostDown lines a router peer needs
+// to forward between the tunnel and its LAN
+func gatewayHints(peer model.Peer, server model.Server) string {
+	lan := peer.LANInterface
+	if lan == "" {
+		lan = defaultLANInterface
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# Gateway for %s on %s\n", strings.Join(peer.LANSubnets, ","), lan)
+	for _, family := range []struct {
+		v4       bool
+		sysctl   string
+		iptables string
+	}{
+		{true, "net.ipv4.ip_forward", "iptables"},
+		{false, "net.ipv6.conf.all.forwarding", "ip6tables"},
+	} {
+		subnets := familyCIDRs(peer.LANSubnets, family.v4)
+		if len(subnets) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "PostUp = sysctl -w %s=1\n", family.sysctl)
+		fmt.Fprintf(b, "PostUp = %[1]s -A FORWARD -i %%i -o %[2]s -j ACCEPT; %[1]s -A FORWARD -i %[2]s -o %%i -j ACCEPT\n", family.iptables, lan)
+		fmt.Fprintf(b, "PostDown = %[1]s -D FORWARD -i %%i -o %[2]s -j ACCEPT; %[1]s -D FORWARD -i %[2]s -o %%i -j ACCEPT\n", family.iptables, lan)
+		networks := familyCIDRs(server.Interface.Addresses, family.v4)
+		if len(networks) == 0 {
+			continue
+		}
+		if peer.LANMasquerade {
+			for _, network := range networks {
+				fmt.Fprintf(b, "PostUp = %s -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE\n", family.iptables, network, lan)
+				fmt.Fprintf(b, "PostDown = %s -t nat -D POSTROUTING -s %s -o %s -j MASQUERADE\n", family.iptables, network, lan)
+			}
+		} else {
+			fmt.Fprintf(b, "# Hosts in the LAN need a route to %s through this gateway\n", strings.Join(networks, ","))
+		}
+	}
+	return b.String()
+}
+
+// familyCIDRs returns the networks of the CIDRs of one address family
+func familyCIDRs(cidrs []string, v4 bool) []string {
+	networks := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip, network, err := net.ParseCIDR(cidr); err == nil && (ip.To4() != nil) == v4 {
+			networks = append(networks, network.String())
+		}
+	}
+	return networks
+}
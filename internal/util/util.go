@@ -4,14 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	externalip "github.com/glendc/go-external-ip"
-	"github.com/sdomino/scribble"
 	"github.com/sirupsen/logrus"
 	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 	"vpn-wg/internal/model"
 )
 
@@ -48,70 +45,26 @@ func LookupEnvOrInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
-func GetPublicIP() (model.Interface, error) {
-	cfg := externalip.ConsensusConfig{}
-	cfg.Timeout = time.Second * 5
-	consensus := externalip.NewConsensus(&cfg, nil)
-
-	// add trusted voters
-	consensus.AddVoter(externalip.NewHTTPSource("http://checkip.amazonaws.com/"), 1)
-	consensus.AddVoter(externalip.NewHTTPSource("http://whatismyip.akamai.com"), 1)
-	consensus.AddVoter(externalip.NewHTTPSource("http://ifconfig.top"), 1)
-
-	publicInterface := model.Interface{}
-	publicInterface.Name = "Public Address"
-
-	ip, err := consensus.ExternalIP()
-	if err != nil {
-		publicInterface.IPAddress = "N/A"
-	}
-	publicInterface.IPAddress = ip.String()
-
-	return publicInterface, err
-}
-
-func GetAllocatedIPs(ignorePeerID string) ([]string, error) {
+// CollectAllocatedIPs lists the server addresses and the addresses of the given peers
+func CollectAllocatedIPs(serverAddresses []string, peers []model.PeerData, ignorePeerID string) ([]string, error) {
 	allocatedIPs := make([]string, 0)
-	// initialize database directory TODO change normal init
-	dir := "./db"
-	db, err := scribble.New(dir, nil)
-	if err != nil {
-		return nil, err
-	}
-	// read server information
-	serverInterface := model.ServerInterface{}
-	if err := db.Read("server", "interfaces", &serverInterface); err != nil {
-		return nil, err
-	}
-	// append server's addresses to the result
-	for _, cidr := range serverInterface.Addresses {
+	for _, cidr := range serverAddresses {
 		ip, err := GetIPFromCIDR(cidr)
 		if err != nil {
 			return nil, err
 		}
 		allocatedIPs = append(allocatedIPs, ip)
 	}
-	// read peer information
-	records, err := db.ReadAll("clients")
-	if err != nil {
-		return nil, err
-	}
-	// append peer's addresses to the result
-	for _, f := range records {
-		peer := model.Peer{}
-		if err := json.Unmarshal([]byte(f), &peer); err != nil {
-			return nil, err
+	for _, peerData := range peers {
+		if peerData.Peer.ID == ignorePeerID {
+			continue
 		}
-
-		if peer.ID != ignorePeerID {
-			for _, cidr := range peer.AllocatedIPs {
-				ip, err := GetIPFromCIDR(cidr)
-				fmt.Println("ip", ip)
-				if err != nil {
-					return nil, err
-				}
-				allocatedIPs = append(allocatedIPs, ip)
+		for _, cidr := range peerData.Peer.AllocatedIPs {
+			ip, err := GetIPFromCIDR(cidr)
+			if err != nil {
+				return nil, err
 			}
+			allocatedIPs = append(allocatedIPs, ip)
 		}
 	}
 	return allocatedIPs, nil
@@ -172,6 +125,26 @@ func ValidateCIDR(cidr string) bool {
 	return true
 }
 
+// ValidateDomain to validate a domain name such as corp.example, a trailing
+// dot is allowed
+func ValidateDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // ValidateCIDRList to validate a list of network CIDR
 func ValidateCIDRList(cidrs []string, allowEmpty bool) bool {
 	for _, cidr := range cidrs {
@@ -211,8 +184,8 @@ func BuildPeerConfig(peer model.Peer, server model.Server, setting model.GlobalS
 	peerAddress := fmt.Sprintf("Address = %s\n", strings.Join(peer.AllocatedIPs, ","))
 	peerPrivateKey := fmt.Sprintf("PrivateKey = %s\n", peer.PrivateKey)
 	peerDNS := ""
-	if peer.UseServerDNS {
-		peerDNS = fmt.Sprintf("DNS = %s\n", strings.Join(setting.DNSServers, ","))
+	if dns := PeerDNS(peer, server, setting); dns.Default {
+		peerDNS = fmt.Sprintf("DNS = %s\n", strings.Join(append(append([]string{}, dns.Servers...), dns.SearchDomains...), ","))
 	}
 	peerMTU := ""
 	if setting.MTU > 0 {
@@ -228,18 +201,7 @@ func BuildPeerConfig(peer model.Peer, server model.Server, setting model.GlobalS
 
 	peerAllowedIPs := fmt.Sprintf("AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ","))
 
-	desiredHost := setting.EndpointAddress
-	desiredPort := server.Interface.ListenPort
-	if strings.Contains(desiredHost, ":") {
-		split := strings.Split(desiredHost, ":")
-		desiredHost = split[0]
-		if n, err := strconv.Atoi(split[1]); err == nil {
-			desiredPort = n
-		} else {
-			logrus.Error("Endpoint appears to be incorrectly formatted: ", err)
-		}
-	}
-	peerEndpoint := fmt.Sprintf("Endpoint = %s:%d\n", desiredHost, desiredPort)
+	peerEndpoint := fmt.Sprintf("Endpoint = %s\n", peerEndpoint(server, setting))
 
 	peerPersistentKeepalive := ""
 	if setting.PersistentKeepalive > 0 {
@@ -251,6 +213,11 @@ func BuildPeerConfig(peer model.Peer, server model.Server, setting model.GlobalS
 		forwardMark = fmt.Sprintf("FwMark = %s\n", setting.ForwardMark)
 	}
 
+	gateway := ""
+	if peer.Router() {
+		gateway = gatewayHints(peer, server)
+	}
+
 	// build the config as string
 	strConfig := "[Interface]\n" +
 		peerAddress +
@@ -258,6 +225,7 @@ func BuildPeerConfig(peer model.Peer, server model.Server, setting model.GlobalS
 		peerDNS +
 		peerMTU +
 		forwardMark +
+		gateway +
 		"\n[Peer]\n" +
 		peerPublicKey +
 		peerPresharedKey +
@@ -268,7 +236,20 @@ func BuildPeerConfig(peer model.Peer, server model.Server, setting model.GlobalS
 	return strConfig
 }
 
-func GetAvailableIP(cidr string, allocatedList []string) (string, error) {
+// peerEndpoint returns the host:port peers connect to, the port defaults to
+// the listen port
+func peerEndpoint(server model.Server, setting model.GlobalSetting) string {
+	endpoint, err := ParseEndpoint(setting.EndpointAddress)
+	if err != nil {
+		logrus.WithError(err).Error("Endpoint appears to be incorrectly formatted")
+		return setting.EndpointAddress
+	}
+	return endpoint.Address(server.Interface.ListenPort)
+}
+
+// GetAvailableIP returns the first address of cidr that is neither in
+// allocatedList nor inside one of the reserved networks
+func GetAvailableIP(cidr string, allocatedList []string, reserved ...*net.IPNet) (string, error) {
 	ip, net, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return "", err
@@ -286,6 +267,12 @@ func GetAvailableIP(cidr string, allocatedList []string) (string, error) {
 				break
 			}
 		}
+		for _, network := range reserved {
+			if network.Contains(ip) {
+				available = false
+				break
+			}
+		}
 		if available && suggestedAddr != networkAddr && suggestedAddr != broadcastAddr {
 			return suggestedAddr, nil
 		}
@@ -294,6 +281,18 @@ func GetAvailableIP(cidr string, allocatedList []string) (string, error) {
 	return "", errors.New("no more available ip address")
 }
 
+// NetworksOverlap reports whether two networks share any address
+func NetworksOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// NetworkContains reports whether inner lies completely inside outer
+func NetworkContains(outer *net.IPNet, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
 func GetBroadcastIP(n *net.IPNet) net.IP {
 	var broadcast net.IP
 	if len(n.IP) == 4 {
@@ -306,3 +305,35 @@ func GetBroadcastIP(n *net.IPNet) net.IP {
 	}
 	return broadcast
 }
+
+// ApplyMergePatch applies an RFC 7396 JSON merge patch to a JSON document
+func ApplyMergePatch(document []byte, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	var changes interface{}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(target, changes))
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
@@ -0,0 +1,64 @@
+package wgdevice
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"time"
+)
+
+// PeerStats is the runtime state the kernel keeps for a single peer
+type PeerStats struct {
+	PublicKey         string    `json:"public_key"`
+	Endpoint          string    `json:"endpoint"`
+	LastHandshakeTime time.Time `json:"last_handshake_time"`
+	ReceiveBytes      int64     `json:"receive_bytes"`
+	TransmitBytes     int64     `json:"transmit_bytes"`
+}
+
+type Reader interface {
+	// Peers returns the stats of every peer on the device keyed by public key
+	Peers() (map[string]PeerStats, error)
+}
+
+type WgctrlReader struct {
+	name string
+}
+
+func New(name string) *WgctrlReader {
+	return &WgctrlReader{name: name}
+}
+
+func (r *WgctrlReader) Peers() (map[string]PeerStats, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	device, err := client.Device(r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make(map[string]PeerStats, len(device.Peers))
+	for _, p := range device.Peers {
+		stats := PeerStats{
+			PublicKey:         p.PublicKey.String(),
+			LastHandshakeTime: p.LastHandshakeTime,
+			ReceiveBytes:      p.ReceiveBytes,
+			TransmitBytes:     p.TransmitBytes,
+		}
+		if p.Endpoint != nil {
+			stats.Endpoint = p.Endpoint.String()
+		}
+		peers[stats.PublicKey] = stats
+	}
+	return peers, nil
+}
+
+// OnlineThreshold is how recent a handshake must be for a peer to count as online.
+// WireGuard re-handshakes every two minutes while traffic flows.
+const OnlineThreshold = 3 * time.Minute
+
+func (s PeerStats) Online(now time.Time) bool {
+	return !s.LastHandshakeTime.IsZero() && now.Sub(s.LastHandshakeTime) < OnlineThreshold
+}